@@ -93,6 +93,11 @@ func (ch *Chain) CheckBlock(bl *Block) (er error, dos bool, maybelater bool) {
 				dos = true
 				return
 			}
+			if !bl.Txs[i].IsFinal(prevblk.Height+1, bl.BlockTime()) {
+				er = errors.New("CheckBlock() : Contains transaction that is not final")
+				dos = true
+				return
+			}
 		}
 	}
 
@@ -12,6 +12,7 @@ var AbortNow bool  // set it to true to abort any activity
 type Chain struct {
 	Blocks *BlockDB      // blockchain.dat and blockchain.idx
 	Unspent *UnspentDB    // unspent folder
+	Filters *FilterDB     // blockfilters.dat and blockfilters.idx
 
 	BlockTreeRoot *BlockTreeNode
 	BlockTreeEnd *BlockTreeNode
@@ -31,6 +32,7 @@ func NewChain(dbrootdir string, genesis *Uint256, rescan bool) (ch *Chain) {
 	ch.Genesis = genesis
 	ch.Blocks = NewBlockDB(dbrootdir)
 	ch.Unspent = NewUnspentDb(dbrootdir, rescan)
+	ch.Filters = NewFilterDB(dbrootdir)
 
 	if AbortNow {
 		return
@@ -41,6 +43,10 @@ func NewChain(dbrootdir string, genesis *Uint256, rescan bool) (ch *Chain) {
 		return
 	}
 
+	if _, _, ok := ch.Filters.Headers(ch.Genesis); !ok {
+		ch.Filters.Add(0, ch.Genesis.Hash[:], NewGCSFilter(ch.Genesis.Hash[:], [][]byte{GenesisPkScript}), make([]byte, 32))
+	}
+
 	if rescan {
 		ch.BlockTreeEnd = ch.BlockTreeRoot
 	}
@@ -62,6 +68,7 @@ func NewChain(dbrootdir string, genesis *Uint256, rescan bool) (ch *Chain) {
 func (ch *Chain) Sync() {
 	ch.DoNotSync = false
 	ch.Blocks.Sync()
+	ch.Filters.Sync()
 }
 
 
@@ -75,6 +82,7 @@ func (ch *Chain) Idle() bool {
 // Save all the databases. Defragment when needed.
 func (ch *Chain) Save() {
 	ch.Blocks.Sync()
+	ch.Filters.Sync()
 	ch.Unspent.Save()
 }
 
@@ -96,6 +104,7 @@ func (ch *Chain) Stats() (s string) {
 		len(ch.BlockIndex), ch.DoNotSync, ch.BlockTreeEnd.Height)
 	ch.BlockIndexAccess.Unlock()
 	s += ch.Blocks.GetStats()
+	s += ch.Filters.GetStats()
 	s += ch.Unspent.GetStats()
 	return
 }
@@ -104,6 +113,7 @@ func (ch *Chain) Stats() (s string) {
 // Close the databases.
 func (ch *Chain) Close() {
 	ch.Blocks.Close()
+	ch.Filters.Close()
 	ch.Unspent.Close()
 }
 
@@ -116,6 +126,17 @@ func (ch *Chain) GetAllUnspent(addr []*BtcAddr, quick bool) AllUnspentTx {
 }
 
 
+// Checks the given output scripts against the block's BIP158 filter.
+// Returns true if the block may contain any of them.
+func (ch *Chain) MatchBlockFilter(blockhash *Uint256, scripts [][]byte) (bool, error) {
+	f, e := ch.Filters.Get(blockhash)
+	if e != nil {
+		return false, e
+	}
+	return f.MatchAny(blockhash.Hash[:], scripts)
+}
+
+
 // Returns true if we are on Testnet3 chain
 func (ch *Chain) testnet() bool {
 	return ch.Genesis.Hash[0]==0x43 // it's simple, but works
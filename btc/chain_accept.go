@@ -9,6 +9,10 @@ import (
 // been verified already by the client while being taken to its memory pool
 var TrustedTxChecker func(*Uint256) bool
 
+// BlockDisconnected, if set, gets called for each block that is being
+// taken off the top of the chain, when switching to a different branch.
+var BlockDisconnected func(*Block)
+
 
 func (ch *Chain) ProcessBlockTransactions(bl *Block, height uint32) (changes *BlockChanges, e error) {
 	changes = new(BlockChanges)
@@ -67,6 +71,7 @@ func (ch *Chain)AcceptBlock(bl *Block) (e error) {
 			// Apply the block's trabnsactions to the unspent database:
 			changes.LastKnownHeight = bl.LastKnownHeight
 			ch.Unspent.CommitBlockTxs(changes, bl.Hash.Hash[:])
+			ch.addBlockFilter(bl, changes)
 			if !ch.DoNotSync {
 				ch.Blocks.Sync()
 			}
@@ -91,6 +96,20 @@ func (ch *Chain)AcceptBlock(bl *Block) (e error) {
 }
 
 
+// Builds BIP158 filter of a block that has just been applied to the unspent database
+func (ch *Chain) addBlockFilter(bl *Block, changes *BlockChanges) {
+	_, prvhdr, ok := ch.Filters.Headers(NewUint256(bl.ParentHash()))
+	if !ok {
+		return // parent's filter unknown (block database created by older version) - rescan needed
+	}
+	prevouts := make([][]byte, 0, len(changes.DeledTxs))
+	for _, v := range changes.DeledTxs {
+		prevouts = append(prevouts, v.Pk_script)
+	}
+	ch.Filters.Add(changes.Height, bl.Hash.Hash[:], NewBasicFilter(bl, prevouts), prvhdr)
+}
+
+
 // This isusually the most time consuming process when applying a new block
 func (ch *Chain)commitTxs(bl *Block, changes *BlockChanges) (e error) {
 	sumblockin := GetBlockReward(changes.Height)
@@ -66,6 +66,7 @@ func (ch *Chain) ParseTillBlock(end *BlockTreeNode) {
 
 		changes.LastKnownHeight = end.Height
 		ch.Unspent.CommitBlockTxs(changes, bl.Hash.Hash[:])
+		ch.addBlockFilter(bl, changes)
 
 		ch.BlockTreeEnd = nxt
 	}
@@ -163,6 +164,10 @@ func (ch *Chain)MoveToBlock(dst *BlockTreeNode) {
 			fmt.Printf("->orph block %s @ %d\n", ch.BlockTreeEnd.BlockHash.String(),
 				ch.BlockTreeEnd.Height)
 		}
+		if BlockDisconnected!=nil {
+			ch.notifyDisconnected(ch.BlockTreeEnd)
+		}
+		ch.Filters.Remove(ch.BlockTreeEnd.BlockHash.Hash[:])
 		ch.Unspent.UndoBlockTransactions(ch.BlockTreeEnd.Height)
 		ch.BlockTreeEnd = ch.BlockTreeEnd.Parent
 		cur = cur.Parent
@@ -174,6 +179,25 @@ func (ch *Chain)MoveToBlock(dst *BlockTreeNode) {
 }
 
 
+// Passes the block that is being orphaned to BlockDisconnected
+func (ch *Chain) notifyDisconnected(n *BlockTreeNode) {
+	raw, _, er := ch.Blocks.BlockGet(n.BlockHash)
+	if er != nil {
+		println("notifyDisconnected:", er.Error())
+		return
+	}
+	bl, er := NewBlock(raw)
+	if er == nil {
+		er = bl.BuildTxList()
+	}
+	if er != nil {
+		println("notifyDisconnected:", er.Error())
+		return
+	}
+	BlockDisconnected(bl)
+}
+
+
 // Returns a common parent with the highest height
 func (cur *BlockTreeNode)FirstCommonParent(dst *BlockTreeNode) *BlockTreeNode {
 	if cur.Height > dst.Height {
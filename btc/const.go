@@ -18,6 +18,8 @@ const(
 	GenesisBlockTime = 1231006505
 
 	BIP16SwitchTime = 1333238400 // BIP16 didn't become active until Apr 1 2012
+
+	LOCKTIME_THRESHOLD = 500000000 // Lock_time below it is a block height, otherwise a unix time
 )
 
 // Increase the number of threads to optimize txs verification time,
@@ -0,0 +1,199 @@
+package btc
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"errors"
+	"encoding/binary"
+)
+
+const (
+	FILTER_REMOVED = 0x01
+)
+
+/*
+	blockfilters.dat - contains raw BIP158 basic filters (as in "cfilter" message)
+	blockfilters.idx - contains records of 116 bytes (all values LSB):
+		[0] - flags:
+			bit(0) - "removed" flag - the block has been disconnected (orphaned)
+		[4:36]  - 256-bit block hash
+		[36:40] - 32-bit block height
+		[40:48] - 64-bit filter pos in blockfilters.dat file
+		[48:52] - 32-bit filter lenght in bytes
+		[52:84] - 256-bit filter hash
+		[84:116] - 256-bit filter header
+	A record of a later "removed" block overwrites the previous one.
+*/
+
+type oneFilter struct {
+	height uint32
+	fpos uint64
+	flen uint32
+	hash [32]byte
+	header [32]byte
+}
+
+type FilterDB struct {
+	dirname string
+	index map[[Uint256IdxLen]byte] *oneFilter
+	filterdata *os.File
+	filterindx *os.File
+	mutex sync.Mutex
+}
+
+
+func NewFilterDB(dir string) (db *FilterDB) {
+	db = new(FilterDB)
+	db.dirname = dir
+	if db.dirname!="" && db.dirname[len(db.dirname )-1]!='/' && db.dirname[len(db.dirname )-1]!='\\' {
+		db.dirname += "/"
+	}
+	db.index = make(map[[Uint256IdxLen]byte] *oneFilter)
+	os.MkdirAll(db.dirname, 0770)
+	db.filterdata, _ = os.OpenFile(db.dirname+"blockfilters.dat", os.O_RDWR|os.O_CREATE, 0660)
+	if db.filterdata == nil {
+		panic("Cannot open blockfilters.dat")
+	}
+	db.filterindx, _ = os.OpenFile(db.dirname+"blockfilters.idx", os.O_RDWR|os.O_CREATE, 0660)
+	if db.filterindx == nil {
+		panic("Cannot open blockfilters.idx")
+	}
+	db.loadIndex()
+	return
+}
+
+
+func (db *FilterDB) loadIndex() {
+	var b [116]byte
+	var maxdatfilepos int64
+	validpos, _ := db.filterindx.Seek(0, os.SEEK_SET)
+	for !AbortNow {
+		if n, _ := db.filterindx.Read(b[:]); n!=len(b) {
+			break
+		}
+		validpos += int64(len(b))
+		idx := NewUint256(b[4:36]).BIdx()
+		if (b[0]&FILTER_REMOVED) != 0 {
+			delete(db.index, idx)
+			continue
+		}
+		of := new(oneFilter)
+		of.height = binary.LittleEndian.Uint32(b[36:40])
+		of.fpos = binary.LittleEndian.Uint64(b[40:48])
+		of.flen = binary.LittleEndian.Uint32(b[48:52])
+		copy(of.hash[:], b[52:84])
+		copy(of.header[:], b[84:116])
+		db.index[idx] = of
+		if int64(of.fpos)+int64(of.flen) > maxdatfilepos {
+			maxdatfilepos = int64(of.fpos)+int64(of.flen)
+		}
+	}
+	// In case if there was some trash at the end of data or index file, this should truncate it:
+	db.filterindx.Seek(validpos, os.SEEK_SET)
+	db.filterdata.Seek(maxdatfilepos, os.SEEK_SET)
+}
+
+
+func (db *FilterDB) writeRecord(flags byte, hash []byte, of *oneFilter) {
+	var b [116]byte
+	b[0] = flags
+	copy(b[4:36], hash)
+	binary.LittleEndian.PutUint32(b[36:40], of.height)
+	binary.LittleEndian.PutUint64(b[40:48], of.fpos)
+	binary.LittleEndian.PutUint32(b[48:52], of.flen)
+	copy(b[52:84], of.hash[:])
+	copy(b[84:116], of.header[:])
+	db.filterindx.Write(b[:])
+}
+
+
+// Stores a filter of the given block. prevheader is the filter header of the parent block.
+func (db *FilterDB) Add(height uint32, blockhash []byte, f *BlockFilter, prevheader []byte) (e error) {
+	dat := f.Bytes()
+	of := new(oneFilter)
+	of.height = height
+	of.flen = uint32(len(dat))
+	copy(of.hash[:], f.Hash())
+	copy(of.header[:], FilterHeader(of.hash[:], prevheader))
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	pos, e := db.filterdata.Seek(0, os.SEEK_END)
+	if e != nil {
+		return
+	}
+	if _, e = db.filterdata.Write(dat); e != nil {
+		return
+	}
+	of.fpos = uint64(pos)
+	db.writeRecord(0, blockhash, of)
+	db.index[NewUint256(blockhash).BIdx()] = of
+	return
+}
+
+
+// Removes the filter of a block that is being disconnected from the chain
+func (db *FilterDB) Remove(blockhash []byte) {
+	idx := NewUint256(blockhash).BIdx()
+	db.mutex.Lock()
+	if of, ok := db.index[idx]; ok {
+		db.writeRecord(FILTER_REMOVED, blockhash, of)
+		delete(db.index, idx)
+	}
+	db.mutex.Unlock()
+}
+
+
+// Returns the filter hash and the filter header of the given block
+func (db *FilterDB) Headers(blockhash *Uint256) (hash, header []byte, ok bool) {
+	var of *oneFilter
+	db.mutex.Lock()
+	of, ok = db.index[blockhash.BIdx()]
+	db.mutex.Unlock()
+	if ok {
+		hash, header = of.hash[:], of.header[:]
+	}
+	return
+}
+
+
+// Returns the filter of the given block
+func (db *FilterDB) Get(blockhash *Uint256) (f *BlockFilter, e error) {
+	db.mutex.Lock()
+	of, ok := db.index[blockhash.BIdx()]
+	db.mutex.Unlock()
+	if !ok {
+		e = errors.New("Filter not in the index")
+		return
+	}
+	dat := make([]byte, of.flen)
+	if _, e = db.filterdata.ReadAt(dat, int64(of.fpos)); e != nil {
+		return
+	}
+	f, e = NewBlockFilter(dat)
+	return
+}
+
+
+func (db *FilterDB) GetStats() (s string) {
+	db.mutex.Lock()
+	s = fmt.Sprintf("FilterDB: %d filters\n", len(db.index))
+	db.mutex.Unlock()
+	return
+}
+
+
+// Flush all the data to files
+func (db *FilterDB) Sync() {
+	db.mutex.Lock()
+	db.filterindx.Sync()
+	db.filterdata.Sync()
+	db.mutex.Unlock()
+}
+
+
+func (db *FilterDB) Close() {
+	db.filterindx.Close()
+	db.filterdata.Close()
+}
@@ -0,0 +1,297 @@
+package btc
+
+import (
+	"sort"
+	"errors"
+	"encoding/hex"
+	"encoding/binary"
+)
+
+// BIP158 basic filter parameters
+const (
+	BasicFilterType = 0
+	BasicFilterP = 19
+	BasicFilterM = 784931
+)
+
+// Script of the genesis block's only output (the same for mainnet and testnet3).
+// We need it, because the genesis block itself is never processed by the chain.
+var GenesisPkScript, _ = hex.DecodeString("4104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac")
+
+
+// BlockFilter is a Golomb-coded set, as described in BIP158
+type BlockFilter struct {
+	N uint32  // number of items in the set
+	Data []byte  // golomb-rice coded deltas
+}
+
+
+func rotl64(x uint64, b uint) uint64 {
+	return (x<<b) | (x>>(64-b))
+}
+
+
+// SipHash-2-4 of the data, with the key given as two 64-bit words
+func SipHash(k0, k1 uint64, p []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1; v1 = rotl64(v1, 13); v1 ^= v0; v0 = rotl64(v0, 32)
+		v2 += v3; v3 = rotl64(v3, 16); v3 ^= v2
+		v0 += v3; v3 = rotl64(v3, 21); v3 ^= v0
+		v2 += v1; v1 = rotl64(v1, 17); v1 ^= v2; v2 = rotl64(v2, 32)
+	}
+
+	l := len(p)
+	for len(p) >= 8 {
+		m := binary.LittleEndian.Uint64(p)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+		p = p[8:]
+	}
+
+	var last [8]byte
+	copy(last[:], p)
+	last[7] = byte(l)
+	m := binary.LittleEndian.Uint64(last[:])
+	v3 ^= m
+	round()
+	round()
+	v0 ^= m
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+
+// Returns upper 64 bits of a 128-bit product
+func mulHi64(a, b uint64) uint64 {
+	a_lo, a_hi := a&0xffffffff, a>>32
+	b_lo, b_hi := b&0xffffffff, b>>32
+	t := a_hi*b_lo + (a_lo*b_lo)>>32
+	w1 := (t&0xffffffff) + a_lo*b_hi
+	return a_hi*b_hi + (t>>32) + (w1>>32)
+}
+
+
+// Maps the items into the [0, n*M) range, using the block hash as the siphash key
+func hashFilterItems(blockhash []byte, items [][]byte, n uint32) (res []uint64) {
+	k0 := binary.LittleEndian.Uint64(blockhash[0:8])
+	k1 := binary.LittleEndian.Uint64(blockhash[8:16])
+	f := uint64(n) * BasicFilterM
+	res = make([]uint64, len(items))
+	for i := range items {
+		res[i] = mulHi64(SipHash(k0, k1, items[i]), f)
+	}
+	sort.Sort(uint64Slice(res))
+	return
+}
+
+
+type uint64Slice []uint64
+
+func (x uint64Slice) Len() int { return len(x) }
+func (x uint64Slice) Less(i, j int) bool { return x[i] < x[j] }
+func (x uint64Slice) Swap(i, j int) { x[i], x[j] = x[j], x[i] }
+
+
+type bitWriter struct {
+	buf []byte
+	nbits uint
+}
+
+func (w *bitWriter) writeBit(b bool) {
+	if (w.nbits&7)==0 {
+		w.buf = append(w.buf, 0)
+	}
+	if b {
+		w.buf[len(w.buf)-1] |= 0x80 >> (w.nbits&7)
+	}
+	w.nbits++
+}
+
+func (w *bitWriter) writeBits(v uint64, n uint) {
+	for n > 0 {
+		n--
+		w.writeBit(((v>>n)&1) != 0)
+	}
+}
+
+
+type bitReader struct {
+	buf []byte
+	pos uint
+}
+
+func (r *bitReader) readBit() (b bool, e error) {
+	if r.pos>>3 >= uint(len(r.buf)) {
+		e = errors.New("bitReader: end of data")
+		return
+	}
+	b = (r.buf[r.pos>>3] & (0x80 >> (r.pos&7))) != 0
+	r.pos++
+	return
+}
+
+func (r *bitReader) readBits(n uint) (v uint64, e error) {
+	var b bool
+	for ; n > 0; n-- {
+		if b, e = r.readBit(); e != nil {
+			return
+		}
+		v <<= 1
+		if b {
+			v |= 1
+		}
+	}
+	return
+}
+
+func (r *bitReader) readGolomb() (v uint64, e error) {
+	var b bool
+	for {
+		if b, e = r.readBit(); e != nil {
+			return
+		}
+		if !b {
+			break
+		}
+		v++
+	}
+	var rem uint64
+	rem, e = r.readBits(BasicFilterP)
+	v = (v<<BasicFilterP) | rem
+	return
+}
+
+
+// Builds a BIP158 filter of the given items (duplicates and empty items are skipped)
+func NewGCSFilter(blockhash []byte, items [][]byte) (f *BlockFilter) {
+	uniq := make(map[string]bool, len(items))
+	var its [][]byte
+	for i := range items {
+		if len(items[i])>0 && !uniq[string(items[i])] {
+			uniq[string(items[i])] = true
+			its = append(its, items[i])
+		}
+	}
+	f = new(BlockFilter)
+	f.N = uint32(len(its))
+	w := new(bitWriter)
+	var last uint64
+	for _, v := range hashFilterItems(blockhash, its, f.N) {
+		d := v - last
+		for q := d>>BasicFilterP; q > 0; q-- {
+			w.writeBit(true)
+		}
+		w.writeBit(false)
+		w.writeBits(d, BasicFilterP)
+		last = v
+	}
+	f.Data = w.buf
+	return
+}
+
+
+// Builds the basic filter of a block. The block must have its tx list built.
+// prevouts are the scripts of the outputs spent by the block's transactions.
+func NewBasicFilter(bl *Block, prevouts [][]byte) *BlockFilter {
+	items := prevouts
+	for i := range bl.Txs {
+		for j := range bl.Txs[i].TxOut {
+			scr := bl.Txs[i].TxOut[j].Pk_script
+			if len(scr)>0 && scr[0]!=0x6a /*OP_RETURN*/ {
+				items = append(items, scr)
+			}
+		}
+	}
+	return NewGCSFilter(bl.Hash.Hash[:], items)
+}
+
+
+// Decodes a filter serialized with BlockFilter.Bytes()
+func NewBlockFilter(b []byte) (f *BlockFilter, e error) {
+	n, l := VLen(b)
+	if l==0 {
+		e = errors.New("NewBlockFilter: data too short")
+		return
+	}
+	f = new(BlockFilter)
+	f.N = uint32(n)
+	f.Data = b[l:]
+	return
+}
+
+
+// Serializes the filter the way it is used in the "cfilter" message
+func (f *BlockFilter) Bytes() []byte {
+	var buf [9]byte
+	l := int(PutVlen(buf[:], int(f.N)))
+	res := make([]byte, l+len(f.Data))
+	copy(res, buf[:l])
+	copy(res[l:], f.Data)
+	return res
+}
+
+
+// Returns double SHA256 of the serialized filter
+func (f *BlockFilter) Hash() []byte {
+	h := Sha2Sum(f.Bytes())
+	return h[:]
+}
+
+
+// Calculates the filter header, given the filter hash and the previous filter header
+func FilterHeader(filterhash, prevheader []byte) []byte {
+	var buf [64]byte
+	copy(buf[:32], filterhash)
+	copy(buf[32:], prevheader)
+	h := Sha2Sum(buf[:])
+	return h[:]
+}
+
+
+// Returns true if any of the items (i.e. wallet's output scripts) may be in the filter.
+// False positive rate is 1/M for each item.
+func (f *BlockFilter) MatchAny(blockhash []byte, items [][]byte) (yes bool, e error) {
+	if f.N==0 || len(items)==0 {
+		return
+	}
+	hs := hashFilterItems(blockhash, items, f.N)
+	r := &bitReader{buf:f.Data}
+	var val uint64
+	var idx int
+	for i:=uint32(0); i<f.N; i++ {
+		var d uint64
+		if d, e = r.readGolomb(); e != nil {
+			return
+		}
+		val += d
+		for idx<len(hs) && hs[idx]<val {
+			idx++
+		}
+		if idx==len(hs) {
+			return
+		}
+		if hs[idx]==val {
+			yes = true
+			return
+		}
+	}
+	return
+}
+
+
+// Returns true if the item may be in the filter
+func (f *BlockFilter) Match(blockhash []byte, item []byte) (bool, error) {
+	return f.MatchAny(blockhash, [][]byte{item})
+}
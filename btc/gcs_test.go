@@ -0,0 +1,74 @@
+package btc
+
+import (
+	"bytes"
+	"testing"
+	"encoding/hex"
+)
+
+func TestSipHash(t *testing.T) {
+	var msg [15]byte
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	k0, k1 := uint64(0x0706050403020100), uint64(0x0f0e0d0c0b0a0908)
+	if h := SipHash(k0, k1, nil); h!=0x726fdb47dd0e0e31 {
+		t.Errorf("SipHash of empty msg: %x", h)
+	}
+	if h := SipHash(k0, k1, msg[:]); h!=0xa129ca6149be45e5 {
+		t.Errorf("SipHash of 15 bytes: %x", h)
+	}
+}
+
+
+func TestGenesisFilter(t *testing.T) {
+	// BIP158 test vector: testnet3 genesis block
+	bh := NewUint256FromString("000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943")
+	f := NewGCSFilter(bh.Hash[:], [][]byte{GenesisPkScript})
+	if hex.EncodeToString(f.Bytes())!="019dfca8" {
+		t.Error("Bad genesis filter", hex.EncodeToString(f.Bytes()))
+	}
+	hdr := FilterHeader(f.Hash(), make([]byte, 32))
+	if NewUint256(hdr).String()!="21584579b7eb08997773e5aeff3a7f932700042d0ed2a6129012b7d7ae81b750" {
+		t.Error("Bad genesis filter header", NewUint256(hdr).String())
+	}
+	if ok, _ := f.Match(bh.Hash[:], GenesisPkScript); !ok {
+		t.Error("Genesis script not matched")
+	}
+}
+
+
+func TestGCSFilter(t *testing.T) {
+	bh := NewSha2Hash([]byte("block"))
+	var items [][]byte
+	for i:=0; i<200; i++ {
+		items = append(items, []byte{0x76, 0xa9, byte(i), byte(i>>8)})
+	}
+	f, e := NewBlockFilter(NewGCSFilter(bh.Hash[:], items).Bytes())
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if f.N!=200 {
+		t.Error("Bad N", f.N)
+	}
+	for i := range items {
+		if ok, e := f.Match(bh.Hash[:], items[i]); !ok || e!=nil {
+			t.Error("Item not matched", i, e)
+		}
+	}
+	var fp int
+	for i:=0; i<1000; i++ {
+		if ok, _ := f.Match(bh.Hash[:], []byte{0xa9, byte(i), byte(i>>8)}); ok {
+			fp++
+		}
+	}
+	if fp > 2 {
+		t.Error("Too many false positives", fp)
+	}
+	if ok, _ := f.MatchAny(bh.Hash[:], [][]byte{[]byte("none"), items[77]}); !ok {
+		t.Error("MatchAny failed")
+	}
+	if !bytes.Equal(NewGCSFilter(bh.Hash[:], append(items, items[5], nil)).Bytes(), f.Bytes()) {
+		t.Error("Duplicated and empty items should be ignored")
+	}
+}
@@ -0,0 +1,364 @@
+package btc
+
+import (
+	"bytes"
+	"errors"
+	"encoding/binary"
+)
+
+// MerkleBranch proves that a transaction is included in a block.
+// Hashes are the siblings along the path from the tx to the root (bottom first).
+type MerkleBranch struct {
+	TxHash *Uint256
+	Index uint32 // position of the transaction inside the block
+	Hashes [][]byte
+}
+
+
+func merkleHashPair(a, b []byte) []byte {
+	var buf [64]byte
+	copy(buf[:32], a)
+	copy(buf[32:], b)
+	h := Sha2Sum(buf[:])
+	return h[:]
+}
+
+
+// Returns merkle branch of the transaction with the given index
+func GetMerkleBranch(txs []*Tx, idx int) (hashes [][]byte) {
+	level := make([][]byte, len(txs))
+	for i := range txs {
+		level[i] = txs[i].Hash.Hash[:]
+	}
+	for len(level) > 1 {
+		sibling := idx^1
+		if sibling >= len(level) {
+			sibling = idx // the last one at an odd level gets paired with itself
+		}
+		hashes = append(hashes, level[sibling])
+
+		next := make([][]byte, (len(level)+1)/2)
+		for i := range next {
+			if 2*i+1 < len(level) {
+				next[i] = merkleHashPair(level[2*i], level[2*i+1])
+			} else {
+				next[i] = merkleHashPair(level[2*i], level[2*i])
+			}
+		}
+		level = next
+		idx >>= 1
+	}
+	return
+}
+
+
+// Builds a merkle branch for the block's transaction with the given index
+func (bl *Block) GetMerkleBranch(idx int) (mb *MerkleBranch, e error) {
+	if bl.Txs==nil {
+		if e = bl.BuildTxList(); e != nil {
+			return
+		}
+	}
+	if idx<0 || idx>=len(bl.Txs) {
+		e = errors.New("GetMerkleBranch: tx index out of range")
+		return
+	}
+	mb = new(MerkleBranch)
+	mb.TxHash = bl.Txs[idx].Hash
+	mb.Index = uint32(idx)
+	mb.Hashes = GetMerkleBranch(bl.Txs, idx)
+	return
+}
+
+
+// Calculates the merkle root that the branch leads to
+func (mb *MerkleBranch) Root() []byte {
+	h := mb.TxHash.Hash[:]
+	idx := mb.Index
+	for i := range mb.Hashes {
+		if (idx&1) != 0 {
+			h = merkleHashPair(mb.Hashes[i], h)
+		} else {
+			h = merkleHashPair(h, mb.Hashes[i])
+		}
+		idx >>= 1
+	}
+	return h
+}
+
+
+// Returns true if the branch leads to the given merkle root (i.e. Block.MerkleRoot())
+func (mb *MerkleBranch) Verify(merkleroot []byte) bool {
+	if len(mb.Hashes)>=32 || (mb.Index>>uint(len(mb.Hashes)))!=0 {
+		return false // the index does not fit into the tree
+	}
+	return bytes.Equal(mb.Root(), merkleroot)
+}
+
+
+/*
+Serialized merkle branch:
+ [0:32] - transaction hash
+ [32:36] - transaction index in the block (LSB)
+ var_int - number of hashes
+ 32 bytes for each hash
+*/
+func (mb *MerkleBranch) Bytes() []byte {
+	var buf [9]byte
+	wr := new(bytes.Buffer)
+	wr.Write(mb.TxHash.Hash[:])
+	binary.Write(wr, binary.LittleEndian, mb.Index)
+	wr.Write(buf[:PutVlen(buf[:], len(mb.Hashes))])
+	for i := range mb.Hashes {
+		wr.Write(mb.Hashes[i])
+	}
+	return wr.Bytes()
+}
+
+
+// Decodes var_int count of items (each size bytes long) that must fit in the rest of b.
+// Unlike VLen, it does not panic on huge values - it returns n==0 if the items do not fit.
+func itemsCount(b []byte, size int) (cnt int, n int) {
+	if len(b)==0 {
+		return
+	}
+	if b[0] < 0xfd {
+		cnt, n = int(b[0]), 1
+	} else {
+		n = 1 + (2 << (2-(0xff-b[0])))
+		if len(b) < n {
+			return 0, 0
+		}
+		var res uint64
+		for i:=1; i<n; i++ {
+			res |= uint64(b[i]) << uint(8*(i-1))
+		}
+		if res > uint64(len(b)) {
+			return 0, 0
+		}
+		cnt = int(res)
+	}
+	if cnt > (len(b)-n)/size {
+		return 0, 0
+	}
+	return
+}
+
+
+// Decodes a merkle branch serialized with MerkleBranch.Bytes()
+func NewMerkleBranch(b []byte) (mb *MerkleBranch, e error) {
+	if len(b) < 37 {
+		e = errors.New("NewMerkleBranch: data too short")
+		return
+	}
+	cnt, n := itemsCount(b[36:], 32)
+	if n==0 || len(b) != 36+n+32*cnt {
+		e = errors.New("NewMerkleBranch: length mismatch")
+		return
+	}
+	mb = new(MerkleBranch)
+	mb.TxHash = NewUint256(b[:32])
+	mb.Index = binary.LittleEndian.Uint32(b[32:36])
+	mb.Hashes = make([][]byte, cnt)
+	offs := 36+n
+	for i := range mb.Hashes {
+		mb.Hashes[i] = make([]byte, 32)
+		copy(mb.Hashes[i], b[offs:offs+32])
+		offs += 32
+	}
+	return
+}
+
+
+// PartialMerkleTree is the BIP37 encoding of a subset of block's transactions
+// (as used inside the "merkleblock" message).
+type PartialMerkleTree struct {
+	TxCount uint32
+	Hashes [][]byte
+	Bits []bool
+}
+
+
+func (pmt *PartialMerkleTree) treeWidth(height uint) uint32 {
+	return (pmt.TxCount + (1<<height) - 1) >> height
+}
+
+
+func (pmt *PartialMerkleTree) calcHash(height uint, pos uint32, txids [][]byte) []byte {
+	if height==0 {
+		return txids[pos]
+	}
+	left := pmt.calcHash(height-1, pos*2, txids)
+	if pos*2+1 < pmt.treeWidth(height-1) {
+		return merkleHashPair(left, pmt.calcHash(height-1, pos*2+1, txids))
+	}
+	return merkleHashPair(left, left)
+}
+
+
+func (pmt *PartialMerkleTree) build(height uint, pos uint32, txids [][]byte, matches []bool) {
+	var parentOfMatch bool
+	for p := pos<<height; p < (pos+1)<<height && p < pmt.TxCount; p++ {
+		if matches[p] {
+			parentOfMatch = true
+			break
+		}
+	}
+	pmt.Bits = append(pmt.Bits, parentOfMatch)
+	if height==0 || !parentOfMatch {
+		pmt.Hashes = append(pmt.Hashes, pmt.calcHash(height, pos, txids))
+	} else {
+		pmt.build(height-1, pos*2, txids, matches)
+		if pos*2+1 < pmt.treeWidth(height-1) {
+			pmt.build(height-1, pos*2+1, txids, matches)
+		}
+	}
+}
+
+
+// Builds a partial merkle tree of the given txids, where matches marks the ones to prove
+func NewPartialMerkleTree(txids [][]byte, matches []bool) (pmt *PartialMerkleTree) {
+	pmt = new(PartialMerkleTree)
+	pmt.TxCount = uint32(len(txids))
+	var height uint
+	for pmt.treeWidth(height) > 1 {
+		height++
+	}
+	pmt.build(height, 0, txids, matches)
+	return
+}
+
+
+type pmtExtract struct {
+	bitsUsed, hashUsed int
+	matched [][]byte
+	bad bool
+}
+
+
+func (pmt *PartialMerkleTree) extract(height uint, pos uint32, st *pmtExtract) []byte {
+	if st.bitsUsed >= len(pmt.Bits) {
+		st.bad = true
+		return nil
+	}
+	parentOfMatch := pmt.Bits[st.bitsUsed]
+	st.bitsUsed++
+	if height==0 || !parentOfMatch {
+		if st.hashUsed >= len(pmt.Hashes) {
+			st.bad = true
+			return nil
+		}
+		h := pmt.Hashes[st.hashUsed]
+		st.hashUsed++
+		if height==0 && parentOfMatch {
+			st.matched = append(st.matched, h)
+		}
+		return h
+	}
+	left := pmt.extract(height-1, pos*2, st)
+	right := left
+	if pos*2+1 < pmt.treeWidth(height-1) {
+		right = pmt.extract(height-1, pos*2+1, st)
+		if !st.bad && bytes.Equal(left, right) {
+			st.bad = true // identical siblings would allow to fake the tree (CVE-2012-2459)
+		}
+	}
+	if st.bad {
+		return nil
+	}
+	return merkleHashPair(left, right)
+}
+
+
+// Verifies the tree and returns its merkle root along with the hashes of the matched txs.
+// Compare the returned root with the block header's MerkleRoot().
+func (pmt *PartialMerkleTree) ExtractMatches() (root []byte, matched [][]byte, e error) {
+	if pmt.TxCount==0 {
+		e = errors.New("ExtractMatches: no transactions")
+		return
+	}
+	if pmt.TxCount > uint32(MAX_BLOCK_SIZE)/60 {
+		e = errors.New("ExtractMatches: too many transactions")
+		return
+	}
+	if len(pmt.Hashes) > int(pmt.TxCount) {
+		e = errors.New("ExtractMatches: more hashes than transactions")
+		return
+	}
+	if len(pmt.Bits) < len(pmt.Hashes) {
+		e = errors.New("ExtractMatches: not enough bits")
+		return
+	}
+	var height uint
+	for pmt.treeWidth(height) > 1 {
+		height++
+	}
+	st := new(pmtExtract)
+	root = pmt.extract(height, 0, st)
+	if st.bad {
+		e = errors.New("ExtractMatches: malformed tree")
+		return
+	}
+	if (st.bitsUsed+7)/8 != (len(pmt.Bits)+7)/8 || st.hashUsed != len(pmt.Hashes) {
+		e = errors.New("ExtractMatches: not all the data used")
+		return
+	}
+	matched = st.matched
+	return
+}
+
+
+// Serializes the tree the way it is sent inside the "merkleblock" message
+func (pmt *PartialMerkleTree) Bytes() []byte {
+	var buf [9]byte
+	wr := new(bytes.Buffer)
+	binary.Write(wr, binary.LittleEndian, pmt.TxCount)
+	wr.Write(buf[:PutVlen(buf[:], len(pmt.Hashes))])
+	for i := range pmt.Hashes {
+		wr.Write(pmt.Hashes[i])
+	}
+	flags := make([]byte, (len(pmt.Bits)+7)/8)
+	for i := range pmt.Bits {
+		if pmt.Bits[i] {
+			flags[i/8] |= 1 << uint(i%8)
+		}
+	}
+	wr.Write(buf[:PutVlen(buf[:], len(flags))])
+	wr.Write(flags)
+	return wr.Bytes()
+}
+
+
+// Decodes a partial merkle tree from its BIP37 serialized form
+func NewPartialMerkleTreeFromBytes(b []byte) (pmt *PartialMerkleTree, e error) {
+	if len(b) < 5 {
+		e = errors.New("NewPartialMerkleTree: data too short")
+		return
+	}
+	pmt = new(PartialMerkleTree)
+	pmt.TxCount = binary.LittleEndian.Uint32(b[0:4])
+	offs := 4
+	cnt, n := itemsCount(b[offs:], 32)
+	if n==0 {
+		pmt, e = nil, errors.New("NewPartialMerkleTree: hashes corrupt")
+		return
+	}
+	offs += n
+	pmt.Hashes = make([][]byte, cnt)
+	for i := range pmt.Hashes {
+		pmt.Hashes[i] = make([]byte, 32)
+		copy(pmt.Hashes[i], b[offs:offs+32])
+		offs += 32
+	}
+	cnt, n = itemsCount(b[offs:], 1)
+	if n==0 || len(b) != offs+n+cnt {
+		pmt, e = nil, errors.New("NewPartialMerkleTree: flags corrupt")
+		return
+	}
+	offs += n
+	pmt.Bits = make([]bool, 8*cnt)
+	for i := range pmt.Bits {
+		pmt.Bits[i] = (b[offs+i/8] & (1 << uint(i%8))) != 0
+	}
+	return
+}
@@ -0,0 +1,121 @@
+package btc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func fakeTxs(cnt int) (txs []*Tx) {
+	txs = make([]*Tx, cnt)
+	for i := range txs {
+		txs[i] = new(Tx)
+		txs[i].Hash = NewSha2Hash([]byte{byte(i), byte(i>>8)})
+	}
+	return
+}
+
+
+func TestMerkleBranch(t *testing.T) {
+	for cnt:=1; cnt<=17; cnt++ {
+		txs := fakeTxs(cnt)
+		root := GetMerkel(txs)
+		for i := range txs {
+			mb := &MerkleBranch{TxHash:txs[i].Hash, Index:uint32(i), Hashes:GetMerkleBranch(txs, i)}
+			if !mb.Verify(root) {
+				t.Error("Branch not verified", cnt, i)
+			}
+			mb2, e := NewMerkleBranch(mb.Bytes())
+			if e != nil {
+				t.Fatal(e.Error())
+			}
+			if !mb2.Verify(root) {
+				t.Error("Deserialized branch not verified", cnt, i)
+			}
+			if i^1 < cnt { // the last odd one is paired with itself, so its index is ambiguous
+				mb.Index ^= 1
+				if mb.Verify(root) {
+					t.Error("Branch with a wrong index verified", cnt, i)
+				}
+			}
+		}
+	}
+}
+
+
+func TestPartialMerkleTree(t *testing.T) {
+	for cnt:=1; cnt<=17; cnt++ {
+		txs := fakeTxs(cnt)
+		root := GetMerkel(txs)
+		txids := make([][]byte, cnt)
+		for i := range txs {
+			txids[i] = txs[i].Hash.Hash[:]
+		}
+		for i := range txs {
+			matches := make([]bool, cnt)
+			matches[i] = true
+			if i+3 < cnt {
+				matches[i+3] = true
+			}
+			pmt, e := NewPartialMerkleTreeFromBytes(NewPartialMerkleTree(txids, matches).Bytes())
+			if e != nil {
+				t.Fatal(e.Error())
+			}
+			r, m, e := pmt.ExtractMatches()
+			if e != nil {
+				t.Fatal(cnt, i, e.Error())
+			}
+			if !bytes.Equal(r, root) {
+				t.Error("Root mismatch", cnt, i)
+			}
+			var exp int
+			for j := range matches {
+				if matches[j] {
+					if exp>=len(m) || !bytes.Equal(m[exp], txids[j]) {
+						t.Error("Match mismatch", cnt, i, j)
+					}
+					exp++
+				}
+			}
+			if exp!=len(m) {
+				t.Error("Number of matches mismatch", cnt, i, len(m), exp)
+			}
+		}
+	}
+}
+
+
+func TestMerkleMalformed(t *testing.T) {
+	txs := fakeTxs(5)
+	txids := make([][]byte, len(txs))
+	for i := range txs {
+		txids[i] = txs[i].Hash.Hash[:]
+	}
+	mb := &MerkleBranch{TxHash:txs[2].Hash, Index:2, Hashes:GetMerkleBranch(txs, 2)}
+	pmt := NewPartialMerkleTree(txids, []bool{false, true, false, false, false})
+
+	// a huge var_int count must not cause a panic (nor a huge allocation)
+	huge := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	if _, e := NewMerkleBranch(append(make([]byte, 36), huge...)); e == nil {
+		t.Error("NewMerkleBranch accepted a huge count")
+	}
+	if _, e := NewPartialMerkleTreeFromBytes(append([]byte{5,0,0,0}, huge...)); e == nil {
+		t.Error("NewPartialMerkleTreeFromBytes accepted a huge number of hashes")
+	}
+	if _, e := NewPartialMerkleTreeFromBytes(append([]byte{5,0,0,0,0}, huge...)); e == nil {
+		t.Error("NewPartialMerkleTreeFromBytes accepted a huge number of flags")
+	}
+
+	// truncated data
+	b := mb.Bytes()
+	for i := range b {
+		if _, e := NewMerkleBranch(b[:i]); e == nil {
+			t.Error("NewMerkleBranch accepted truncated data", i)
+		}
+	}
+	b = pmt.Bytes()
+	for i := range b {
+		if _, e := NewPartialMerkleTreeFromBytes(b[:i]); e == nil {
+			t.Error("NewPartialMerkleTreeFromBytes accepted truncated data", i)
+		}
+	}
+}
@@ -129,3 +129,13 @@ func GetCompact(b *big.Int) uint32 {
 func init() {
 	bnProofOfWorkLimit, _ = new(big.Int).SetString("00000000FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF", 16)
 }
+
+
+// Returns true if the hash meets the target given in compact form
+func CheckProofOfWork(hash *Uint256, bits uint32) bool {
+	target := SetCompact(bits)
+	if target.Sign()<=0 || target.Cmp(bnProofOfWorkLimit)>0 {
+		return false
+	}
+	return hash.BigInt().Cmp(target) <= 0
+}
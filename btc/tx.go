@@ -274,6 +274,28 @@ func (tx *Tx) IsCoinBase() bool {
 }
 
 
+// Returns true if the tx can be included in a block of the given height and time
+func (tx *Tx) IsFinal(blockheight, timestamp uint32) bool {
+	if tx.Lock_time==0 {
+		return true
+	}
+	if tx.Lock_time < LOCKTIME_THRESHOLD {
+		if tx.Lock_time < blockheight {
+			return true
+		}
+	} else if tx.Lock_time < timestamp {
+		return true
+	}
+	// The lock time has not passed, but it does not matter if all the inputs are final
+	for i := range tx.TxIn {
+		if tx.TxIn[i].Sequence!=0xffffffff {
+			return false
+		}
+	}
+	return true
+}
+
+
 func (tx *Tx) CheckTransaction() error {
 	// Basic checks that don't depend on any context
 	if len(tx.TxIn)==0 {
@@ -253,3 +253,23 @@ func TestSighash(t *testing.T) {
 		}
 	}
 }
+
+
+func TestIsFinal(t *testing.T) {
+	tx := &Tx{TxIn:[]*TxIn{&TxIn{Sequence:0}}}
+	if !tx.IsFinal(1, 1) {
+		t.Error("Zero lock time is always final")
+	}
+	tx.Lock_time = 1000
+	if tx.IsFinal(1000, 0) || !tx.IsFinal(1001, 0) {
+		t.Error("Height lock time")
+	}
+	tx.Lock_time = LOCKTIME_THRESHOLD + 1000
+	if tx.IsFinal(2000, LOCKTIME_THRESHOLD + 1000) || !tx.IsFinal(1, LOCKTIME_THRESHOLD + 1001) {
+		t.Error("Time lock time")
+	}
+	tx.TxIn[0].Sequence = 0xffffffff
+	if !tx.IsFinal(1, 1) {
+		t.Error("Final inputs should make it final")
+	}
+}
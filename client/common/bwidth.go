@@ -5,8 +5,20 @@ import (
 	"time"
 	"fmt"
 	"net"
+	"io/ioutil"
+	"encoding/json"
 )
 
+const (
+	UploadQuotaFileName = "ulquota.json"
+)
+
+// Bandwidth limits for a part of the day (CFG.Net.BwSchedule)
+type BwPeriod struct {
+	From, To string // local time "hh:mm" - if To is before From, the period goes over midnight
+	MaxUpKBps, MaxDownKBps uint
+}
+
 var (
 	bw_mutex sync.Mutex
 
@@ -23,8 +35,21 @@ var (
 	ul_bytes_so_far int
 	UlBytesPrevSec, ul_bytes_priod uint64
 	UlBytesTotal uint64
+
+	// Upload quota (CFG.Net.UploadQuotaMB) - bytes sent in the current month:
+	UlQuota struct {
+		Month int // year*12 + month
+		Bytes uint64
+	}
+
+	bw_periods []bwPeriod
+	BwPeriodActive int = -1 // index in CFG.Net.BwSchedule of the period being in force
 )
 
+type bwPeriod struct {
+	from, to int // minutes since midnight
+}
+
 
 
 func TickRecv() {
@@ -53,10 +78,110 @@ func TickSent() {
 		ul_bytes_priod = 0
 		ul_bytes_so_far = 0
 		ul_last_sec = now
+		applyBwSchedule()
+	}
+}
+
+
+// Sets the bandwidth limits of the time-of-day period we are in.
+// The limits are only touched when a period starts or ends, so they can be changed manually in between.
+// Make sure to call it with locked bw_mutex
+func applyBwSchedule() {
+	if len(bw_periods)==0 {
+		return
+	}
+	now := time.Now()
+	min := now.Hour()*60 + now.Minute()
+	idx := -1
+	for i, p := range bw_periods {
+		if p.from<=p.to && min>=p.from && min<p.to || p.from>p.to && (min>=p.from || min<p.to) {
+			idx = i
+			break
+		}
+	}
+	if idx==BwPeriodActive {
+		return
+	}
+	BwPeriodActive = idx
+	if idx<0 {
+		UploadLimit = CFG.Net.MaxUpKBps << 10
+		DownloadLimit = CFG.Net.MaxDownKBps << 10
+	} else {
+		UploadLimit = CFG.Net.BwSchedule[idx].MaxUpKBps << 10
+		DownloadLimit = CFG.Net.BwSchedule[idx].MaxDownKBps << 10
+	}
+}
+
+
+// Parses CFG.Net.BwSchedule - called from Reset()
+func setBwSchedule() {
+	bw_mutex.Lock()
+	bw_periods = nil
+	BwPeriodActive = -1
+	for _, p := range CFG.Net.BwSchedule {
+		var fh, fm, th, tm int
+		n1, _ := fmt.Sscanf(p.From, "%d:%d", &fh, &fm)
+		n2, _ := fmt.Sscanf(p.To, "%d:%d", &th, &tm)
+		if n1!=2 || n2!=2 || fh>23 || th>23 || fm>59 || tm>59 || fh<0 || th<0 || fm<0 || tm<0 {
+			println("ERROR: Incorrect Net.BwSchedule period:", p.From, "-", p.To)
+			bw_periods = nil
+			break
+		}
+		bw_periods = append(bw_periods, bwPeriod{from:fh*60+fm, to:th*60+tm})
+	}
+	applyBwSchedule()
+	bw_mutex.Unlock()
+}
+
+
+// Make sure to call it with locked bw_mutex
+func quotaMonth() {
+	now := time.Now()
+	if m := now.Year()*12 + int(now.Month()); m!=UlQuota.Month {
+		UlQuota.Month = m
+		UlQuota.Bytes = 0
 	}
 }
 
 
+// Returns true if we have sent more than CFG.Net.UploadQuotaMB this month
+func UploadQuotaExceeded() (res bool) {
+	if CFG.Net.UploadQuotaMB==0 {
+		return
+	}
+	bw_mutex.Lock()
+	quotaMonth()
+	res = UlQuota.Bytes >= uint64(CFG.Net.UploadQuotaMB)<<20
+	bw_mutex.Unlock()
+	return
+}
+
+
+func SaveUploadQuota(fn string) {
+	bw_mutex.Lock()
+	dat, _ := json.Marshal(&UlQuota)
+	bw_mutex.Unlock()
+	if e := ioutil.WriteFile(fn, dat, 0660); e != nil {
+		println("SaveUploadQuota:", e.Error())
+	}
+}
+
+
+// Restores the current month's upload counter saved by SaveUploadQuota
+func LoadUploadQuota(fn string) {
+	dat, e := ioutil.ReadFile(fn)
+	if e != nil {
+		return
+	}
+	bw_mutex.Lock()
+	if e = json.Unmarshal(dat, &UlQuota); e != nil {
+		println("LoadUploadQuota: bad file", fn)
+	}
+	quotaMonth()
+	bw_mutex.Unlock()
+}
+
+
 func SockRead(con net.Conn, buf []byte) (n int, e error) {
 	var toread int
 	bw_mutex.Lock()
@@ -114,6 +239,8 @@ func SockWrite(con net.Conn, buf []byte) (n int, e error) {
 		bw_mutex.Lock()
 		UlBytesTotal += uint64(n)
 		ul_bytes_priod += uint64(n)
+		quotaMonth()
+		UlQuota.Bytes += uint64(n)
 		bw_mutex.Unlock()
 		if e != nil {
 			if nerr, ok := e.(net.Error); ok && nerr.Timeout() {
@@ -143,6 +270,10 @@ func PrintStats() {
 		DlBytesPrevSec>>10, DownloadLimit>>10, BytesToString(DlBytesTotal))
 	fmt.Printf("  |  Uploading at %d/%d KB/s, %s total\n",
 		UlBytesPrevSec>>10, UploadLimit>>10, BytesToString(UlBytesTotal))
+	if CFG.Net.UploadQuotaMB!=0 {
+		quotaMonth()
+		fmt.Printf("Uploaded %s this month, out of %d MB quota\n", BytesToString(UlQuota.Bytes), CFG.Net.UploadQuotaMB)
+	}
 	bw_mutex.Unlock()
 	return
 }
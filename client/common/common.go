@@ -10,9 +10,10 @@ import (
 const (
 	ConfigFile = "gocoin.conf"
 
-	Version = 70001
+	Version = 70014
 	DefaultUserAgent = "/Gocoin:"+btc.SourcesTag+"/"
-	Services = uint64(0x00000001)
+	Services = uint64(0x00000001) // NODE_NETWORK
+	ServiceCompactFilters = uint64(0x00000040) // NODE_COMPACT_FILTERS (BIP157)
 
 	MaxCachedBlocks = 600
 )
@@ -37,6 +38,7 @@ var (
 
 	MaxExpireTime time.Duration
 	ExpirePerKB time.Duration
+	MaxMempoolSize uint64 // 0 - no limit
 
 	DebugLevel int64
 
@@ -50,6 +52,21 @@ var (
 )
 
 
+// Returns the services that we advertise to peers.
+// The compact filters are only advertised once the filter index has reached the top block
+// (a block database created by an older version needs a rescan to build it).
+func MyServices() (res uint64) {
+	res = Services
+	Last.Mutex.Lock()
+	top := Last.Block.BlockHash
+	Last.Mutex.Unlock()
+	if _, _, ok := BlockChain.Filters.Headers(top); ok {
+		res |= ServiceCompactFilters
+	}
+	return
+}
+
+
 func CountSafe(k string) {
 	CounterMutex.Lock()
 	Counter[k]++
@@ -112,3 +129,15 @@ func IsIPBlocked(ip4 []byte) bool {
 	}*/
 	return false
 }
+
+
+// Returns true if the IP is within any of the subnets from CFG.Net.Whitelist
+func IsWhitelisted(ip4 []byte) bool {
+	addr := uint32(ip4[0])<<24 | uint32(ip4[1])<<16 | uint32(ip4[2])<<8 | uint32(ip4[3])
+	for i := range NetWhitelist {
+		if (addr&NetWhitelist[i].Mask)==NetWhitelist[i].Addr {
+			return true
+		}
+	}
+	return false
+}
@@ -38,11 +38,20 @@ var (
 			MaxInCons uint32
 			MaxUpKBps uint
 			MaxDownKBps uint
+			BwSchedule []BwPeriod // different MaxUpKBps / MaxDownKBps for some parts of the day
+			UploadQuotaMB uint // monthly upload quota - if exceeded, we stop serving historical blocks (0 for no limit)
 			MaxBlockAtOnce uint32
+			BanScore uint32 // ban the peer when its misbehaving score reaches this value
+			BanTimeHours uint // how long the bans last
+			AddNodes string // comma separated ip[:port] of peers that we always stay connected to
+			Whitelist string // comma separated IPs / subnets of peers exempt from bans and fee limits
+			CaptureAll bool // write messages exchanged with each peer into a file
+			CaptureDir string // where the capture files go (default: "capture" in the data folder)
 		}
 		TXPool struct {
 			Enabled bool // Global on/off swicth
 			AllowMemInputs bool
+			AllowRBF bool // accept BIP125 replacements
 			FeePerByte uint64
 			MaxTxSize uint32
 			MinVoutValue uint64
@@ -50,6 +59,13 @@ var (
 			// Otherwise expiration time will be proportionally different.
 			TxExpireMinPerKB uint
 			TxExpireMaxHours uint
+			MaxSizeMB uint // zero for no limit
+			MaxOrphans uint32 // how many txs can be waiting for inputs
+			// Standardness policy:
+			BareMultisig bool
+			DataCarrier bool
+			DataCarrierSize uint32
+			DoubleSpendCmd string // executed for each double spend of a pool tx
 		}
 		TXRoute struct {
 			Enabled bool // Global on/off swicth
@@ -83,6 +99,7 @@ type oneAllowedAddr struct {
 }
 
 var WebUIAllowed []oneAllowedAddr
+var NetWhitelist []oneAllowedAddr
 
 func init() {
 	// Fill in default values
@@ -90,6 +107,8 @@ func init() {
 	CFG.Net.MaxOutCons = 9
 	CFG.Net.MaxInCons = 10
 	CFG.Net.MaxBlockAtOnce = 3
+	CFG.Net.BanScore = 100
+	CFG.Net.BanTimeHours = 24
 
 	CFG.TextUI.Enabled = true
 
@@ -100,11 +119,17 @@ func init() {
 
 	CFG.TXPool.Enabled = true
 	CFG.TXPool.AllowMemInputs = true
+	CFG.TXPool.AllowRBF = true
 	CFG.TXPool.FeePerByte = 1
 	CFG.TXPool.MaxTxSize = 10e3
 	CFG.TXPool.MinVoutValue = 0
 	CFG.TXPool.TxExpireMinPerKB = 180
 	CFG.TXPool.TxExpireMaxHours = 12
+	CFG.TXPool.MaxSizeMB = 100
+	CFG.TXPool.MaxOrphans = 1000
+	CFG.TXPool.BareMultisig = true
+	CFG.TXPool.DataCarrier = true
+	CFG.TXPool.DataCarrierSize = 83 // 80 bytes of data
 
 	CFG.TXRoute.Enabled = true
 	CFG.TXRoute.FeePerByte = 1
@@ -130,6 +155,7 @@ func init() {
 	flag.BoolVar(&FLAG.Rescan, "r", false, "Rebuild the unspent DB (fixes 'Unknown input TxID' errors)")
 	flag.BoolVar(&CFG.Testnet, "t", CFG.Testnet, "Use Testnet3")
 	flag.StringVar(&CFG.ConnectOnly, "c", CFG.ConnectOnly, "Connect only to this host and nowhere else")
+	flag.StringVar(&CFG.Net.AddNodes, "addnode", CFG.Net.AddNodes, "Always stay connected to these hosts (comma separated)")
 	flag.BoolVar(&CFG.Net.ListenTCP, "l", CFG.Net.ListenTCP, "Listen for incoming TCP connections (on default port)")
 	flag.StringVar(&CFG.Datadir, "d", CFG.Datadir, "Specify Gocoin's database root folder")
 	flag.UintVar(&CFG.Net.MaxUpKBps, "ul", CFG.Net.MaxUpKBps, "Upload limit in KB/s (0 for no limit)")
@@ -140,6 +166,13 @@ func init() {
 	flag.BoolVar(&CFG.TXRoute.Enabled, "txr", CFG.TXRoute.Enabled, "Enable Transaction Routing")
 	flag.BoolVar(&CFG.TextUI.Enabled, "textui", CFG.TextUI.Enabled, "Enable processing TextUI commands (from stdin)")
 
+	Reset()
+}
+
+
+// Applies the command line switches on top of the config file.
+// Call it from main, so the packages can be used (e.g. tested) without parsing os.Args.
+func ParseFlags() {
 	if flag.Lookup("h") != nil {
 		flag.PrintDefaults()
 		os.Exit(0)
@@ -153,9 +186,11 @@ func init() {
 func Reset() {
 	UploadLimit = CFG.Net.MaxUpKBps << 10
 	DownloadLimit = CFG.Net.MaxDownKBps << 10
+	setBwSchedule()
 	debug.SetGCPercent(CFG.Memory.GCPercTrshold)
 	MaxExpireTime = time.Duration(CFG.TXPool.TxExpireMaxHours) * time.Hour
 	ExpirePerKB = time.Duration(CFG.TXPool.TxExpireMinPerKB) * time.Minute
+	MaxMempoolSize = uint64(CFG.TXPool.MaxSizeMB) << 20
 	btc.NocacheBlocksBelow = CFG.Memory.NoCacheBefore
 	btc.MinBrowsableOutValue = uint64(CFG.Memory.MinBrowsableVal)
 	if CFG.Net.TCPPort != 0 {
@@ -181,6 +216,19 @@ func Reset() {
 	if len(WebUIAllowed)==0 {
 		println("WARNING: No IP is currently allowed at WebUI")
 	}
+
+	NetWhitelist = nil
+	if CFG.Net.Whitelist!="" {
+		ips = strings.Split(CFG.Net.Whitelist, ",")
+		for i := range ips {
+			oaa := str2oaa(strings.TrimSpace(ips[i]))
+			if oaa!=nil {
+				NetWhitelist = append(NetWhitelist, *oaa)
+			} else {
+				println("ERROR: Incorrect Net.Whitelist:", ips[i])
+			}
+		}
+	}
 }
 
 
@@ -47,6 +47,7 @@ func LocalAcceptBlock(bl *btc.Block, from *network.OneConnection) (e error) {
 		network.ReceivedBlocks[bl.Hash.BIdx()].TmAccept = time.Now().Sub(sta)
 		network.MutexRcv.Unlock()
 
+		network.ReturnDisconnectedTxs()
 		for i:=1; i<len(bl.Txs); i++ {
 			network.TxMined(bl.Txs[i])
 			if msg:=contains_message(bl.Txs[i]); msg!=nil {
@@ -63,7 +64,7 @@ func LocalAcceptBlock(bl *btc.Block, from *network.OneConnection) (e error) {
 		if int64(bl.BlockTime()) > time.Now().Add(-10*time.Minute).Unix() {
 			// Freshly mined block - do the inv and beeps...
 			common.Busy("NetRouteInv")
-			network.NetRouteInv(2, bl.Hash, from)
+			network.NetRouteBlock(bl, from)
 
 			if common.CFG.Beeps.NewBlock {
 				fmt.Println("\007Received block", common.BlockChain.BlockTreeEnd.Height)
@@ -137,6 +138,7 @@ func retry_cached_blocks() bool {
 				fmt.Println("retry CheckBlock:", e.Error())
 				common.CountSafe("BadCachedBlocks")
 				if dos {
+					v.Conn.RejectBlock(v.Block, e)
 					v.Conn.DoS("BadCachedBlock2")
 				}
 				delete(network.CachedBlocks, k)
@@ -159,6 +161,7 @@ func HandleNetBlock(newbl *network.BlockRcvd) {
 		} else {
 			fmt.Println(dos, e.Error())
 			if dos {
+				newbl.Conn.RejectBlock(bl, e)
 				newbl.Conn.DoS("CheckBlock")
 			}
 		}
@@ -229,6 +232,8 @@ func main() {
 		fmt.Println("WARNING: Gocoin client shall be build for 64-bit arch. It will likely crash now.")
 	}
 
+	common.ParseFlags()
+
 	fmt.Println("Gocoin client version", btc.SourcesTag)
 	runtime.GOMAXPROCS(runtime.NumCPU()) // It seems that Go does not do it by default
 
@@ -295,6 +300,12 @@ func main() {
 		network.ReceivedBlocks[k] = &network.OneReceivedBlock{Time: time.Unix(int64(v.Timestamp()), 0)}
 	}
 
+	network.LoadFeeEstimates(common.GocoinHomeDir+network.FeeEstFileName)
+	common.LoadUploadQuota(common.GocoinHomeDir+common.UploadQuotaFileName)
+	if common.CFG.TXPool.Enabled {
+		network.LoadMempool(common.GocoinHomeDir+network.MempoolFileName)
+	}
+
 	if common.CFG.TextUI.Enabled {
 		go textui.MainThread()
 	}
@@ -332,6 +343,15 @@ func main() {
 				fmt.Println("\007" + newal)
 				textui.ShowPrompt()
 
+			case ds := <-network.NetDoubleSpends:
+				usif.DoubleSpend(ds)
+				fmt.Println("\007" + ds.String())
+				textui.ShowPrompt()
+
+			case rj := <-network.NetOwnTxRejects:
+				fmt.Println("\007" + rj.String())
+				textui.ShowPrompt()
+
 			case cmd := <-usif.UiChannel:
 				common.Busy("UI command")
 				cmd.Handler(cmd.Param)
@@ -343,6 +363,7 @@ func main() {
 
 			case <-txPoolTick:
 				network.ExpireTxs()
+				network.RebroadcastOwnTxs()
 
 			case <-netTick:
 				network.NetworkTick()
@@ -361,6 +382,9 @@ func main() {
 
 	network.NetCloseAll()
 	network.ClosePeerDB()
+	network.SaveMempool(common.GocoinHomeDir+network.MempoolFileName)
+	network.SaveFeeEstimates(common.GocoinHomeDir+network.FeeEstFileName)
+	common.SaveUploadQuota(common.GocoinHomeDir+common.UploadQuotaFileName)
 
 	if usif.DefragBlocksDB {
 		defrag_db()
@@ -0,0 +1,144 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"strings"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+const (
+	AddNodeRetryMin = 30*time.Second // first retry after a failed connection attempt
+	AddNodeRetryMax = 30*time.Minute // the retry delay doubles with each failure, up to this
+	AddNodeStable = 10*time.Minute // a connection that lasted this long resets the retry delay
+)
+
+// A peer from CFG.Net.AddNodes, that we always keep connected
+type OneAddNode struct {
+	Addr string // as given in the config
+	*onePeer
+	conn *OneConnection // the last connection attempt
+	Fails uint // how many attempts have failed in a row
+	NextTry time.Time
+}
+
+var (
+	AddNodes []*OneAddNode
+	AddNodesMutex sync.Mutex
+	addNodesCfg string // CFG.Net.AddNodes that AddNodes have been made from
+)
+
+
+// Returns the delay before the next connection attempt
+func (an *OneAddNode) retryDelay() (d time.Duration) {
+	if an.Fails==0 {
+		return
+	}
+	d = AddNodeRetryMax
+	if an.Fails<16 && AddNodeRetryMin<<(an.Fails-1) < d {
+		d = AddNodeRetryMin<<(an.Fails-1)
+	}
+	return
+}
+
+
+func (an *OneAddNode) String() (s string) {
+	s = fmt.Sprintf("%21s", an.Ip())
+	if ConnectionActive(an.onePeer) {
+		s += "  connected"
+	} else if an.Fails>0 {
+		s += fmt.Sprintf("  %d failed attempt(s), next in %s", an.Fails,
+			an.NextTry.Sub(time.Now()).String())
+	}
+	return
+}
+
+
+// Rebuilds AddNodes, if the config has changed.
+// The peers that were already on the list keep their state.
+// Make sure to call it with locked AddNodesMutex
+func refreshAddNodes() {
+	common.LockCfg()
+	cfg := common.CFG.Net.AddNodes
+	common.UnlockCfg()
+	if cfg==addNodesCfg {
+		return
+	}
+	addNodesCfg = cfg
+
+	old := make(map[string] *OneAddNode, len(AddNodes))
+	for _, an := range AddNodes {
+		old[an.Addr] = an
+	}
+	AddNodes = nil
+	for _, s := range strings.Split(cfg, ",") {
+		if s = strings.TrimSpace(s); s=="" {
+			continue
+		}
+		if an, ok := old[s]; ok {
+			AddNodes = append(AddNodes, an)
+			continue
+		}
+		hp := s
+		if strings.Index(hp, ":")==-1 {
+			hp = fmt.Sprint(hp, ":", common.DefaultTcpPort)
+		}
+		oa, e := net.ResolveTCPAddr("tcp4", hp)
+		if e != nil {
+			println("AddNodes:", e.Error())
+			continue
+		}
+		p := NewEmptyPeer()
+		p.Services = common.Services
+		copy(p.Ip4[:], oa.IP.To4())
+		p.Port = uint16(oa.Port)
+		AddNodes = append(AddNodes, &OneAddNode{Addr:s, onePeer:p})
+	}
+}
+
+
+// Connects to the peers from CFG.Net.AddNodes that are not connected, when their time comes
+func addNodesTick() {
+	AddNodesMutex.Lock()
+	defer AddNodesMutex.Unlock()
+	refreshAddNodes()
+	for _, an := range AddNodes {
+		if ConnectionActive(an.onePeer) {
+			continue
+		}
+		if an.conn!=nil {
+			// The last connection is over - see if it was any good
+			if !an.conn.ConnectedAt.IsZero() && time.Now().Sub(an.conn.ConnectedAt) >= AddNodeStable {
+				an.Fails = 0
+			} else {
+				an.Fails++
+			}
+			an.conn = nil
+			an.NextTry = time.Now().Add(an.retryDelay())
+			common.CountSafe("AddNodeLost")
+		}
+		if time.Now().Before(an.NextTry) {
+			continue
+		}
+		if an.conn = DoNetwork(an.onePeer); an.conn!=nil {
+			an.conn.Mutex.Lock()
+			an.conn.AddNode = true
+			an.conn.Mutex.Unlock()
+			common.CountSafe("AddNodeConnect")
+		}
+	}
+}
+
+
+// Returns the current state of each of the addnode peers
+func GetAddNodes() (res []string) {
+	AddNodesMutex.Lock()
+	refreshAddNodes()
+	for _, an := range AddNodes {
+		res = append(res, an.String())
+	}
+	AddNodesMutex.Unlock()
+	return
+}
@@ -3,10 +3,9 @@ package network
 import (
 	"time"
 	"sync"
-	"bytes"
 	"encoding/binary"
-	"github.com/piotrnar/gocoin/qdb"
 	"github.com/piotrnar/gocoin/btc"
+	"github.com/piotrnar/gocoin/protocol"
 	"github.com/piotrnar/gocoin/others/utils"
 	"github.com/piotrnar/gocoin/client/common"
 )
@@ -57,7 +56,7 @@ func BestExternalAddr() []byte {
 
 	ExternalIpMutex.Unlock()
 	res := make([]byte, 26)
-	binary.LittleEndian.PutUint64(res[0:8], common.Services)
+	binary.LittleEndian.PutUint64(res[0:8], common.MyServices())
 	// leave ip6 filled with zeros, except for the last 2 bytes:
 	res[18], res[19] = 0xff, 0xff
 	binary.BigEndian.PutUint32(res[20:24], best_ip)
@@ -69,50 +68,42 @@ func BestExternalAddr() []byte {
 func (c *OneConnection) SendAddr() {
 	pers := GetBestPeers(MaxAddrsPerMessage, false)
 	if len(pers)>0 {
-		buf := new(bytes.Buffer)
-		btc.WriteVlen(buf, uint32(len(pers)))
+		addrs := make([]*protocol.Addr, len(pers))
 		for i := range pers {
-			binary.Write(buf, binary.LittleEndian, pers[i].Time)
-			buf.Write(pers[i].NetAddr.Bytes())
+			addrs[i] = &protocol.Addr{Time:pers[i].Time, NetAddr:pers[i].NetAddr}
 		}
-		c.SendRawMsg("addr", buf.Bytes())
+		c.SendRawMsg("addr", protocol.AddrBytes(addrs))
 	}
 }
 
 
 func (c *OneConnection) SendOwnAddr() {
 	if ExternalAddrLen()>0 {
-		buf := new(bytes.Buffer)
-		btc.WriteVlen(buf, 1)
-		binary.Write(buf, binary.LittleEndian, uint32(time.Now().Unix()))
-		buf.Write(BestExternalAddr())
-		c.SendRawMsg("addr", buf.Bytes())
+		a := &protocol.Addr{Time:uint32(time.Now().Unix()), NetAddr:*btc.NewNetAddr(BestExternalAddr())}
+		c.SendRawMsg("addr", protocol.AddrBytes([]*protocol.Addr{a}))
 	}
 }
 
 // Parese network's "addr" message
-func ParseAddr(pl []byte) {
-	b := bytes.NewBuffer(pl)
-	cnt, _ := btc.ReadVLen(b)
-	for i := 0; i < int(cnt); i++ {
-		var buf [30]byte
-		n, e := b.Read(buf[:])
-		if n!=len(buf) || e!=nil {
-			common.CountSafe("AddrError")
-			//println("ParseAddr:", n, e)
+func (c *OneConnection) ParseAddr(pl []byte) {
+	addrs, e := protocol.ParseAddr(pl)
+	if e != nil {
+		common.CountSafe("AddrError")
+		return
+	}
+	src := netGroup(c.PeerAddr.Ip4[:])
+	for i := range addrs {
+		if c.AddrsAccepted >= MaxAddrsPerSource {
+			common.CountSafe("AddrSourceLimit")
 			break
 		}
-		a := NewPeer(buf[:])
+		a := &onePeer{OnePeer:&utils.OnePeer{NetAddr:addrs[i].NetAddr, Time:addrs[i].Time}}
 		if !utils.ValidIp4(a.Ip4[:]) {
 			common.CountSafe("AddrInvalid")
 		} else if time.Unix(int64(a.Time), 0).Before(time.Now().Add(time.Minute)) {
 			if time.Now().Before(time.Unix(int64(a.Time), 0).Add(ExpirePeerAfter)) {
-				k := qdb.KeyType(a.UniqID())
-				v := PeerDB.Get(k)
-				if v != nil {
-					a.Banned = NewPeer(v[:]).Banned
-				}
-				PeerDB.Put(k, a.Bytes())
+				addrAdd(a, src)
+				c.AddrsAccepted++
 			} else {
 				common.CountSafe("AddrStale")
 			}
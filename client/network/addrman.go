@@ -0,0 +1,356 @@
+package network
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"time"
+	"math/rand"
+	"crypto/sha256"
+	crand "crypto/rand"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/qdb"
+	"github.com/piotrnar/gocoin/others/utils"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+/*
+The address manager keeps the known peers in two tables of buckets:
+ - "new" for the addresses that we have only heard about,
+ - "tried" for the ones that we have successfully connected to.
+Which bucket an address goes to depends on its network group and, for the new table,
+on the network group of the peer that told us about it. This way a single actor
+(controlling one or few network groups) can only fill a small part of the tables.
+*/
+
+const (
+	AddrNewBuckets = 256
+	AddrTriedBuckets = 64
+	AddrBucketSize = 64
+	AddrNewBucketsPerSrc = 32 // addresses from one source group can only go to this many new buckets
+	AddrTriedBucketsPerGroup = 8 // addresses from one network group can only go to this many tried buckets
+
+	MaxAddrsPerSource = 1000 // do not take more addresses than this from a single connection
+
+	ExpireTriedPeerAfter = 7*24*time.Hour // peers from the tried table are kept much longer
+)
+
+type addrSlot struct {
+	tried bool
+	bucket, pos int
+}
+
+var (
+	addrNew [AddrNewBuckets][AddrBucketSize]uint64 // UniqID of each peer (zero for an empty slot)
+	addrTried [AddrTriedBuckets][AddrBucketSize]uint64
+	addrSlots map[uint64] addrSlot = make(map[uint64] addrSlot)
+	addrNewCnt, addrTriedCnt int
+	addrKey [32]byte // makes the layout of the tables unpredictable from outside (kept in the peers DB)
+)
+
+const addrKeyDBKey = qdb.KeyType(0xadd7e55ce7000000) // addrKey's record in the peers DB
+
+
+// Returns the network group (/16 for IPv4) of the given address
+func netGroup(ip4 []byte) uint16 {
+	return uint16(ip4[0])<<8 | uint16(ip4[1])
+}
+
+
+func addrHash(vals ...uint64) uint64 {
+	var b [8]byte
+	h := sha256.New()
+	h.Write(addrKey[:])
+	for _, v := range vals {
+		binary.LittleEndian.PutUint64(b[:], v)
+		h.Write(b[:])
+	}
+	return binary.LittleEndian.Uint64(h.Sum(nil))
+}
+
+
+func newSlot(p *onePeer) addrSlot {
+	grp, src := uint64(netGroup(p.Ip4[:])), uint64(p.SrcGroup)
+	b := addrHash(1, src, addrHash(2, grp, src)%AddrNewBucketsPerSrc) % AddrNewBuckets
+	return addrSlot{bucket:int(b), pos:int(addrHash(3, b, p.UniqID()) % AddrBucketSize)}
+}
+
+
+func triedSlot(p *onePeer) addrSlot {
+	grp := uint64(netGroup(p.Ip4[:]))
+	b := addrHash(4, grp, addrHash(5, p.UniqID())%AddrTriedBucketsPerGroup) % AddrTriedBuckets
+	return addrSlot{tried:true, bucket:int(b), pos:int(addrHash(6, b, p.UniqID()) % AddrBucketSize)}
+}
+
+
+func (s addrSlot) ref() *uint64 {
+	if s.tried {
+		return &addrTried[s.bucket][s.pos]
+	}
+	return &addrNew[s.bucket][s.pos]
+}
+
+
+// Make sure to call it with locked peerdb_mutex
+func addrPlace(p *onePeer, s addrSlot) {
+	id := p.UniqID()
+	*s.ref() = id
+	addrSlots[id] = s
+	if s.tried {
+		addrTriedCnt++
+	} else {
+		addrNewCnt++
+	}
+	p.Tried = s.tried
+}
+
+
+// Takes the address out of the tables, but leaves it in the DB
+// Make sure to call it with locked peerdb_mutex
+func addrUnlink(id uint64) {
+	if s, ok := addrSlots[id]; ok {
+		*s.ref() = 0
+		delete(addrSlots, id)
+		if s.tried {
+			addrTriedCnt--
+		} else {
+			addrNewCnt--
+		}
+	}
+}
+
+
+// Make sure to call it with locked peerdb_mutex
+func addrRemove(id uint64) {
+	addrUnlink(id)
+	PeerDB.Del(qdb.KeyType(id))
+}
+
+
+// An address that has not been seen for long can be replaced with a fresh one
+func addrTerrible(p *onePeer) bool {
+	return time.Now().After(time.Unix(int64(p.Time), 0).Add(ExpirePeerAfter/2))
+}
+
+
+// Puts the peer into its new bucket. Returns false if the slot is taken by another good address.
+// Make sure to call it with locked peerdb_mutex
+func addrAddNew(p *onePeer) bool {
+	s := newSlot(p)
+	if old := *s.ref(); old!=0 {
+		if v := PeerDB.Get(qdb.KeyType(old)); v!=nil && !addrTerrible(NewPeer(v)) {
+			return false
+		}
+		addrRemove(old)
+	}
+	addrPlace(p, s)
+	p.Save()
+	return true
+}
+
+
+// Adds a new address that we have heard about from the given source network group,
+// or updates the one that we already know. Returns false if the address got ignored.
+func addrAdd(p *onePeer, src uint16) bool {
+	peerdb_mutex.Lock()
+	defer peerdb_mutex.Unlock()
+	id := p.UniqID()
+	if _, ok := addrSlots[id]; ok {
+		if v := PeerDB.Get(qdb.KeyType(id)); v!=nil {
+			old := NewPeer(v)
+			if p.Time > old.Time {
+				old.Time = p.Time
+				old.Services = p.Services
+				old.Save()
+			}
+		}
+		return true
+	}
+	p.SrcGroup = src
+	if !addrAddNew(p) {
+		common.CountSafe("AddrBucketFull")
+		return false
+	}
+	return true
+}
+
+
+// Moves the peer to the tried table, after we have successfully connected to it.
+// Whoever occupied its slot in there, goes back to the new table.
+func addrGood(p *onePeer) {
+	peerdb_mutex.Lock()
+	defer peerdb_mutex.Unlock()
+	id := p.UniqID()
+	if s, ok := addrSlots[id]; ok && s.tried {
+		return
+	}
+	addrUnlink(id)
+	s := triedSlot(p)
+	if old := *s.ref(); old!=0 {
+		addrUnlink(old)
+		if v := PeerDB.Get(qdb.KeyType(old)); v!=nil && !addrAddNew(NewPeer(v)) {
+			PeerDB.Del(qdb.KeyType(old))
+		}
+		common.CountSafe("AddrTriedEvicted")
+	}
+	addrPlace(p, s)
+	p.Save()
+}
+
+
+// Picks a random address to connect to, from either of the tables,
+// avoiding the network groups that we already have outgoing connections to
+func SelectOutboundPeer() *onePeer {
+	if proxyPeer!=nil {
+		if !ConnectionActive(proxyPeer) {
+			return proxyPeer
+		}
+		return nil
+	}
+
+	groups := make(map[uint16] bool)
+	Mutex_net.Lock()
+	for _, v := range OpenCons {
+		if !v.Incoming {
+			groups[netGroup(v.PeerAddr.Ip4[:])] = true
+		}
+	}
+	Mutex_net.Unlock()
+
+	peerdb_mutex.Lock()
+	defer peerdb_mutex.Unlock()
+	for tries:=0; tries<100 && addrNewCnt+addrTriedCnt>0; tries++ {
+		var id uint64
+		if addrTriedCnt>0 && (addrNewCnt==0 || rand.Intn(2)==0) {
+			id = pickFromBuckets(addrTried[:])
+		} else {
+			id = pickFromBuckets(addrNew[:])
+		}
+		v := PeerDB.Get(qdb.KeyType(id))
+		if v == nil {
+			continue
+		}
+		ad := NewPeer(v)
+		if IsBanned(ad.Ip4[:]) || !utils.ValidIp4(ad.Ip4[:]) || common.IsIPBlocked(ad.Ip4[:]) {
+			continue
+		}
+		if groups[netGroup(ad.Ip4[:])] {
+			common.CountSafe("AddrSameGroup")
+			continue
+		}
+		if !ConnectionActive(ad) {
+			return ad
+		}
+	}
+	return nil
+}
+
+
+// Returns a random non-empty slot, starting from a random bucket
+func pickFromBuckets(tab [][AddrBucketSize]uint64) uint64 {
+	b0, p0 := rand.Intn(len(tab)), rand.Intn(AddrBucketSize)
+	for i := range tab {
+		b := &tab[(b0+i)%len(tab)]
+		for j := range b {
+			if id := b[(p0+j)%AddrBucketSize]; id!=0 {
+				return id
+			}
+		}
+	}
+	return 0
+}
+
+
+// Returns number of addresses in the new and the tried table
+func AddrManStats() (newcnt, triedcnt int) {
+	peerdb_mutex.Lock()
+	newcnt, triedcnt = addrNewCnt, addrTriedCnt
+	peerdb_mutex.Unlock()
+	return
+}
+
+
+// Puts all the addresses from the DB into the tables.
+// The ones that do not fit get removed.
+func loadAddrMan() {
+	// The key must stay the same, otherwise the addresses would go to different buckets after each restart
+	if v := PeerDB.Get(addrKeyDBKey); len(v)==len(addrKey) {
+		copy(addrKey[:], v)
+	} else {
+		crand.Read(addrKey[:])
+		PeerDB.Put(addrKeyDBKey, append([]byte{}, addrKey[:]...)) // qdb keeps the slice
+	}
+
+	var tried, fresh manyPeers
+	PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
+		if !IsPeerKey(k) {
+			return 0
+		}
+		if p := NewPeer(v); p.OnePeer!=nil {
+			if p.Tried {
+				tried = append(tried, p)
+			} else {
+				fresh = append(fresh, p)
+			}
+		}
+		return 0
+	})
+
+	peerdb_mutex.Lock()
+	defer peerdb_mutex.Unlock()
+	// The most recent ones first, so they win the collisions
+	sort.Sort(tried)
+	sort.Sort(fresh)
+	for _, p := range tried {
+		if s := triedSlot(p); *s.ref()==0 {
+			addrPlace(p, s)
+		} else {
+			fresh = append(fresh, p)
+		}
+	}
+	var dropped int
+	for _, p := range fresh {
+		if _, ok := addrSlots[p.UniqID()]; ok {
+			continue
+		}
+		if s := newSlot(p); *s.ref()==0 {
+			wastried := p.Tried
+			addrPlace(p, s)
+			if wastried {
+				p.Save()
+			}
+		} else {
+			PeerDB.Del(qdb.KeyType(p.UniqID()))
+			dropped++
+		}
+	}
+	if dropped>0 {
+		PeerDB.Defrag()
+	}
+	fmt.Println(addrNewCnt, "new and", addrTriedCnt, "tried peers loaded.", dropped, "did not fit.")
+}
+
+
+// Copies the peers from the old (flat) database, so they get put into the buckets
+func migratePeers3(dir string) {
+	if _, e := os.Stat(dir+"peers3"); e != nil {
+		return
+	}
+	old, e := qdb.NewDB(dir+"peers3", true)
+	if e != nil {
+		println("migratePeers3:", e.Error())
+		return
+	}
+	var cnt int
+	old.Browse(func(k qdb.KeyType, v []byte) uint32 {
+		if p := NewPeer(v); p.OnePeer!=nil {
+			p.SrcGroup = netGroup(p.Ip4[:]) // we do not know where we got it from
+			p.Banned = 0 // bans are kept separately now
+			PeerDB.Put(k, p.Bytes())
+			cnt++
+		}
+		return 0
+	})
+	old.Close()
+	fmt.Println(cnt, "peers imported from", dir+"peers3", "- you can remove the old folder")
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"encoding/binary"
 	"github.com/piotrnar/gocoin/btc"
+	"github.com/piotrnar/gocoin/protocol"
 )
 
 var (
@@ -26,7 +27,7 @@ func (c *OneConnection) HandleAlert(b []byte) {
 		return // already have this one
 	}
 
-	a, e := btc.NewAlert(b, AlertPubKey)
+	a, e := protocol.ParseAlert(b, AlertPubKey)
 	if e != nil {
 		println(c.PeerAddr.String(), "- sent us a broken alert:", e.Error())
 		if a == nil {
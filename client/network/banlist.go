@@ -0,0 +1,287 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+	"errors"
+	"strings"
+	"strconv"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/qdb"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+const (
+	// Bans are stored in the peers DB, with keys that have this prefix (see IsBanKey)
+	banKeyPrefix = 0xba7ba70000000000
+	banKeyMask = 0xffffff0000000000
+)
+
+// A banned IP or subnet
+type OneBan struct {
+	Ip4 [4]byte
+	Bits byte // length of the subnet mask
+	From, Until uint32 // unix time of when it has been banned and when the ban expires (zero for never)
+}
+
+var (
+	BanList map[uint64] *OneBan = make(map[uint64] *OneBan)
+	BanMutex sync.Mutex
+)
+
+
+/*
+Serialized ban record:
+ [0:4] - IPv4 (network order)
+ [4] - subnet mask length
+ [5:9] - ban time (LSB)
+ [9:13] - expiration time (LSB)
+*/
+func (b *OneBan) Bytes() (res []byte) {
+	res = make([]byte, 13)
+	copy(res[0:4], b.Ip4[:])
+	res[4] = b.Bits
+	binary.LittleEndian.PutUint32(res[5:9], b.From)
+	binary.LittleEndian.PutUint32(res[9:13], b.Until)
+	return
+}
+
+
+func (b *OneBan) Key() uint64 {
+	return banKeyPrefix | uint64(b.Bits)<<32 | uint64(binary.BigEndian.Uint32(b.Ip4[:]))
+}
+
+
+func IsBanKey(k qdb.KeyType) bool {
+	return uint64(k)&banKeyMask==banKeyPrefix
+}
+
+
+// Returns false for the records of the peers DB that are not peers (bans and the address manager's key)
+func IsPeerKey(k qdb.KeyType) bool {
+	return !IsBanKey(k) && k!=addrKeyDBKey
+}
+
+
+func (b *OneBan) mask() uint32 {
+	return ^uint32(0) << (32-uint(b.Bits))
+}
+
+
+// Returns the ban record for the subnet, with the host part of the IP cleared
+func newBan(ip4 [4]byte, bits byte) (b *OneBan) {
+	b = &OneBan{Bits:bits}
+	binary.BigEndian.PutUint32(b.Ip4[:], binary.BigEndian.Uint32(ip4[:])&b.mask())
+	return
+}
+
+
+// Returns true if the given IP is within the banned subnet
+func (b *OneBan) Contains(ip4 []byte) bool {
+	m := b.mask()
+	return binary.BigEndian.Uint32(ip4)&m == binary.BigEndian.Uint32(b.Ip4[:])&m
+}
+
+
+func (b *OneBan) Expired() bool {
+	return b.Until!=0 && uint32(time.Now().Unix())>=b.Until
+}
+
+
+func (b *OneBan) Subnet() string {
+	return fmt.Sprintf("%d.%d.%d.%d/%d", b.Ip4[0], b.Ip4[1], b.Ip4[2], b.Ip4[3], b.Bits)
+}
+
+
+// Returns when the ban started and when it ends
+func (b *OneBan) Period() (s string) {
+	s = "since " + time.Unix(int64(b.From), 0).Format("2006-01-02 15:04")
+	if b.Until==0 {
+		s += "  forever"
+	} else {
+		s += "  until " + time.Unix(int64(b.Until), 0).Format("2006-01-02 15:04")
+	}
+	return
+}
+
+
+func (b *OneBan) String() string {
+	return fmt.Sprintf("%-18s  %s", b.Subnet(), b.Period())
+}
+
+
+// Parses "a.b.c.d" or "a.b.c.d/bits"
+func ParseSubnet(s string) (ip4 [4]byte, bits byte, e error) {
+	bits = 32
+	if x := strings.Index(s, "/"); x!=-1 {
+		var n uint
+		if _, e = fmt.Sscan(s[x+1:], &n); e!=nil || n>32 {
+			e = errors.New("Bad subnet mask length in "+s)
+			return
+		}
+		bits = byte(n)
+		s = s[:x]
+	}
+	ip := net.ParseIP(s)
+	if ip==nil || ip.To4()==nil {
+		e = errors.New("Bad IPv4 address "+s)
+		return
+	}
+	copy(ip4[:], ip.To4())
+	return
+}
+
+
+// Returns the default ban duration (from the config)
+func BanTime() time.Duration {
+	return time.Duration(common.CFG.Net.BanTimeHours)*time.Hour
+}
+
+
+// Parses ban duration given as Go duration (e.g. "48h"), number of seconds or "forever".
+// An empty string means the default ban time.
+func ParseBanTime(s string) (dur time.Duration, e error) {
+	if s=="" {
+		dur = BanTime()
+	} else if s!="forever" {
+		var sec uint64
+		if sec, e = strconv.ParseUint(s, 10, 32); e==nil {
+			dur = time.Duration(sec)*time.Second
+		} else {
+			dur, e = time.ParseDuration(s)
+		}
+		if e==nil && dur<=0 {
+			e = errors.New("Ban time must be positive")
+		}
+	}
+	return
+}
+
+
+// Bans the given subnet for the given time (zero for a ban that never expires)
+// and drops any connections from it.
+func SetBan(ip4 [4]byte, bits byte, dur time.Duration) {
+	b := newBan(ip4, bits)
+	b.From = uint32(time.Now().Unix())
+	if until := int64(b.From) + int64(dur/time.Second); dur!=0 && until<=0xffffffff {
+		b.Until = uint32(until)
+	} // a ban that would expire after 2106 never does
+
+	BanMutex.Lock()
+	BanList[b.Key()] = b
+	BanMutex.Unlock()
+	PeerDB.Put(qdb.KeyType(b.Key()), b.Bytes())
+	common.CountSafe("BanSet")
+
+	Mutex_net.Lock()
+	for _, c := range OpenCons {
+		if b.Contains(c.PeerAddr.Ip4[:]) {
+			c.Disconnect()
+		}
+	}
+	Mutex_net.Unlock()
+}
+
+
+// Returns false if there was no such a ban
+func RemoveBan(ip4 [4]byte, bits byte) bool {
+	b := newBan(ip4, bits)
+	BanMutex.Lock()
+	_, ok := BanList[b.Key()]
+	delete(BanList, b.Key())
+	BanMutex.Unlock()
+	if ok {
+		PeerDB.Del(qdb.KeyType(b.Key()))
+	}
+	return ok
+}
+
+
+// Removes all the bans. Returns how many there were.
+func ClearBans() (cnt int) {
+	BanMutex.Lock()
+	for k := range BanList {
+		PeerDB.Del(qdb.KeyType(k))
+		cnt++
+	}
+	BanList = make(map[uint64] *OneBan)
+	BanMutex.Unlock()
+	return
+}
+
+
+// Returns true if the IP is within any of the (not expired) banned subnets
+func IsBanned(ip4 []byte) bool {
+	BanMutex.Lock()
+	defer BanMutex.Unlock()
+	for _, b := range BanList {
+		if !b.Expired() && b.Contains(ip4) {
+			return true
+		}
+	}
+	return false
+}
+
+
+type manyBans []*OneBan
+
+func (mb manyBans) Len() int {
+	return len(mb)
+}
+
+func (mb manyBans) Less(i, j int) bool {
+	return mb[i].From > mb[j].From
+}
+
+func (mb manyBans) Swap(i, j int) {
+	mb[i], mb[j] = mb[j], mb[i]
+}
+
+
+// Returns the current bans, the most recent first
+func GetBans() (res manyBans) {
+	BanMutex.Lock()
+	for _, b := range BanList {
+		if !b.Expired() {
+			res = append(res, b)
+		}
+	}
+	BanMutex.Unlock()
+	sort.Sort(res)
+	return
+}
+
+
+// Removes the expired bans
+func ExpireBans() {
+	BanMutex.Lock()
+	for k, b := range BanList {
+		if b.Expired() {
+			delete(BanList, k)
+			PeerDB.Del(qdb.KeyType(k))
+			common.CountSafe("BanExpired")
+		}
+	}
+	BanMutex.Unlock()
+}
+
+
+// Loads the bans from the peers DB
+func loadBans() {
+	BanMutex.Lock()
+	PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
+		if IsBanKey(k) && len(v)>=13 {
+			b := new(OneBan)
+			copy(b.Ip4[:], v[0:4])
+			b.Bits = v[4]
+			b.From = binary.LittleEndian.Uint32(v[5:9])
+			b.Until = binary.LittleEndian.Uint32(v[9:13])
+			BanList[uint64(k)] = b
+		}
+		return 0
+	})
+	BanMutex.Unlock()
+}
@@ -0,0 +1,83 @@
+package network
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"github.com/piotrnar/gocoin/others/utils"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+// Returns the folder for the capture files
+func CaptureDir() (dir string) {
+	common.LockCfg()
+	dir = common.CFG.Net.CaptureDir
+	common.UnlockCfg()
+	if dir=="" {
+		dir = common.GocoinHomeDir + "capture"
+	}
+	if dir[len(dir)-1]!=os.PathSeparator {
+		dir += string(os.PathSeparator)
+	}
+	return
+}
+
+
+// Starts writing all the messages exchanged with the peer into a new file in the given folder.
+// Returns the name of the file.
+func (c *OneConnection) StartCapture(dir string) (fn string, e error) {
+	os.MkdirAll(dir, 0700)
+	fn = fmt.Sprintf("%s%d.%d.%d.%d_%d_%d_%s.cap", dir, c.PeerAddr.Ip4[0], c.PeerAddr.Ip4[1],
+		c.PeerAddr.Ip4[2], c.PeerAddr.Ip4[3], c.PeerAddr.Port, c.ConnID, time.Now().Format("20060102_150405"))
+	f, e := os.Create(fn)
+	if e != nil {
+		return
+	}
+	h := &utils.MsgCapHeader{Ip4:c.PeerAddr.Ip4, Port:c.PeerAddr.Port, Incoming:c.Incoming, Started:time.Now()}
+	copy(h.Magic[:], common.Magic[:])
+	if _, e = f.Write(h.Bytes()); e != nil {
+		f.Close()
+		return
+	}
+	c.Mutex.Lock()
+	if c.capture != nil {
+		c.capture.Close()
+	}
+	c.capture = f
+	c.Mutex.Unlock()
+	common.CountSafe("CaptureStarted")
+	return
+}
+
+
+// Closes the capture file, if there is one
+func (c *OneConnection) StopCapture() {
+	c.Mutex.Lock()
+	if c.capture != nil {
+		c.capture.Close()
+		c.capture = nil
+	}
+	c.Mutex.Unlock()
+}
+
+
+func (c *OneConnection) Capturing() (yes bool) {
+	c.Mutex.Lock()
+	yes = c.capture != nil
+	c.Mutex.Unlock()
+	return
+}
+
+
+// Make sure to call it with locked c.Mutex
+func (c *OneConnection) captureMsg(sent bool, cmd string, pl []byte) {
+	if c.capture == nil {
+		return
+	}
+	m := &utils.CapMsg{Time:time.Now(), Sent:sent, Cmd:cmd, Pl:pl}
+	if _, e := c.capture.Write(m.Bytes()); e != nil {
+		println("Capture of", c.PeerAddr.Ip(), "aborted:", e.Error())
+		c.capture.Close()
+		c.capture = nil
+	}
+}
@@ -0,0 +1,137 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/btc"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+const (
+	MaxCFiltersAtOnce = 1000
+	MaxCFHeadersAtOnce = 2000
+	CFCheckptInterval = 1000
+)
+
+
+// Returns blocks from start_height up to the given stop block (in the ascending order)
+func cfBlockRange(start_height uint32, stop *btc.Uint256, max uint32) (res []*btc.BlockTreeNode, ok bool) {
+	common.BlockChain.BlockIndexAccess.Lock()
+	defer common.BlockChain.BlockIndexAccess.Unlock()
+	n, ok := common.BlockChain.BlockIndex[stop.BIdx()]
+	if !ok || start_height>n.Height || n.Height-start_height>=max {
+		ok = false
+		return
+	}
+	res = make([]*btc.BlockTreeNode, n.Height-start_height+1)
+	for i:=len(res)-1; i>=0; i-- {
+		res[i] = n
+		n = n.Parent
+	}
+	return
+}
+
+
+// Parses "getcfilters" and "getcfheaders" payloads
+func parseCFRequest(pl []byte) (start_height uint32, stop *btc.Uint256, ok bool) {
+	if len(pl)!=37 || pl[0]!=btc.BasicFilterType {
+		return
+	}
+	start_height = binary.LittleEndian.Uint32(pl[1:5])
+	stop = btc.NewUint256(pl[5:37])
+	ok = true
+	return
+}
+
+
+func (c *OneConnection) GetCFilters(pl []byte) {
+	start_height, stop, ok := parseCFRequest(pl)
+	if !ok {
+		c.DoS("BadGetCFilters")
+		return
+	}
+	nodes, ok := cfBlockRange(start_height, stop, MaxCFiltersAtOnce)
+	if !ok {
+		common.CountSafe("GetCFiltersBad")
+		return
+	}
+	for i := range nodes {
+		f, er := common.BlockChain.Filters.Get(nodes[i].BlockHash)
+		if er != nil {
+			common.CountSafe("GetCFiltersMissing")
+			return
+		}
+		fb := f.Bytes()
+		b := new(bytes.Buffer)
+		b.WriteByte(btc.BasicFilterType)
+		b.Write(nodes[i].BlockHash.Hash[:])
+		btc.WriteVlen(b, uint32(len(fb)))
+		b.Write(fb)
+		c.SendRawMsg("cfilter", b.Bytes())
+	}
+}
+
+
+func (c *OneConnection) GetCFHeaders(pl []byte) {
+	start_height, stop, ok := parseCFRequest(pl)
+	if !ok {
+		c.DoS("BadGetCFHeaders")
+		return
+	}
+	nodes, ok := cfBlockRange(start_height, stop, MaxCFHeadersAtOnce)
+	if !ok {
+		common.CountSafe("GetCFHeadersBad")
+		return
+	}
+
+	prvhdr := make([]byte, 32)
+	if nodes[0].Parent != nil {
+		if _, prvhdr, ok = common.BlockChain.Filters.Headers(nodes[0].Parent.BlockHash); !ok {
+			common.CountSafe("GetCFHeadersMissing")
+			return
+		}
+	}
+
+	b := new(bytes.Buffer)
+	b.WriteByte(btc.BasicFilterType)
+	b.Write(stop.Hash[:])
+	b.Write(prvhdr)
+	btc.WriteVlen(b, uint32(len(nodes)))
+	for i := range nodes {
+		fh, _, ok := common.BlockChain.Filters.Headers(nodes[i].BlockHash)
+		if !ok {
+			common.CountSafe("GetCFHeadersMissing")
+			return
+		}
+		b.Write(fh)
+	}
+	c.SendRawMsg("cfheaders", b.Bytes())
+}
+
+
+func (c *OneConnection) GetCFCheckpt(pl []byte) {
+	if len(pl)!=33 || pl[0]!=btc.BasicFilterType {
+		c.DoS("BadGetCFCheckpt")
+		return
+	}
+	stop := btc.NewUint256(pl[1:33])
+	nodes, ok := cfBlockRange(0, stop, 0xffffffff)
+	if !ok {
+		common.CountSafe("GetCFCheckptBad")
+		return
+	}
+
+	b := new(bytes.Buffer)
+	b.WriteByte(btc.BasicFilterType)
+	b.Write(stop.Hash[:])
+	btc.WriteVlen(b, uint32((len(nodes)-1)/CFCheckptInterval))
+	for i:=CFCheckptInterval; i<len(nodes); i+=CFCheckptInterval {
+		_, hdr, ok := common.BlockChain.Filters.Headers(nodes[i].BlockHash)
+		if !ok {
+			common.CountSafe("GetCFCheckptMissing")
+			return
+		}
+		b.Write(hdr)
+	}
+	c.SendRawMsg("cfcheckpt", b.Bytes())
+}
@@ -0,0 +1,294 @@
+package network
+
+import (
+	"time"
+	"bytes"
+	"errors"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/btc"
+	"github.com/piotrnar/gocoin/protocol"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+const (
+	CmpctVersion = 1 // BIP152 compact blocks (no segwit)
+	CmpctMinProtoVersion = 70014
+
+	MaxCmpctInProgress = 4 // how many blocks a peer can have reconstructing at once
+)
+
+// A compact block waiting for its missing transactions
+type oneCmpctBlock struct {
+	header []byte
+	txs [][]byte // raw transactions - nil if still missing
+	missing []int
+	start time.Time // when we asked for the missing ones
+}
+
+
+// Calculates the siphash key for short transaction IDs
+func cmpctKeys(header []byte, nonce []byte) (k0, k1 uint64) {
+	s := sha256.New()
+	s.Write(header[:80])
+	s.Write(nonce[:8])
+	h := s.Sum(nil)
+	k0 = binary.LittleEndian.Uint64(h[0:8])
+	k1 = binary.LittleEndian.Uint64(h[8:16])
+	return
+}
+
+
+func cmpctShortId(k0, k1 uint64, txid []byte) uint64 {
+	return btc.SipHash(k0, k1, txid) & 0xffffffffffff
+}
+
+
+// Splits the block into its raw transactions
+func blockRawTxs(raw []byte) (txs [][]byte, e error) {
+	bl, e := btc.NewBlock(raw)
+	if e != nil {
+		return
+	}
+	offs := bl.TxOffset
+	txs = make([][]byte, bl.TxCount)
+	for i := range txs {
+		tx, n := btc.NewTx(raw[offs:])
+		if tx==nil || n==0 {
+			txs, e = nil, errors.New("blockRawTxs: NewTx failed")
+			return
+		}
+		txs[i] = raw[offs:offs+n]
+		offs += n
+	}
+	return
+}
+
+
+// Builds the "cmpctblock" message payload. Only the coinbase is prefilled.
+func cmpctBlockMsg(raw []byte) (res []byte, e error) {
+	txs, e := blockRawTxs(raw)
+	if e != nil {
+		return
+	}
+	cb := &protocol.CmpctBlock{Header:raw[:80]}
+	rand.Read(cb.Nonce[:])
+	k0, k1 := cmpctKeys(raw[:80], cb.Nonce[:])
+	cb.ShortIds = make([]uint64, len(txs)-1)
+	for i := range cb.ShortIds {
+		cb.ShortIds[i] = cmpctShortId(k0, k1, btc.NewSha2Hash(txs[i+1]).Hash[:])
+	}
+	cb.Prefilled = []*protocol.PrefilledTx{&protocol.PrefilledTx{Index:0, Raw:txs[0]}}
+	res = cb.Bytes()
+	return
+}
+
+
+func (c *OneConnection) SendCmpct() {
+	if c.Node.Version>=CmpctMinProtoVersion && common.CFG.TXPool.Enabled {
+		var b [9]byte
+		b[0] = 0 // we want the low-bandwidth mode
+		binary.LittleEndian.PutUint64(b[1:9], CmpctVersion)
+		c.SendRawMsg("sendcmpct", b[:])
+	}
+}
+
+
+func (c *OneConnection) HandleSendCmpct(pl []byte) {
+	if len(pl)!=9 {
+		c.DoS("BadSendCmpct")
+		return
+	}
+	if binary.LittleEndian.Uint64(pl[1:9])!=CmpctVersion {
+		common.CountSafe("SendCmpctVerUnkn")
+		return
+	}
+	c.Mutex.Lock()
+	c.Node.SendCmpctVer = CmpctVersion
+	c.Node.HighBandwidth = pl[0]!=0
+	c.Mutex.Unlock()
+}
+
+
+// Returns false if the compact block's header does not connect to our chain or has no valid PoW
+func (c *OneConnection) cmpctHeaderOk(bh *btc.Uint256, hdr []byte) bool {
+	common.BlockChain.BlockIndexAccess.Lock()
+	_, parent := common.BlockChain.BlockIndex[btc.NewUint256(hdr[4:36]).BIdx()]
+	common.BlockChain.BlockIndexAccess.Unlock()
+	if !parent {
+		// Let getblocks sort it out
+		common.CountSafe("CmpctUnconnected")
+		c.Mutex.Lock()
+		c.NextBlocksAsk = time.Now()
+		c.Mutex.Unlock()
+		return false
+	}
+	if !btc.CheckProofOfWork(bh, binary.LittleEndian.Uint32(hdr[72:76])) {
+		c.DoS("BadCmpctBlock")
+		return false
+	}
+	return true
+}
+
+
+func (c *OneConnection) HandleCmpctBlock(pl []byte) {
+	cmb, e := protocol.ParseCmpctBlock(pl)
+	if e != nil {
+		c.DoS("BadCmpctBlock")
+		return
+	}
+	bh := btc.NewSha2Hash(cmb.Header)
+	MutexRcv.Lock()
+	_, got := ReceivedBlocks[bh.BIdx()]
+	MutexRcv.Unlock()
+	if got {
+		common.CountSafe("CmpctNotWanted")
+		return
+	}
+	if !c.cmpctHeaderOk(bh, cmb.Header) {
+		return
+	}
+	k0, k1 := cmpctKeys(cmb.Header, cmb.Nonce[:])
+
+	cb := new(oneCmpctBlock)
+	cb.header = cmb.Header
+	cb.txs = make([][]byte, len(cmb.ShortIds)+len(cmb.Prefilled))
+	for _, p := range cmb.Prefilled {
+		cb.txs[p.Index] = p.Raw
+	}
+
+	// Now assign the short ids to the free slots
+	shortids := make(map[uint64]int, len(cmb.ShortIds))
+	idx := 0
+	for _, id := range cmb.ShortIds {
+		for cb.txs[idx]!=nil {
+			idx++
+		}
+		if _, dup := shortids[id]; dup {
+			common.CountSafe("CmpctShortIdDup")
+			c.GetBlockData(bh.Hash[:])
+			return
+		}
+		shortids[id] = idx
+		idx++
+	}
+
+	// Fill in what we can from the memory pool
+	TxMutex.Lock()
+	for _, v := range TransactionsToSend {
+		if i, ok := shortids[cmpctShortId(k0, k1, v.Hash.Hash[:])]; ok {
+			if cb.txs[i]!=nil {
+				TxMutex.Unlock()
+				common.CountSafe("CmpctShortIdColl")
+				c.GetBlockData(bh.Hash[:])
+				return
+			}
+			cb.txs[i] = v.Data
+		}
+	}
+	TxMutex.Unlock()
+
+	for i := range cb.txs {
+		if cb.txs[i]==nil {
+			cb.missing = append(cb.missing, i)
+		}
+	}
+
+	if len(cb.missing)==0 {
+		common.CountSafe("CmpctComplete")
+		c.cmpctBlockDone(bh, cb)
+		return
+	}
+
+	c.Mutex.Lock()
+	if len(c.CmpctInProgress) >= MaxCmpctInProgress {
+		c.Mutex.Unlock()
+		common.CountSafe("CmpctTooMany")
+		c.GetBlockData(bh.Hash[:])
+		return
+	}
+	cb.start = time.Now()
+	c.CmpctInProgress[bh.BIdx()] = cb
+	c.Mutex.Unlock()
+
+	common.CountSafe("CmpctIncomplete")
+	req := &protocol.GetBlockTxn{Hash:bh, Indexes:cb.missing}
+	c.SendRawMsg("getblocktxn", req.Bytes())
+}
+
+
+// Assembles the block and passes it on, as if it came in a "block" message
+func (c *OneConnection) cmpctBlockDone(bh *btc.Uint256, cb *oneCmpctBlock) {
+	b := new(bytes.Buffer)
+	b.Write(cb.header)
+	btc.WriteVlen(b, uint32(len(cb.txs)))
+	for i := range cb.txs {
+		b.Write(cb.txs[i])
+	}
+	raw := b.Bytes()
+
+	bl, e := btc.NewBlock(raw)
+	if e == nil {
+		e = bl.BuildTxList()
+	}
+	if e != nil || !bytes.Equal(btc.GetMerkel(bl.Txs), bl.MerkleRoot()) {
+		common.CountSafe("CmpctMerkleBad")
+		c.GetBlockData(bh.Hash[:])
+		return
+	}
+	netBlockReceived(c, raw)
+}
+
+
+func (c *OneConnection) HandleBlockTxn(pl []byte) {
+	bt, e := protocol.ParseBlockTxn(pl)
+	if e != nil {
+		c.DoS("BadBlockTxn")
+		return
+	}
+	c.Mutex.Lock()
+	cb, ok := c.CmpctInProgress[bt.Hash.BIdx()]
+	delete(c.CmpctInProgress, bt.Hash.BIdx())
+	c.Mutex.Unlock()
+	if !ok {
+		common.CountSafe("BlockTxnUnexpected")
+		return
+	}
+	if len(bt.Txs)!=len(cb.missing) {
+		c.DoS("BadBlockTxn")
+		return
+	}
+	for i, idx := range cb.missing {
+		cb.txs[idx] = bt.Txs[i]
+	}
+	c.cmpctBlockDone(bt.Hash, cb)
+}
+
+
+func (c *OneConnection) GetBlockTxn(pl []byte) {
+	req, e := protocol.ParseGetBlockTxn(pl)
+	if e != nil {
+		c.DoS("BadGetBlockTxn")
+		return
+	}
+	raw, _, e := common.BlockChain.Blocks.BlockGet(req.Hash)
+	if e != nil {
+		common.CountSafe("GetBlockTxnUnkn")
+		return
+	}
+	txs, e := blockRawTxs(raw)
+	if e != nil {
+		println("GetBlockTxn:", e.Error())
+		return
+	}
+	bt := &protocol.BlockTxn{Hash:req.Hash, Txs:make([][]byte, len(req.Indexes))}
+	for i, idx := range req.Indexes {
+		if idx>=len(txs) {
+			c.DoS("BadGetBlockTxn")
+			return
+		}
+		bt.Txs[i] = txs[idx]
+	}
+	c.SendRawMsg("blocktxn", bt.Bytes())
+}
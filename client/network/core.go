@@ -1,6 +1,7 @@
 package network
 
 import (
+	"os"
 	"fmt"
 	"net"
 	"time"
@@ -12,6 +13,7 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"github.com/piotrnar/gocoin/btc"
+	"github.com/piotrnar/gocoin/protocol"
 	"github.com/piotrnar/gocoin/client/common"
 )
 
@@ -55,6 +57,28 @@ var (
 	// Hammering protection (peers that keep re-connecting) map IPv4 => UnixTime
 	HammeringMutex sync.Mutex
 	RecentlyDisconencted map[[4]byte] time.Time = make(map[[4]byte] time.Time)
+
+	// Misbehaving scores of the offences. The ones not listed here get the peer banned at once.
+	DoSScores map[string] uint = map[string] uint {
+		"MsgBadChksum": 20,
+		"MsgSizeMismatch": 20,
+		"MsgTooBig": 50,
+		"BrokenAlert": 10,
+		"BadFeeFilter": 10,
+		"BadSendCmpct": 10,
+		"BadGetCFilters": 10,
+		"BadGetCFHeaders": 10,
+		"BadGetCFCheckpt": 10,
+		"BadGetBlks": 20,
+		"BadGetHdrs": 20,
+		"BadGetBlockTxn": 20,
+		"TxLenMismatch": 20,
+		"TxBroken": 50,
+		"TxNoInputs": 50,
+		"BadBlockTxn": 50,
+		"BadCmpctBlock": 50,
+		"BadHeaders": 50,
+	}
 )
 
 
@@ -70,6 +94,8 @@ type OneConnection struct {
 
 	// TCP connection data:
 	Incoming bool
+	Whitelisted bool // the peer is from CFG.Net.Whitelist (never banned)
+	AddNode bool // outgoing connection to one of CFG.Net.AddNodes
 	NetConn net.Conn
 
 	// Handshake data
@@ -85,6 +111,10 @@ type OneConnection struct {
 		Agent string
 		DoNotRelayTxs bool
 		ReportedIp4 uint32
+		SendCmpctVer uint64 // BIP152 version, that the peer wants to use
+		HighBandwidth bool // peer wants new blocks as "cmpctblock", without inv
+		SendHeaders bool // peer wants new blocks announced with "headers" (BIP130)
+		FeeFilter uint64 // do not send invs of txs with lower fee (satoshis per 1000 bytes)
 	}
 
 	// Messages reception state machine:
@@ -106,20 +136,33 @@ type OneConnection struct {
 	// Statistics:
 	LoopCnt, TicksCnt uint  // just to see if the threads loop is alive
 	BytesReceived, BytesSent uint64
+	TrafficIn, TrafficOut TrafficWindow // bytes of the messages over the last few minutes
+	MsgTraffic map[string] *MsgTraffic // traffic by message type
 	LastBtsRcvd, LastBtsSent uint32
 	LastCmdRcvd, LastCmdSent string
 	InvsRecieved uint64
+	AddrsAccepted uint // how many addresses we have taken from this peer
+	BanScore uint // grows each time the peer misbehaves
+
+	OrphanCnt uint // how many of the peer's txs are waiting for inputs (protected by TxMutex)
+
+	capture *os.File // all the messages get written in here, when not nil (see capture.go)
 
 	PendingInvs []*[36]byte // List of pending INV to send and the mutex protecting access to it
+	PendingTxInvs []*[36]byte // tx invs waiting to be trickled (see trickle.go)
+	NextTxInvs time.Time // when PendingTxInvs are to be sent
 
 	NextGetAddr time.Time // When we shoudl issue "getaddr" again
 
 	LastDataGot time.Time // if we have no data for some time, we abort this conenction
 
 	LastBlocksFrom *btc.BlockTreeNode // what the last getblocks was based un
+	LastHeaderSent *btc.BlockTreeNode // the last block header that we sent to this peer
+	FeeFilterSent uint64 // the last feefilter value that we sent to this peer
 	NextBlocksAsk time.Time           // when the next getblocks should be needed
 
 	GetBlockInProgress map[[btc.Uint256IdxLen]byte] *oneBlockDl
+	CmpctInProgress map[[btc.Uint256IdxLen]byte] *oneCmpctBlock
 
 	// Ping stats
 	PingHistory [PingHistoryLength]int
@@ -146,7 +189,10 @@ func NewConnection(ad *onePeer) (c *OneConnection) {
 	c = new(OneConnection)
 	c.PeerAddr = ad
 	c.GetBlockInProgress = make(map[[btc.Uint256IdxLen]byte] *oneBlockDl)
+	c.CmpctInProgress = make(map[[btc.Uint256IdxLen]byte] *oneCmpctBlock)
+	c.MsgTraffic = make(map[string] *MsgTraffic)
 	c.ConnID = atomic.AddUint32(&LastConnId, 1)
+	c.Whitelisted = common.IsWhitelisted(ad.Ip4[:])
 	return
 }
 
@@ -171,21 +217,13 @@ func (c *OneConnection) SendRawMsg(cmd string, pl []byte) (e error) {
 
 	common.CountSafe("sent_"+cmd)
 	common.CountSafeAdd("sbts_"+cmd, uint64(len(pl)))
-	sbuf := make([]byte, 24+len(pl))
 
 	c.LastCmdSent = cmd
 	c.LastBtsSent = uint32(len(pl))
+	c.captureMsg(true, cmd, pl)
+	c.countTraffic(true, cmd, 24+len(pl))
 
-	binary.LittleEndian.PutUint32(sbuf[0:4], common.Version)
-	copy(sbuf[0:4], common.Magic[:])
-	copy(sbuf[4:16], cmd)
-	binary.LittleEndian.PutUint32(sbuf[16:20], uint32(len(pl)))
-
-	sh := btc.Sha2Sum(pl[:])
-	copy(sbuf[20:24], sh[:4])
-	copy(sbuf[24:], pl)
-
-	c.Send.Buf = append(c.Send.Buf, sbuf...)
+	c.Send.Buf = append(c.Send.Buf, protocol.NewMsg(common.Magic, cmd, pl)...)
 
 	if common.DebugLevel<0 {
 		fmt.Println(cmd, len(c.Send.Buf), "->", c.PeerAddr.Ip())
@@ -211,11 +249,30 @@ func (c *OneConnection) IsBroken() (res bool) {
 }
 
 
+// Punishes the peer for the offence, with its score from DoSScores
 func (c *OneConnection) DoS(why string) {
-	common.CountSafe("Ban"+why)
+	score, ok := DoSScores[why]
+	if !ok {
+		score = uint(atomic.LoadUint32(&common.CFG.Net.BanScore))
+	}
+	c.Misbehave(why, score)
+}
+
+
+// Adds the score to the peer's ban score, banning it when it reaches the configured threshold.
+// Whitelisted peers only get their score increased (they still get disconnected on framing errors).
+func (c *OneConnection) Misbehave(why string, score uint) {
+	common.CountSafe("Bad"+why)
+	if c==nil {
+		return // not from a peer (e.g. a tx returned from an orphaned block)
+	}
 	c.Mutex.Lock()
-	c.banit = true
-	c.broken = true
+	c.BanScore += score
+	if !c.banit && !c.Whitelisted && c.BanScore >= uint(atomic.LoadUint32(&common.CFG.Net.BanScore)) {
+		c.banit = true
+		c.broken = true
+		common.CountSafe("Ban"+why)
+	}
 	c.Mutex.Unlock()
 }
 
@@ -274,6 +331,7 @@ func (c *OneConnection) FetchMessage() (*BCmsg) {
 			if c.recv.pl_len > msi {
 				//println(c.PeerAddr.Ip(), "Command", c.recv.cmd, "is going to be too big", c.recv.pl_len, msi)
 				c.DoS("MsgTooBig")
+				c.Disconnect() // we cannot skip the payload, so the stream is lost
 				return nil
 			}
 			c.Mutex.Lock()
@@ -290,6 +348,7 @@ func (c *OneConnection) FetchMessage() (*BCmsg) {
 				if c.recv.datlen > c.recv.pl_len {
 					println(c.PeerAddr.Ip(), "is sending more of", c.recv.cmd, "then it should have", c.recv.datlen, c.recv.pl_len)
 					c.DoS("MsgSizeMismatch")
+					c.Disconnect()
 					return nil
 				}
 			}
@@ -307,6 +366,10 @@ func (c *OneConnection) FetchMessage() (*BCmsg) {
 	if !bytes.Equal(c.recv.hdr[20:24], sh[:4]) {
 		//println(c.PeerAddr.Ip(), "Msg checksum error")
 		c.DoS("MsgBadChksum")
+		c.Mutex.Lock()
+		c.recv.dat = nil // skip the message, so it does not get scored again
+		c.recv.hdr_len = 0
+		c.Mutex.Unlock()
 		return nil
 	}
 
@@ -318,6 +381,8 @@ func (c *OneConnection) FetchMessage() (*BCmsg) {
 	c.recv.dat = nil
 	c.recv.hdr_len = 0
 	c.BytesReceived += uint64(24+len(ret.pl))
+	c.captureMsg(false, ret.cmd, ret.pl)
+	c.countTraffic(false, ret.cmd, 24+len(ret.pl))
 	c.Mutex.Unlock()
 
 	return ret
@@ -340,7 +405,12 @@ func maxmsgsize(cmd string) uint32 {
 		case "addr": return 3+1000*30 // max 1000 addrs
 		case "block": return 1e6 // max block size 1MB
 		case "getblocks": return 4+3+500*32+32 // we allow up to 500 locator hashes
+		case "getheaders": return 4+3+500*32+32 // we allow up to 500 locator hashes
 		case "getdata": return 3+1000*36 // the spec says "max 50000 entries", but we reject more than 1000
+		case "cmpctblock": return 1e6 // max block size 1MB
+		case "blocktxn": return 1e6 // max block size 1MB
+		case "getblocktxn": return 32+3+3*16667 // max txs in 1MB block
+		case "headers": return 3+2000*81 // max 2000 headers
 		default: return 1024 // Any other type of block: 1KB payload limit
 	}
 }
@@ -3,99 +3,93 @@ package network
 import (
 	"fmt"
 	"time"
-	"bytes"
 	"sync/atomic"
-	"encoding/binary"
 	"github.com/piotrnar/gocoin/btc"
+	"github.com/piotrnar/gocoin/protocol"
 	"github.com/piotrnar/gocoin/client/common"
 )
 
 
 func (c *OneConnection) ProcessGetData(pl []byte) {
-	var notfound []byte
+	var notfound []*protocol.Inv
 
 	//println(c.PeerAddr.Ip(), "getdata")
-	b := bytes.NewReader(pl)
-	cnt, e := btc.ReadVLen(b)
+	invs, e := protocol.ParseInv(pl)
 	if e != nil {
 		println("ProcessGetData:", e.Error(), c.PeerAddr.Ip())
 		return
 	}
-	for i:=0; i<int(cnt); i++ {
-		var typ uint32
-		var h [36]byte
-
-		n, _ := b.Read(h[:])
-		if n!=36 {
-			println("ProcessGetData: pl too short", c.PeerAddr.Ip())
-			return
-		}
-
-		typ = binary.LittleEndian.Uint32(h[:4])
-
-		common.CountSafe(fmt.Sprint("GetdataType",typ))
-		if typ == 2 {
-			uh := btc.NewUint256(h[4:])
-			bl, _, er := common.BlockChain.Blocks.BlockGet(uh)
-			if er == nil {
+	for _, inv := range invs {
+		common.CountSafe(fmt.Sprint("GetdataType",inv.Type))
+		if inv.Type == protocol.MSG_BLOCK {
+			bl, _, er := common.BlockChain.Blocks.BlockGet(inv.Hash)
+			if er == nil && c.blockOverQuota(bl) {
+				common.CountSafe("GetdataOverQuota")
+				notfound = append(notfound, inv)
+			} else if er == nil {
 				c.SendRawMsg("block", bl)
 			} else {
-				notfound = append(notfound, h[:]...)
+				notfound = append(notfound, inv)
+			}
+		} else if inv.Type == protocol.MSG_CMPCT_BLOCK {
+			// compact block (BIP152)
+			bl, _, er := common.BlockChain.Blocks.BlockGet(inv.Hash)
+			if er == nil && c.blockOverQuota(bl) {
+				common.CountSafe("GetdataOverQuota")
+				notfound = append(notfound, inv)
+			} else if er == nil {
+				if msg, er := cmpctBlockMsg(bl); er == nil {
+					c.SendRawMsg("cmpctblock", msg)
+				}
+			} else {
+				notfound = append(notfound, inv)
 			}
-		} else if typ == 1 {
+		} else if inv.Type == protocol.MSG_TX {
 			// transaction
-			uh := btc.NewUint256(h[4:])
 			TxMutex.Lock()
-			if tx, ok := TransactionsToSend[uh.BIdx()]; ok && tx.Blocked==0 {
+			if tx, ok := TransactionsToSend[inv.Hash.BIdx()]; ok && tx.Blocked==0 {
 				tx.SentCnt++
 				tx.Lastsent = time.Now()
 				TxMutex.Unlock()
 				c.SendRawMsg("tx", tx.Data)
 			} else {
 				TxMutex.Unlock()
-				notfound = append(notfound, h[:]...)
+				notfound = append(notfound, inv)
 			}
 		} else {
 			if common.DebugLevel>0 {
-				println("getdata for type", typ, "not supported yet")
+				println("getdata for type", inv.Type, "not supported yet")
 			}
-			if typ>0 && typ<=3 /*3 is a filtered block(we dont support it)*/ {
-				notfound = append(notfound, h[:]...)
+			if inv.Type>0 && inv.Type<=protocol.MSG_FILTERED_BLOCK /*we dont support filtered blocks*/ {
+				notfound = append(notfound, inv)
 			}
 		}
 	}
 
 	if len(notfound)>0 {
-		buf := new(bytes.Buffer)
-		btc.WriteVlen(buf, uint32(len(notfound)/36))
-		buf.Write(notfound)
-		c.SendRawMsg("notfound", buf.Bytes())
+		c.SendRawMsg("notfound", protocol.InvBytes(notfound))
 	}
 }
 
 
 func (c *OneConnection) GetBlockData(h []byte) {
-	var b [1+4+32]byte
-	b[0] = 1 // One inv
-	b[1] = 2 // Block
-	copy(b[5:37], h[:32])
+	bh := btc.NewUint256(h)
 	if common.DebugLevel > 1 {
-		println("GetBlockData", btc.NewUint256(h).String())
+		println("GetBlockData", bh.String())
 	}
-	bh := btc.NewUint256(h)
 	c.Mutex.Lock()
 	c.GetBlockInProgress[bh.BIdx()] = &oneBlockDl{hash:bh, start:time.Now()}
 	c.Mutex.Unlock()
-	c.SendRawMsg("getdata", b[:])
+	c.SendRawMsg("getdata", protocol.InvBytes([]*protocol.Inv{protocol.NewInv(protocol.MSG_BLOCK, bh)}))
 }
 
 
 // This function is called from a net conn thread
 func netBlockReceived(conn *OneConnection, b []byte) {
-	bl, e := btc.NewBlock(b)
+	bl, e := protocol.ParseBlock(b)
 	if e != nil {
 		conn.DoS("BrokenBlock")
-		println("NewBlock:", e.Error())
+		println("ParseBlock:", e.Error())
 		return
 	}
 
@@ -164,64 +158,27 @@ func blockWanted(h []byte) (yes bool) {
 	return
 }
 
-// Read VLen followed by the number of locators
-// parse the payload of getblocks and getheaders messages
-func parseLocatorsPayload(pl []byte) (h2get []*btc.Uint256, hashstop *btc.Uint256, er error) {
-	var cnt uint64
-	var h [32]byte
-	var ver uint32
-
-	b := bytes.NewReader(pl)
-
-	// version
-	if er = binary.Read(b, binary.LittleEndian, &ver); er != nil {
-		return
-	}
-
-	// hash count
-	cnt, er = btc.ReadVLen(b)
-	if er != nil {
-		return
-	}
-
-	// block locator hashes
-	if cnt>0 {
-		h2get = make([]*btc.Uint256, cnt)
-		for i:=0; i<int(cnt); i++ {
-			if _, er = b.Read(h[:]); er!=nil {
-				return
-			}
-			h2get[i] = btc.NewUint256(h[:])
-		}
-	}
-
-	// hash_stop
-	if _, er = b.Read(h[:]); er!=nil {
-		return
-	}
-	hashstop = btc.NewUint256(h[:])
-
-	return
-}
-
 
 // Handle getheaders protocol command
 // https://en.bitcoin.it/wiki/Protocol_specification#getheaders
 func (c *OneConnection) GetHeaders(pl []byte) {
-	h2get, hashstop, e := parseLocatorsPayload(pl)
-	if e != nil || hashstop==nil {
+	loc, e := protocol.ParseLocator(pl)
+	if e != nil {
 		println("GetHeaders: error parsing payload from", c.PeerAddr.Ip())
 		c.DoS("BadGetHdrs")
 		return
 	}
+	h2get, hashstop := loc.Hashes, loc.Stop
 
 	if common.DebugLevel > 1 {
 		println("GetHeaders", len(h2get), hashstop.String())
 	}
 
 	var best_block, last_block *btc.BlockTreeNode
+	var resp [][]byte
 
 	common.BlockChain.BlockIndexAccess.Lock()
+	last_block = common.BlockChain.BlockTreeEnd
 	if len(h2get) > 0 {
 		for i := range h2get {
 			if bl, ok := common.BlockChain.BlockIndex[h2get[i].BIdx()]; ok {
@@ -230,26 +187,34 @@ func (c *OneConnection) GetHeaders(pl []byte) {
 				}
 			}
 		}
-	} else {
-		best_block = common.BlockChain.BlockIndex[hashstop.BIdx()]
+		if best_block==nil {
+			best_block = common.BlockChain.BlockTreeRoot // no locator known - start from genesis
+		} else {
+			best_block = best_block.FirstCommonParent(last_block) // it may be on a side branch
+		}
+		for len(resp)<protocol.MaxHeadersCount {
+			best_block = best_block.FindPathTo(last_block)
+			if best_block==nil {
+				break
+			}
+			resp = append(resp, best_block.BlockHeader[:])
+			if best_block.BlockHash.Equal(hashstop) {
+				break
+			}
+		}
+	} else if bl, ok := common.BlockChain.BlockIndex[hashstop.BIdx()]; ok {
+		// no locators - the peer only wants the hashstop header
+		best_block = bl
+		resp = [][]byte{bl.BlockHeader[:]}
 	}
-	last_block = common.BlockChain.BlockTreeEnd
 	common.BlockChain.BlockIndexAccess.Unlock()
 
-	var resp []byte
-	var cnt uint32
-	for cnt<2000 {
-		best_block = best_block.FindPathTo(last_block)
-		if best_block==nil {
-			break
-		}
-		resp = append(resp, append(best_block.BlockHeader[:], 0)...) // 81st byte is always zero
-		cnt++
+	if best_block!=nil && len(resp)>0 {
+		c.Mutex.Lock()
+		c.LastHeaderSent = best_block
+		c.Mutex.Unlock()
 	}
 
-	out := new(bytes.Buffer)
-	btc.WriteVlen(out, cnt)
-	out.Write(resp)
-	c.SendRawMsg("headers", out.Bytes())
+	c.SendRawMsg("headers", protocol.HeadersBytes(resp))
 	return
 }
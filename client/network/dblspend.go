@@ -0,0 +1,77 @@
+package network
+
+import (
+	"fmt"
+	"time"
+	"github.com/piotrnar/gocoin/btc"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+// A tx from the memory pool has been double spent
+type DoubleSpend struct {
+	time.Time
+	TxID *btc.Uint256 // the one from the pool
+	ConflictID *btc.Uint256 // the one that spends the same input(s)
+	Own bool // TxID is own tx
+	Mined bool // ConflictID has been mined
+	Inputs []btc.TxPrevOut // outputs spent by both txs
+	PrevOuts []*btc.TxOut // value and script of each of the Inputs (nil if unknown)
+	Wallet btc.AllUnspentTx // affected outputs from the wallet's balance (filled in by usif)
+}
+
+var (
+	NetDoubleSpends chan *DoubleSpend = make(chan *DoubleSpend, 100)
+)
+
+
+func (ds *DoubleSpend) String() (s string) {
+	if ds.Own {
+		s = "Own tx "
+	} else {
+		s = "Tx "
+	}
+	s += ds.TxID.String() + " double spent by " + ds.ConflictID.String()
+	if ds.Mined {
+		s += " (mined)"
+	}
+	s += fmt.Sprint(" - ", len(ds.Inputs), " input(s)")
+	if len(ds.Wallet)>0 {
+		var val uint64
+		for i := range ds.Wallet {
+			val += ds.Wallet[i].Value
+		}
+		s += fmt.Sprintf(", %.8f BTC from %d wallet output(s)", float64(val)/1e8, len(ds.Wallet))
+	}
+	return
+}
+
+
+// Reports that the given tx spends some of the inputs of the pool tx
+// Make sure to call it with locked TxMutex
+func doubleSpendSeen(rec *OneTxToSend, tx *btc.Tx, mined bool) {
+	if rec==nil {
+		return
+	}
+	ds := &DoubleSpend{Time:time.Now(), TxID:rec.Tx.Hash, ConflictID:tx.Hash, Own:rec.Own!=0, Mined:mined}
+	// Take the spent outputs now - once the conflict is mined, they are gone from the unspent db
+	ins := make(map[btc.TxPrevOut] *btc.TxOut, len(rec.TxIn))
+	for i := range rec.TxIn {
+		if i < len(rec.PrevOuts) {
+			ins[rec.TxIn[i].Input] = rec.PrevOuts[i]
+		} else {
+			ins[rec.TxIn[i].Input] = nil
+		}
+	}
+	for i := range tx.TxIn {
+		if po, ok := ins[tx.TxIn[i].Input]; ok {
+			ds.Inputs = append(ds.Inputs, tx.TxIn[i].Input)
+			ds.PrevOuts = append(ds.PrevOuts, po)
+		}
+	}
+	select {
+		case NetDoubleSpends <- ds:
+			common.CountSafe("DoubleSpendSeen")
+		default:
+			common.CountSafe("DoubleSpendDropped")
+	}
+}
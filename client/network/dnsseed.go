@@ -0,0 +1,68 @@
+package network
+
+import (
+	"sync"
+	"time"
+	"github.com/piotrnar/gocoin/others/utils"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+const (
+	MinPeersForDNSSeed = 1000 // do not bother the DNS seeds if we know this many peers
+	DNSSeedRetry = 10*time.Minute // do not query the seeds more often than this
+)
+
+var (
+	DNSResolver utils.SeedResolver // nil for the system's default one
+	dnsseed_mutex sync.Mutex
+	dnsSeeding bool
+	lastDNSSeed time.Time
+)
+
+
+// Queries the DNS seeds in the background, if we do not know enough peers
+func DNSSeedIfNeeded() {
+	if proxyPeer!=nil {
+		return
+	}
+	if newcnt, triedcnt := AddrManStats(); newcnt+triedcnt >= MinPeersForDNSSeed {
+		return
+	}
+	dnsseed_mutex.Lock()
+	if dnsSeeding || !lastDNSSeed.IsZero() && time.Now().Sub(lastDNSSeed) < DNSSeedRetry {
+		dnsseed_mutex.Unlock()
+		return
+	}
+	dnsSeeding = true
+	dnsseed_mutex.Unlock()
+
+	go func() {
+		n := dnsSeed()
+		if common.DebugLevel>0 {
+			println(n, "peers added from DNS seeds")
+		}
+		dnsseed_mutex.Lock()
+		dnsSeeding = false
+		lastDNSSeed = time.Now()
+		dnsseed_mutex.Unlock()
+	}()
+}
+
+
+// Puts the addresses from the DNS seeds of our network into the address manager.
+// Returns how many of them have been added.
+func dnsSeed() (cnt int) {
+	common.CountSafe("DNSSeedQuery")
+	seeds, port := utils.DNSSeeds(common.CFG.Testnet)
+	for _, p := range utils.SeedPeers(DNSResolver, seeds, port) {
+		if !p.IsIPv4() {
+			common.CountSafe("DNSSeedIPv6")
+			continue // we only do IPv4
+		}
+		if addrAdd(&onePeer{OnePeer:p}, netGroup(p.Ip4[:])) {
+			cnt++
+		}
+	}
+	common.CountSafeAdd("DNSSeedPeers", uint64(cnt))
+	return
+}
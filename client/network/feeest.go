@@ -0,0 +1,170 @@
+package network
+
+import (
+	"sort"
+	"math"
+	"io/ioutil"
+	"encoding/json"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+const (
+	FeeEstFileName = "feeest.json"
+
+	FeeEstMaxTarget = 25 // we can tell how to get mined within up to this many blocks
+	FeeEstDecay = 0.998 // each new block makes older data points less important
+	FeeEstSuccess = 0.85 // how many txs from a bucket must have made it in time
+	FeeEstMinData = 4.0 // do not draw any conclusions from less data than this
+
+	feeEstMinSPKB = 1000
+	feeEstMaxSPKB = 1e7
+	feeEstSpacing = 1.1
+)
+
+// Fee rates (satoshis per 1000 bytes) of the txs seen entering the pool and how fast they got mined
+type feeBucket struct {
+	Confirmed [FeeEstMaxTarget]float64 // Confirmed[n] - mined within n+1 blocks
+	Total float64 // all the txs that left the pool (mined or not)
+}
+
+var (
+	FeeEst struct {
+		Limits []uint64 // lower fee rate limit of each bucket
+		Buckets []feeBucket
+		Height uint32 // last block we have seen
+	}
+)
+
+
+// Returns the bucket index for the given fee rate
+func feeEstBucket(spkb uint64) int {
+	i := sort.Search(len(FeeEst.Limits), func(i int) bool { return FeeEst.Limits[i] > spkb }) - 1
+	if i < 0 {
+		i = 0
+	}
+	return i
+}
+
+
+// Make sure to call it with locked TxMutex
+func feeEstNewHeight(height uint32) {
+	if height <= FeeEst.Height {
+		return
+	}
+	if FeeEst.Height != 0 {
+		d := math.Pow(FeeEstDecay, float64(height-FeeEst.Height))
+		for i := range FeeEst.Buckets {
+			for j := range FeeEst.Buckets[i].Confirmed {
+				FeeEst.Buckets[i].Confirmed[j] *= d
+			}
+			FeeEst.Buckets[i].Total *= d
+		}
+	}
+	FeeEst.Height = height
+}
+
+
+// Called when a tx that we have been tracking gets mined at the given height
+// Make sure to call it with locked TxMutex
+func feeEstMined(rec *OneTxToSend, height uint32) {
+	if rec.EntryHeight==0 || height <= rec.EntryHeight {
+		return
+	}
+	feeEstNewHeight(height)
+	b := &FeeEst.Buckets[feeEstBucket(rec.SPKB())]
+	for n := int(height-rec.EntryHeight)-1; n < FeeEstMaxTarget; n++ {
+		b.Confirmed[n]++
+	}
+	b.Total++
+}
+
+
+// Called when a tx that we have been tracking leaves the pool without being mined
+// Make sure to call it with locked TxMutex
+func feeEstDropped(rec *OneTxToSend) {
+	if rec.EntryHeight!=0 {
+		FeeEst.Buckets[feeEstBucket(rec.SPKB())].Total++
+	}
+}
+
+
+// Returns the lowest fee rate (satoshis per 1000 bytes) that should get a tx mined
+// within the given number of blocks. Returns zero if there is not enough data.
+func EstimateFee(blocks int) uint64 {
+	if blocks < 1 {
+		blocks = 1
+	} else if blocks > FeeEstMaxTarget {
+		blocks = FeeEstMaxTarget
+	}
+	TxMutex.Lock()
+	defer TxMutex.Unlock()
+
+	// Group the buckets from the highest fee down, until we have enough data in the group
+	var conf, tot float64
+	var res uint64
+	for i := len(FeeEst.Buckets)-1; i >= 0; i-- {
+		conf += FeeEst.Buckets[i].Confirmed[blocks-1]
+		tot += FeeEst.Buckets[i].Total
+		if tot >= FeeEstMinData {
+			if conf/tot < FeeEstSuccess {
+				break
+			}
+			res = FeeEst.Limits[i]
+			conf, tot = 0, 0
+		}
+	}
+	return res
+}
+
+
+// Stores the estimator's state in the given file
+func SaveFeeEstimates(fn string) {
+	TxMutex.Lock()
+	dat, _ := json.Marshal(&FeeEst)
+	TxMutex.Unlock()
+	if e := ioutil.WriteFile(fn, dat, 0660); e != nil {
+		println("SaveFeeEstimates:", e.Error())
+	}
+}
+
+
+// Restores the estimator's state saved by SaveFeeEstimates
+func LoadFeeEstimates(fn string) {
+	dat, e := ioutil.ReadFile(fn)
+	if e != nil {
+		return
+	}
+	TxMutex.Lock()
+	defer TxMutex.Unlock()
+	lims := FeeEst.Limits
+	if e = json.Unmarshal(dat, &FeeEst); e != nil || len(FeeEst.Limits)!=len(lims) || len(FeeEst.Buckets)!=len(lims) {
+		println("LoadFeeEstimates: bad file", fn)
+		feeEstReset()
+		return
+	}
+	for i := range lims {
+		if FeeEst.Limits[i]!=lims[i] {
+			println("LoadFeeEstimates: incompatible buckets in", fn)
+			feeEstReset()
+			return
+		}
+	}
+	if FeeEst.Height > common.BlockChain.BlockTreeEnd.Height {
+		FeeEst.Height = common.BlockChain.BlockTreeEnd.Height
+	}
+}
+
+
+func feeEstReset() {
+	FeeEst.Limits = nil
+	for f := float64(feeEstMinSPKB); f < feeEstMaxSPKB; f *= feeEstSpacing {
+		FeeEst.Limits = append(FeeEst.Limits, uint64(f))
+	}
+	FeeEst.Buckets = make([]feeBucket, len(FeeEst.Limits))
+	FeeEst.Height = 0
+}
+
+
+func init() {
+	feeEstReset()
+}
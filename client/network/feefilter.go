@@ -0,0 +1,92 @@
+package network
+
+import (
+	"sync/atomic"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/btc"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+const FeeFilterMinProtoVersion = 70013
+
+
+// Returns true if feefilter has been sent
+func (c *OneConnection) SendFeeFilter() bool {
+	if !common.CFG.TXPool.Enabled || c.Node.DoNotRelayTxs || c.Node.Version<FeeFilterMinProtoVersion {
+		return false
+	}
+	if c.Whitelisted {
+		return false // we do not want whitelisted peers to hold back any txs from us
+	}
+	TxMutex.Lock()
+	spkb := MinFeeSPKB()
+	TxMutex.Unlock()
+	if spkb==c.FeeFilterSent {
+		return false
+	}
+	if spkb!=1000*atomic.LoadUint64(&common.CFG.TXPool.FeePerByte) &&
+		spkb*4 > c.FeeFilterSent*3 && spkb*4 < c.FeeFilterSent*5 {
+		return false // the dynamic fee has not changed enough to bother the peer
+	}
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], spkb)
+	c.SendRawMsg("feefilter", b[:])
+	c.Mutex.Lock()
+	c.FeeFilterSent = spkb
+	c.Mutex.Unlock()
+	return true
+}
+
+
+func (c *OneConnection) HandleFeeFilter(pl []byte) {
+	if len(pl)!=8 {
+		c.DoS("BadFeeFilter")
+		return
+	}
+	spkb := binary.LittleEndian.Uint64(pl)
+	if spkb > btc.MAX_MONEY {
+		common.CountSafe("FeeFilterTooBig")
+		return
+	}
+	c.Mutex.Lock()
+	c.Node.FeeFilter = spkb
+	c.Mutex.Unlock()
+}
+
+
+// Handles BIP35 "mempool" message - queues invs of all the txs we would route.
+// They get trickled like any other tx invs, so our own txs can not be spotted in the answer.
+func (c *OneConnection) HandleMempool() {
+	if !common.CFG.TXPool.Enabled || !common.CFG.TXRoute.Enabled {
+		common.CountSafe("MempoolDisabled")
+		return
+	}
+	c.Mutex.Lock()
+	norelay := c.Node.DoNotRelayTxs
+	feefilter := c.Node.FeeFilter
+	c.Mutex.Unlock()
+	if norelay {
+		common.CountSafe("MempoolNoRelay")
+		return
+	}
+
+	TxMutex.Lock()
+	c.Mutex.Lock()
+	for _, v := range TransactionsToSend {
+		if v.Blocked!=0 || v.Own!=0 && v.Invsentcnt==0 {
+			continue // not routed, or own tx that has not been broadcast yet
+		}
+		if v.Own!=2 && v.SPKB()<feefilter { // own txs with unknown inputs have unknown fee
+			continue
+		}
+		inv := new([36]byte)
+		binary.LittleEndian.PutUint32(inv[0:4], 1)
+		copy(inv[4:36], v.Hash.Hash[:])
+		if !c.QueueInv(1, inv) {
+			break
+		}
+	}
+	c.Mutex.Unlock()
+	TxMutex.Unlock()
+	common.CountSafe("MempoolServed")
+}
@@ -0,0 +1,152 @@
+package network
+
+import (
+	"time"
+	"bytes"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/btc"
+	"github.com/piotrnar/gocoin/protocol"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+const (
+	SendHeadersMinProtoVersion = 70012
+	MaxBlocksToAnnounce = 8 // if more headers would be needed to announce a block, use inv
+	MaxHeadersBlocksAsk = 16 // how many blocks we ask for, after an unsolicited "headers"
+)
+
+
+func (c *OneConnection) SendHeaders() {
+	if c.Node.Version>=SendHeadersMinProtoVersion {
+		c.SendRawMsg("sendheaders", nil)
+	}
+}
+
+
+func (c *OneConnection) HandleSendHeaders() {
+	c.Mutex.Lock()
+	c.Node.SendHeaders = true
+	c.Mutex.Unlock()
+}
+
+
+// Returns "headers" payload announcing the block to a peer that asked for "sendheaders".
+// Returns nil if an inv should be used instead, or with known set, if the peer
+// already has the header (so there is nothing to announce).
+// Call it only when c.Mutex is locked.
+func (c *OneConnection) headersToAnnounce(n *btc.BlockTreeNode) (pl []byte, known bool) {
+	if !c.Node.SendHeaders || n==nil {
+		return
+	}
+	var hdrs [][]byte
+	if c.LastHeaderSent==nil {
+		hdrs = append(hdrs, n.BlockHeader[:])
+	} else {
+		// in case of a reorg, announce all the blocks since the fork
+		fork := c.LastHeaderSent.FirstCommonParent(n)
+		for x:=n; x!=fork; x=x.Parent {
+			if len(hdrs)==MaxBlocksToAnnounce {
+				common.CountSafe("SendHdrsTooMany")
+				return
+			}
+			hdrs = append([][]byte{x.BlockHeader[:]}, hdrs...)
+		}
+		if len(hdrs)==0 {
+			known = true
+			return
+		}
+	}
+	c.LastHeaderSent = n
+	pl = protocol.HeadersBytes(hdrs)
+	return
+}
+
+
+// Announces a new block to all the peers (except the one it came from).
+// Peers that asked for the high-bandwidth compact blocks get "cmpctblock",
+// peers that asked for "sendheaders" get "headers" and the others an inv.
+func NetRouteBlock(bl *btc.Block, fromConn *OneConnection) {
+	common.CountSafe("NetRouteBlock")
+
+	common.BlockChain.BlockIndexAccess.Lock()
+	node := common.BlockChain.BlockIndex[bl.Hash.BIdx()]
+	common.BlockChain.BlockIndexAccess.Unlock()
+
+	inv := new([36]byte)
+	binary.LittleEndian.PutUint32(inv[0:4], 2)
+	copy(inv[4:36], bl.Hash.Hash[:])
+
+	var hb, hd []*OneConnection
+	var hdrs [][]byte
+	Mutex_net.Lock()
+	for _, v := range OpenCons {
+		if v != fromConn {
+			v.Mutex.Lock()
+			if v.Node.SendCmpctVer==CmpctVersion && v.Node.HighBandwidth {
+				hb = append(hb, v)
+			} else if h, known := v.headersToAnnounce(node); known {
+				common.CountSafe("SendHdrsKnown")
+			} else if h!=nil {
+				hd = append(hd, v)
+				hdrs = append(hdrs, h)
+			} else {
+				v.addPendingInv(2, inv, fromConn)
+			}
+			v.Mutex.Unlock()
+		}
+	}
+	Mutex_net.Unlock()
+
+	if len(hb)>0 {
+		msg, e := cmpctBlockMsg(bl.Raw)
+		if e != nil {
+			println("NetRouteBlock:", e.Error())
+		} else {
+			for i := range hb {
+				hb[i].SendRawMsg("cmpctblock", msg)
+			}
+		}
+	}
+	for i := range hd {
+		hd[i].SendRawMsg("headers", hdrs[i])
+	}
+}
+
+
+// Handles "headers" message - peers that we sent "sendheaders" to, announce new blocks this way
+func (c *OneConnection) HandleHeaders(pl []byte) {
+	hdrs, e := protocol.ParseHeaders(pl)
+	if e != nil {
+		c.DoS("BadHeaders")
+		return
+	}
+
+	var ask []byte
+	var prev []byte
+	for _, hdr := range hdrs {
+		bh := btc.NewSha2Hash(hdr)
+
+		common.BlockChain.BlockIndexAccess.Lock()
+		_, known := common.BlockChain.BlockIndex[bh.BIdx()]
+		_, parent := common.BlockChain.BlockIndex[btc.NewUint256(hdr[4:36]).BIdx()]
+		common.BlockChain.BlockIndexAccess.Unlock()
+
+		if !parent && (prev==nil || !bytes.Equal(prev, hdr[4:36])) {
+			// It does not connect to our chain - let getblocks sort it out
+			common.CountSafe("HeadersUnconnected")
+			c.Mutex.Lock()
+			c.NextBlocksAsk = time.Now()
+			c.Mutex.Unlock()
+			break
+		}
+		prev = bh.Hash[:]
+
+		if !known && len(ask)<32*MaxHeadersBlocksAsk && blockWanted(bh.Hash[:]) {
+			ask = append(ask, bh.Hash[:]...)
+		}
+	}
+
+	if len(ask)>0 {
+		c.requestBlocks(ask)
+	}
+}
@@ -6,60 +6,76 @@ import (
 	"bytes"
 	"encoding/binary"
 	"github.com/piotrnar/gocoin/btc"
+	"github.com/piotrnar/gocoin/protocol"
 	"github.com/piotrnar/gocoin/client/common"
 )
 
 
 
 func (c *OneConnection) ProcessInv(pl []byte) {
-	if len(pl) < 37 {
-		println(c.PeerAddr.Ip(), "inv payload too short", len(pl))
+	invs, e := protocol.ParseInv(pl)
+	if e != nil || len(invs)==0 {
+		println(c.PeerAddr.Ip(), "inv payload broken", len(pl))
 		return
 	}
 	c.InvsRecieved++
 
-	cnt, of := btc.VLen(pl)
-	if len(pl) != of + 36*cnt {
-		println("inv payload length mismatch", len(pl), of, cnt)
-	}
-
 	var blinv2ask []byte
 
-	for i:=0; i<cnt; i++ {
-		typ := binary.LittleEndian.Uint32(pl[of:of+4])
-		common.CountSafe(fmt.Sprint("InvGot",typ))
-		if typ==2 {
-			if blockWanted(pl[of+4:of+36]) {
-				blinv2ask = append(blinv2ask, pl[of+4:of+36]...)
+	for _, inv := range invs {
+		common.CountSafe(fmt.Sprint("InvGot",inv.Type))
+		if inv.Type==protocol.MSG_BLOCK {
+			if blockWanted(inv.Hash.Hash[:]) {
+				blinv2ask = append(blinv2ask, inv.Hash.Hash[:]...)
 			}
-		} else if typ==1 {
+		} else if inv.Type==protocol.MSG_TX {
 			if common.CFG.TXPool.Enabled {
-				c.TxInvNotify(pl[of+4:of+36])
+				c.TxInvNotify(inv.Hash.Hash[:])
 			}
 		}
-		of+= 36
 	}
 
 	if len(blinv2ask)>0 {
-		bu := new(bytes.Buffer)
-		btc.WriteVlen(bu, uint32(len(blinv2ask)/32))
-		for i:=0; i<len(blinv2ask); i+=32 {
-			bh := btc.NewUint256(blinv2ask[i:i+32])
-			c.Mutex.Lock()
-			c.GetBlockInProgress[bh.BIdx()] = &oneBlockDl{hash:bh, start:time.Now()}
-			c.Mutex.Unlock()
-			binary.Write(bu, binary.LittleEndian, uint32(2))
-			bu.Write(bh.Hash[:])
-		}
-		c.SendRawMsg("getdata", bu.Bytes())
+		c.requestBlocks(blinv2ask)
 	}
 
 	return
 }
 
 
-// This function is called from the main thread (or from an UI)
+// Sends getdata for the given (concatenated) block hashes
+func (c *OneConnection) requestBlocks(hashes []byte) {
+	typ := uint32(protocol.MSG_BLOCK)
+	if c.Node.SendCmpctVer==CmpctVersion && common.CFG.TXPool.Enabled {
+		typ = protocol.MSG_CMPCT_BLOCK
+	}
+	invs := make([]*protocol.Inv, len(hashes)/32)
+	for i := range invs {
+		bh := btc.NewUint256(hashes[32*i:32*i+32])
+		c.Mutex.Lock()
+		c.GetBlockInProgress[bh.BIdx()] = &oneBlockDl{hash:bh, start:time.Now()}
+		c.Mutex.Unlock()
+		invs[i] = protocol.NewInv(typ, bh)
+	}
+	c.SendRawMsg("getdata", protocol.InvBytes(invs))
+}
+
+
+// This function is called from the main thread (or from an UI).
+// Peers' feefilter is not checked - use it for blocks and for txs of unknown fee.
 func NetRouteInv(typ uint32, h *btc.Uint256, fromConn *OneConnection) (cnt uint) {
+	return netRouteInv(typ, h, fromConn, false, 0)
+}
+
+
+// Same as NetRouteInv, but for a tx of the given fee rate (in satoshis per 1000 bytes),
+// that does not go to peers whose feefilter is above it (also when the fee is zero).
+func NetRouteInvExt(typ uint32, h *btc.Uint256, fromConn *OneConnection, fee_spkb uint64) (cnt uint) {
+	return netRouteInv(typ, h, fromConn, true, fee_spkb)
+}
+
+
+func netRouteInv(typ uint32, h *btc.Uint256, fromConn *OneConnection, feefilter bool, fee_spkb uint64) (cnt uint) {
 	common.CountSafe(fmt.Sprint("NetRouteInv", typ))
 
 	// Prepare the inv
@@ -72,19 +88,10 @@ func NetRouteInv(typ uint32, h *btc.Uint256, fromConn *OneConnection) (cnt uint)
 	for _, v := range OpenCons {
 		if v != fromConn { // except the one that this inv came from
 			v.Mutex.Lock()
-			if v.Node.DoNotRelayTxs && typ==1 {
-				// This node does not want tx inv (it came with its version message)
-				common.CountSafe("SendInvNoTxNode")
-			} else {
-				if fromConn==nil && v.InvsRecieved==0 {
-					// Do not broadcast own txs to nodes that never sent any invs to us
-					common.CountSafe("SendInvOwnBlocked")
-				} else if len(v.PendingInvs)<500 {
-					v.PendingInvs = append(v.PendingInvs, inv)
-					cnt++
-				} else {
-					common.CountSafe("SendInvIgnored")
-				}
+			if typ==1 && feefilter && fee_spkb<v.Node.FeeFilter {
+				common.CountSafe("SendInvFeeFilter")
+			} else if v.addPendingInv(typ, inv, fromConn) {
+				cnt++
 			}
 			v.Mutex.Unlock()
 		}
@@ -94,6 +101,21 @@ func NetRouteInv(typ uint32, h *btc.Uint256, fromConn *OneConnection) (cnt uint)
 }
 
 
+// Call this function only when v.Mutex is locked
+func (v *OneConnection) addPendingInv(typ uint32, inv *[36]byte, fromConn *OneConnection) bool {
+	if v.Node.DoNotRelayTxs && typ==1 {
+		// This node does not want tx inv (it came with its version message)
+		common.CountSafe("SendInvNoTxNode")
+	} else if typ!=1 && len(v.PendingInvs)>=500 {
+		common.CountSafe("SendInvIgnored")
+	} else {
+		// own txs are queued like any other, so they can not be told apart
+		return v.QueueInv(typ, inv)
+	}
+	return false
+}
+
+
 // Call this function only when BlockIndexAccess is locked
 func addInvBlockBranch(inv map[[32]byte] bool, bl *btc.BlockTreeNode, stop *btc.Uint256) {
 	if len(inv)>=500 || bl.BlockHash.Equal(stop) {
@@ -110,13 +132,13 @@ func addInvBlockBranch(inv map[[32]byte] bool, bl *btc.BlockTreeNode, stop *btc.
 
 
 func (c *OneConnection) GetBlocks(pl []byte) {
-	h2get, hashstop, e := parseLocatorsPayload(pl)
-
-	if e!=nil || len(h2get)<1 || hashstop==nil {
+	loc, e := protocol.ParseLocator(pl)
+	if e!=nil || len(loc.Hashes)<1 {
 		println("GetBlocks: error parsing payload from", c.PeerAddr.Ip())
 		c.DoS("BadGetBlks")
 		return
 	}
+	h2get, hashstop := loc.Hashes, loc.Stop
 
 	invs := make(map[[32]byte] bool, 500)
 	for i := range h2get {
@@ -137,13 +159,11 @@ func (c *OneConnection) GetBlocks(pl []byte) {
 					if len(invs)>0 {
 						common.BlockChain.BlockIndexAccess.Unlock()
 
-						inv := new(bytes.Buffer)
-						btc.WriteVlen(inv, uint32(len(invs)))
+						inv := make([]*protocol.Inv, 0, len(invs))
 						for k, _ := range invs {
-							binary.Write(inv, binary.LittleEndian, uint32(2))
-							inv.Write(k[:])
+							inv = append(inv, protocol.NewInv(protocol.MSG_BLOCK, btc.NewUint256(k[:])))
 						}
-						c.SendRawMsg("inv", inv.Bytes())
+						c.SendRawMsg("inv", protocol.InvBytes(inv))
 						return
 					}
 				}
@@ -160,10 +180,11 @@ func (c *OneConnection) GetBlocks(pl []byte) {
 func (c *OneConnection) SendInvs() (res bool) {
 	b := new(bytes.Buffer)
 	c.Mutex.Lock()
-	if len(c.PendingInvs)>0 {
-		btc.WriteVlen(b, uint32(len(c.PendingInvs)))
-		for i := range c.PendingInvs {
-			b.Write((*c.PendingInvs[i])[:])
+	invs := append(c.PendingInvs, c.trickleTxInvs()...)
+	if len(invs)>0 {
+		btc.WriteVlen(b, uint32(len(invs)))
+		for i := range invs {
+			b.Write((*invs[i])[:])
 		}
 		res = true
 	}
@@ -192,10 +213,7 @@ func (c *OneConnection) getblocksNeeded() bool {
 			GetBlocksAskBack = btc.MovingCheckopintDepth
 		}
 
-		b := make([]byte, 37)
-		binary.LittleEndian.PutUint32(b[0:4], common.Version)
-		b[4] = 1 // one locator so far...
-		copy(b[5:37], lb.BlockHash.Hash[:])
+		loc := &protocol.Locator{Version:common.Version, Hashes:[]*btc.Uint256{lb.BlockHash}}
 
 		if GetBlocksAskBack > 0 {
 			common.BlockChain.BlockIndexAccess.Lock()
@@ -204,20 +222,16 @@ func (c *OneConnection) getblocksNeeded() bool {
 				lb = lb.Parent
 				cnt_each++
 				if cnt_each==200 {
-					b[4]++
-					b = append(b, lb.BlockHash.Hash[:]...)
+					loc.Hashes = append(loc.Hashes, lb.BlockHash)
 					cnt_each = 0
 				}
 			}
 			if cnt_each!=0 {
-				b[4]++
-				b = append(b, lb.BlockHash.Hash[:]...)
+				loc.Hashes = append(loc.Hashes, lb.BlockHash)
 			}
 			common.BlockChain.BlockIndexAccess.Unlock()
 		}
-		var null_stop [32]byte
-		b = append(b, null_stop[:]...)
-		c.SendRawMsg("getblocks", b)
+		c.SendRawMsg("getblocks", loc.Bytes())
 		c.Mutex.Lock()
 		c.NextBlocksAsk = time.Now().Add(NewBlocksAskDuration)
 		c.Mutex.Unlock()
@@ -0,0 +1,444 @@
+package network
+
+import (
+	"math"
+	"sort"
+	"time"
+	"sync/atomic"
+	"container/heap"
+	"github.com/piotrnar/gocoin/btc"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+const (
+	MinFeeHalfLife = 12*time.Hour // how quickly the dynamic min fee goes back down
+
+	// Limits for chains of unconfirmed txs in the pool (the numbers include the tx itself)
+	MaxAncestorCnt = 25
+	MaxAncestorSize = 101000
+	MaxDescendantCnt = 25
+	MaxDescendantSize = 101000
+)
+
+var (
+	// Total size of all the transactions in TransactionsToSend
+	TransactionsToSendSize uint64
+
+	// Non-own txs from TransactionsToSend, with the lowest fee rate on top:
+	txsByFee txFeeHeap
+
+	// Dynamic minimum fee (satoshis per 1000 bytes), raised each time we evict something
+	minFeeSPKB uint64
+	minFeeSetAt time.Time
+
+	// Eviction stats (for the WebUI)
+	EvictedTxs, EvictedBytes uint64
+	LastEvictedSPKB uint64
+	LastEviction time.Time
+)
+
+
+// Txs with the lowest package fee rate go on top of the heap
+type txFeeHeap []*OneTxToSend
+
+func (h txFeeHeap) Len() int {
+	return len(h)
+}
+
+func (h txFeeHeap) Less(i, j int) bool {
+	return h[i].evictSPKB() < h[j].evictSPKB()
+}
+
+func (h txFeeHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].feeIdx = i
+	h[j].feeIdx = j
+}
+
+func (h *txFeeHeap) Push(x interface{}) {
+	t := x.(*OneTxToSend)
+	t.feeIdx = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *txFeeHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	t.feeIdx = -1
+	return t
+}
+
+
+// Returns fee rate (satoshis per 1000 bytes) of the tx together with all its in-pool ancestors
+func (t *OneTxToSend) AncSPKB() uint64 {
+	return 1000*t.AncFee/t.AncSize
+}
+
+
+// Returns fee rate (satoshis per 1000 bytes) of the tx together with all its in-pool descendants
+func (t *OneTxToSend) DescSPKB() uint64 {
+	return 1000*t.DescFee/t.DescSize
+}
+
+
+// A child paying a high fee protects its parent from being evicted
+func (t *OneTxToSend) evictSPKB() uint64 {
+	if own, desc := t.SPKB(), t.DescSPKB(); desc > own {
+		return desc
+	}
+	return t.SPKB()
+}
+
+
+// Returns all the in-pool ancestors of the tx (not including itself)
+func (t *OneTxToSend) Ancestors() (res map[[btc.Uint256IdxLen]byte] *OneTxToSend) {
+	res = make(map[[btc.Uint256IdxLen]byte] *OneTxToSend)
+	var walk func(*OneTxToSend)
+	walk = func(x *OneTxToSend) {
+		for k, p := range x.Parents {
+			if _, done := res[k]; !done {
+				res[k] = p
+				walk(p)
+			}
+		}
+	}
+	walk(t)
+	return
+}
+
+
+// Returns all the in-pool descendants of the tx (not including itself)
+func (t *OneTxToSend) Descendants() (res map[[btc.Uint256IdxLen]byte] *OneTxToSend) {
+	res = make(map[[btc.Uint256IdxLen]byte] *OneTxToSend)
+	var walk func(*OneTxToSend)
+	walk = func(x *OneTxToSend) {
+		for k, c := range x.Children {
+			if _, done := res[k]; !done {
+				res[k] = c
+				walk(c)
+			}
+		}
+	}
+	walk(t)
+	return
+}
+
+
+// Returns the txs from the pool whose outputs the given tx spends
+// Make sure to call it with locked TxMutex
+func poolParents(tx *btc.Tx) (res map[[btc.Uint256IdxLen]byte] *OneTxToSend) {
+	res = make(map[[btc.Uint256IdxLen]byte] *OneTxToSend)
+	for i := range tx.TxIn {
+		h := btc.NewUint256(tx.TxIn[i].Input.Hash[:])
+		if p, ok := TransactionsToSend[h.BIdx()]; ok {
+			res[h.BIdx()] = p
+		}
+	}
+	return
+}
+
+
+// Checks if a new tx of the given size with the given parents would not exceed
+// the ancestor/descendant limits. Returns false if the chain would be too long.
+// Make sure to call it with locked TxMutex
+func chainLimitsOK(parents map[[btc.Uint256IdxLen]byte] *OneTxToSend, size int) bool {
+	ancs := make(map[[btc.Uint256IdxLen]byte] *OneTxToSend)
+	for k, p := range parents {
+		ancs[k] = p
+		for ka, a := range p.Ancestors() {
+			ancs[ka] = a
+		}
+	}
+	anccnt, ancsize := 1, uint64(size)
+	for _, a := range ancs {
+		if a.DescCnt+1 > MaxDescendantCnt || a.DescSize+uint64(size) > MaxDescendantSize {
+			return false
+		}
+		anccnt++
+		ancsize += uint64(len(a.Data))
+	}
+	return anccnt <= MaxAncestorCnt && ancsize <= MaxAncestorSize
+}
+
+
+// Sorts txs so parents always go before their children
+func sortByAncestors(txs []*OneTxToSend) {
+	sort.Sort(byAncCnt(txs))
+}
+
+type byAncCnt []*OneTxToSend
+func (b byAncCnt) Len() int { return len(b) }
+func (b byAncCnt) Less(i, j int) bool { return b[i].AncCnt < b[j].AncCnt }
+func (b byAncCnt) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+
+
+// Adds a new tx to the memory pool, linking it with its in-pool parents.
+// Own txs never get evicted.
+// Make sure to call it with locked TxMutex
+func AddToSend(rec *OneTxToSend) {
+	bidx := rec.Tx.Hash.BIdx()
+	size := uint64(len(rec.Data))
+	TransactionsToSend[bidx] = rec
+	TransactionsToSendSize += size
+
+	rec.Parents = poolParents(rec.Tx)
+	rec.Children = make(map[[btc.Uint256IdxLen]byte] *OneTxToSend)
+	rec.AncCnt, rec.AncSize, rec.AncFee = 1, size, rec.Fee
+	rec.DescCnt, rec.DescSize, rec.DescFee = 1, size, rec.Fee
+	for _, p := range rec.Parents {
+		p.Children[bidx] = rec
+	}
+	for _, a := range rec.Ancestors() {
+		rec.AncCnt++
+		rec.AncSize += uint64(len(a.Data))
+		rec.AncFee += a.Fee
+		a.DescCnt++
+		a.DescSize += size
+		a.DescFee += rec.Fee
+		if a.feeIdx>=0 {
+			heap.Fix(&txsByFee, a.feeIdx)
+		}
+	}
+
+	if rec.PrevOuts==nil {
+		rec.PrevOuts = txPrevOuts(rec.Tx)
+	}
+
+	rec.feeIdx = -1
+	if rec.Own==0 {
+		heap.Push(&txsByFee, rec)
+	} else if rec.Spent==nil {
+		// Own txs do not come through HandleNetTx, so index their inputs here.
+		// The caller should have removed the conflicting txs - never take over their inputs.
+		for i := range rec.TxIn {
+			idx := rec.TxIn[i].Input.UIdx()
+			if k, ok := SpentOutputs[idx]; ok && k!=bidx {
+				common.CountSafe("TxOwnInputConflict")
+				continue
+			}
+			rec.Spent = append(rec.Spent, idx)
+			SpentOutputs[idx] = bidx
+		}
+	}
+}
+
+
+// Returns the outputs spent by the tx (nil for the unknown ones)
+// Make sure to call it with locked TxMutex
+func txPrevOuts(tx *btc.Tx) (res []*btc.TxOut) {
+	res = make([]*btc.TxOut, len(tx.TxIn))
+	for i := range tx.TxIn {
+		inp := &tx.TxIn[i].Input
+		if p, ok := TransactionsToSend[btc.NewUint256(inp.Hash[:]).BIdx()]; ok {
+			if int(inp.Vout) < len(p.TxOut) {
+				res[i] = p.TxOut[inp.Vout]
+			}
+		} else {
+			res[i], _ = common.BlockChain.Unspent.UnspentGet(inp)
+		}
+	}
+	return
+}
+
+
+// Takes the tx out of the pool, leaving its descendants in.
+// Make sure to call it with locked TxMutex
+func removeToSend(rec *OneTxToSend) {
+	bidx := rec.Tx.Hash.BIdx()
+	if _, ok := TransactionsToSend[bidx]; !ok {
+		return
+	}
+	for i := range rec.Spent {
+		delete(SpentOutputs, rec.Spent[i])
+	}
+	TransactionsToSendSize -= uint64(len(rec.Data))
+	delete(TransactionsToSend, bidx)
+	if rec.feeIdx>=0 && rec.feeIdx<len(txsByFee) && txsByFee[rec.feeIdx]==rec {
+		heap.Remove(&txsByFee, rec.feeIdx)
+	}
+
+	size := uint64(len(rec.Data))
+	for _, a := range rec.Ancestors() {
+		a.DescCnt--
+		a.DescSize -= size
+		a.DescFee -= rec.Fee
+		if a.feeIdx>=0 {
+			heap.Fix(&txsByFee, a.feeIdx)
+		}
+	}
+	for _, d := range rec.Descendants() {
+		d.AncCnt--
+		d.AncSize -= size
+		d.AncFee -= rec.Fee
+	}
+	for _, p := range rec.Parents {
+		delete(p.Children, bidx)
+	}
+	for _, c := range rec.Children {
+		delete(c.Parents, bidx)
+	}
+}
+
+
+// Removes the tx along with all the txs from the pool that depend on it.
+// Returns the number of txs removed and their total size.
+// Make sure to call it with locked TxMutex
+func DeleteToSend(rec *OneTxToSend) (cnt, size uint64) {
+	if _, ok := TransactionsToSend[rec.Tx.Hash.BIdx()]; !ok {
+		return
+	}
+	for _, c := range rec.Children {
+		n, s := DeleteToSend(c)
+		cnt += n
+		size += s
+	}
+	feeEstDropped(rec)
+	removeToSend(rec)
+	cnt++
+	size += uint64(len(rec.Data))
+	return
+}
+
+
+// Returns the current minimum fee rate (satoshis per 1000 bytes) for the memory pool
+// Make sure to call it with locked TxMutex
+func MinFeeSPKB() uint64 {
+	res := 1000*atomic.LoadUint64(&common.CFG.TXPool.FeePerByte)
+	if minFeeSPKB==0 {
+		return res
+	}
+	halfs := float64(time.Now().Sub(minFeeSetAt)) / float64(MinFeeHalfLife)
+	dyn := uint64(float64(minFeeSPKB) * math.Pow(0.5, halfs))
+	if dyn < res/2 {
+		minFeeSPKB = 0 // it's not worth keeping it anymore
+		return res
+	}
+	if dyn > res {
+		res = dyn
+	}
+	return res
+}
+
+
+// Routes the tx, if it is routable and all its in-pool parents have been routed.
+// Low fee parents that have been held back get routed first, if the tx pays for them.
+// Make sure to call it with locked TxMutex
+func routeToSend(rec *OneTxToSend, from *OneConnection) bool {
+	var ancs []*OneTxToSend
+	for _, a := range rec.Ancestors() {
+		if a.Blocked==TX_REJECTED_LOW_FEE || a.Blocked==TX_REJECTED_NOT_MINED {
+			ancs = append(ancs, a)
+		}
+	}
+	sortByAncestors(ancs)
+	for _, a := range ancs {
+		if parentsRouted(a) && isRoutable(a) {
+			a.Blocked = 0
+			a.Invsentcnt += NetRouteInvExt(1, a.Tx.Hash, nil, a.DescSPKB())
+			common.CountSafe("TxRouteCPFP")
+		}
+	}
+
+	if !parentsRouted(rec) {
+		// Gocoin does not route txs whose unconfirmed inputs have not been routed
+		rec.Blocked = TX_REJECTED_NOT_MINED
+		common.CountSafe("TxRouteNotMined")
+		return false
+	}
+	if !isRoutable(rec) {
+		return false
+	}
+	rec.Blocked = 0
+	rec.Invsentcnt += NetRouteInvExt(1, rec.Tx.Hash, from, rec.SPKB())
+	common.CountSafe("TxRouteOK")
+	return true
+}
+
+
+func parentsRouted(rec *OneTxToSend) bool {
+	for _, p := range rec.Parents {
+		if p.Blocked!=0 {
+			return false
+		}
+	}
+	return true
+}
+
+
+// Returns the txs that should go into a new block (up to maxsize bytes), ordered
+// by their ancestor package fee rate, so children can pay for their parents.
+func GetMiningTxs(maxsize uint64) (res []*OneTxToSend, totfee uint64) {
+	TxMutex.Lock()
+	defer TxMutex.Unlock()
+
+	all := make([]*OneTxToSend, 0, len(TransactionsToSend))
+	for _, v := range TransactionsToSend {
+		if v.Own!=2 {
+			all = append(all, v)
+		}
+	}
+	sort.Sort(byAncSPKB(all))
+
+	var size uint64
+	done := make(map[[btc.Uint256IdxLen]byte] bool)
+	for _, v := range all {
+		if done[v.Tx.Hash.BIdx()] {
+			continue
+		}
+		pkg := []*OneTxToSend{v}
+		pkgsize := uint64(len(v.Data))
+		for k, a := range v.Ancestors() {
+			if !done[k] {
+				pkg = append(pkg, a)
+				pkgsize += uint64(len(a.Data))
+			}
+		}
+		if size+pkgsize > maxsize {
+			continue
+		}
+		sortByAncestors(pkg)
+		for _, t := range pkg {
+			done[t.Tx.Hash.BIdx()] = true
+			res = append(res, t)
+			totfee += t.Fee
+		}
+		size += pkgsize
+	}
+	return
+}
+
+type byAncSPKB []*OneTxToSend
+func (b byAncSPKB) Len() int { return len(b) }
+func (b byAncSPKB) Less(i, j int) bool { return b[i].AncSPKB() > b[j].AncSPKB() }
+func (b byAncSPKB) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+
+
+// Evicts the lowest fee rate txs (with descendants) until the pool fits in its size limit.
+// Returns false if the pool is still too big (i.e. it is full of own txs).
+// Make sure to call it with locked TxMutex
+func limitPoolSize() bool {
+	if common.MaxMempoolSize==0 {
+		return true
+	}
+	for TransactionsToSendSize > common.MaxMempoolSize {
+		if len(txsByFee)==0 {
+			return false
+		}
+		rec := txsByFee[0]
+		LastEvictedSPKB = rec.evictSPKB()
+		cnt, size := DeleteToSend(rec)
+		EvictedTxs += cnt
+		EvictedBytes += size
+		LastEviction = time.Now()
+		common.CountSafeAdd("TxPoolEvicted", cnt)
+
+		// Only accept txs paying more than what we have just dropped
+		if newmin := LastEvictedSPKB + 1000*atomic.LoadUint64(&common.CFG.TXPool.FeePerByte); newmin > MinFeeSPKB() {
+			minFeeSPKB = newmin
+			minFeeSetAt = LastEviction
+		}
+	}
+	return true
+}
@@ -0,0 +1,746 @@
+package network
+
+import (
+	"time"
+	"bytes"
+	"testing"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/btc"
+	"github.com/piotrnar/gocoin/qdb"
+	"github.com/piotrnar/gocoin/protocol"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+
+func TestHandshake(t *testing.T) {
+	p := connectTestPeer(t, 1)
+	defer p.Close()
+
+	p.conn.Mutex.Lock()
+	agent, ver := p.conn.Node.Agent, p.conn.Node.Version
+	p.conn.Mutex.Unlock()
+	if agent!="/test/" || ver!=70014 {
+		t.Error("Bad version info:", agent, ver)
+	}
+	p.sync()
+}
+
+
+func TestBlockRelay(t *testing.T) {
+	a := connectTestPeer(t, 2)
+	defer a.Close()
+	b := connectTestPeer(t, 3)
+	defer b.Close()
+	c := connectTestPeer(t, 4)
+	defer c.Close()
+	c.send("sendheaders", nil)
+	c.sync()
+
+	bl := topTestBlock(t)
+	a.send("block", bl.Raw)
+
+	b.expectInv("inv", 2, bl.Hash)
+	hdr := c.expectCmd("headers")
+	if len(hdr)!=1+81 || !bytes.Equal(hdr[1:81], bl.Raw[:80]) {
+		t.Error("Bad headers announcing the block")
+	}
+	if !chainTop().BlockHash.Equal(bl.Hash) {
+		t.Error("The block has not been accepted")
+	}
+}
+
+
+func TestTxRelay(t *testing.T) {
+	coin := newTestCoin(t)
+	a := connectTestPeer(t, 5)
+	defer a.Close()
+	b := connectTestPeer(t, 6)
+	defer b.Close()
+
+	tx := spendTestTx(t, coin, 0, 10000)
+	raw := tx.Serialize()
+	a.send("inv", invPayload(1, tx.Hash))
+	a.expectInv("getdata", 1, tx.Hash)
+	a.send("tx", raw)
+
+	b.expectInv("inv", 1, tx.Hash)
+	b.send("getdata", invPayload(1, tx.Hash))
+	if !bytes.Equal(b.expectCmd("tx"), raw) {
+		t.Error("Got a different tx")
+	}
+	if !inMempool(tx.Hash) {
+		t.Error("The tx is not in the memory pool")
+	}
+}
+
+
+func TestOrphanTx(t *testing.T) {
+	coin := newTestCoin(t)
+	p := connectTestPeer(t, 7)
+	defer p.Close()
+
+	parent := spendTestTx(t, coin, 0, 10000)
+	child := spendTestTx(t, parent, 0, 10000)
+	p.send("tx", child.Serialize())
+	if !waitUntil(func() bool {
+		TxMutex.Lock()
+		rec := TransactionsRejected[child.Hash.BIdx()]
+		TxMutex.Unlock()
+		return rec!=nil && rec.Reason==TX_REJECTED_NO_TXOU
+	}) {
+		t.Fatal("The child tx has not been put aside")
+	}
+
+	p.send("tx", parent.Serialize())
+	if !waitUntil(func() bool {
+		return inMempool(parent.Hash) && inMempool(child.Hash)
+	}) {
+		t.Error("The orphan has not been accepted after its parent")
+	}
+}
+
+
+func TestReorg(t *testing.T) {
+	coin := newTestCoin(t)
+	fork := chainTop()
+	tx := spendTestTx(t, coin, 0, 10000)
+	mineTestBlock(t, newTestBlock(t, fork.BlockHash, fork.Height+1, tx))
+	if inMempool(tx.Hash) {
+		t.Fatal("Mined tx in the memory pool")
+	}
+
+	p := connectTestPeer(t, 8)
+	defer p.Close()
+	y1 := newTestBlock(t, fork.BlockHash, fork.Height+1)
+	y2 := newTestBlock(t, y1.Hash, fork.Height+2)
+	p.send("block", y1.Raw)
+	p.send("block", y2.Raw)
+
+	if !waitUntil(func() bool {
+		return chainTop().BlockHash.Equal(y2.Hash)
+	}) {
+		t.Fatal("The node has not switched to the longer branch")
+	}
+	if !waitUntil(func() bool {
+		return inMempool(tx.Hash)
+	}) {
+		t.Error("The tx from the orphaned block has not returned to the memory pool")
+	}
+}
+
+
+// Returns a tx that cannot be parsed (a new one each time)
+func brokenTx() []byte {
+	b := []byte{1,0,0,0,5,0,0,0,0,0,0,0,0}
+	binary.LittleEndian.PutUint64(b[5:], uint64(time.Now().UnixNano()))
+	return b
+}
+
+
+func TestBan(t *testing.T) {
+	p := connectTestPeer(t, 9)
+	defer p.Close()
+	defer RemoveBan([4]byte{11,0,0,9}, 32)
+
+	// each broken tx scores 50, so the second one should get the peer banned
+	p.send("tx", brokenTx())
+	p.send("tx", brokenTx())
+	if !p.waitDisconnect() {
+		t.Fatal("Misbehaving peer not disconnected")
+	}
+	if !waitUntil(func() bool {
+		return IsBanned([]byte{11,0,0,9})
+	}) {
+		t.Error("Misbehaving peer not banned")
+	}
+	if _, e := NewIncomingPeer("11.0.0.9:8333"); e == nil {
+		t.Error("Banned peer allowed to reconnect")
+	}
+}
+
+
+func TestBanWhitelisted(t *testing.T) {
+	common.CFG.Net.Whitelist = "11.0.0.10"
+	common.Reset()
+	defer func() {
+		common.CFG.Net.Whitelist = ""
+		common.Reset()
+	}()
+
+	p := connectTestPeer(t, 10)
+	defer p.Close()
+	p.send("tx", brokenTx())
+	p.send("tx", brokenTx())
+	p.sync()
+
+	p.conn.Mutex.Lock()
+	score := p.conn.BanScore
+	p.conn.Mutex.Unlock()
+	if score < 100 {
+		t.Error("Ban score not increased:", score)
+	}
+	if IsBanned([]byte{11,0,0,10}) {
+		t.Error("Whitelisted peer banned")
+	}
+}
+
+
+func TestReject(t *testing.T) {
+	coin := newTestCoin(t)
+	p := connectTestPeer(t, 11)
+	defer p.Close()
+
+	// a tx without any fee should get us "reject" with REJECT_INSUFFICIENTFEE
+	tx := spendTestTx(t, coin, 0, 0)
+	p.send("tx", tx.Serialize())
+	pl := p.expectCmd("reject")
+	rj, e := protocol.ParseReject(pl)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if rj.Message!="tx" || rj.Code!=protocol.REJECT_INSUFFICIENTFEE || rj.Hash==nil || !rj.Hash.Equal(tx.Hash) {
+		t.Error("Bad reject", rj)
+	}
+
+	// a reject of our own tx should be reported
+	own := spendTestTx(t, coin, 0, 10000)
+	rec := &OneTxToSend{Tx:own, Data:own.Serialize(), Own:1, Firstseen:time.Now()}
+	TxMutex.Lock()
+	AddToSend(rec)
+	TxMutex.Unlock()
+	defer func() {
+		TxMutex.Lock()
+		DeleteToSend(rec)
+		TxMutex.Unlock()
+	}()
+
+	rj = &protocol.Reject{Message:"tx", Code:protocol.REJECT_DUST, Reason:"dust", Hash:own.Hash}
+	p.send("reject", rj.Bytes())
+	select {
+		case pr := <-NetOwnTxRejects:
+			if !pr.Own || !pr.Hash.Equal(own.Hash) || pr.Reason!="dust" || pr.Peer!="11.0.0.11:8333" {
+				t.Error("Bad own tx reject", pr.String())
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("Reject of own tx not reported")
+	}
+	PeerRejectsMutex.Lock()
+	last := PeerRejects[len(PeerRejects)-1]
+	PeerRejectsMutex.Unlock()
+	if !last.Hash.Equal(own.Hash) {
+		t.Error("Reject not logged")
+	}
+}
+
+
+func TestTrafficWindow(t *testing.T) {
+	var w TrafficWindow
+	now := time.Now().Unix()
+	w.move(now)
+	w.slots[w.last%TrafficSlots] += 100
+	w.move(now+TrafficSlotSecs)
+	w.slots[w.last%TrafficSlots] += 50
+	if w.slots[(w.last-1)%TrafficSlots]+w.slots[w.last%TrafficSlots] != 150 {
+		t.Error("Bad window sum")
+	}
+	w.move(now+TrafficSlotSecs*TrafficSlots)
+	if w.slots[w.last%TrafficSlots]!=0 || w.slots[(w.last-TrafficSlots+1)%TrafficSlots]!=50 {
+		t.Error("Slots not expired properly")
+	}
+	w.move(now+10*TrafficSlotSecs*TrafficSlots)
+	for i := range w.slots {
+		if w.slots[i]!=0 {
+			t.Fatal("Window not cleared")
+		}
+	}
+}
+
+
+func TestTraffic(t *testing.T) {
+	p := connectTestPeer(t, 12)
+	defer p.Close()
+	p.sync()
+
+	p.conn.Mutex.Lock()
+	ver := p.conn.MsgTraffic["version"]
+	in, out := p.conn.TrafficIn.Sum(), p.conn.TrafficOut.Sum()
+	p.conn.Mutex.Unlock()
+	if ver==nil || ver.InCnt!=1 || ver.OutCnt!=1 || ver.InBytes<24+80 {
+		t.Error("Bad version traffic", ver)
+	}
+	if in==0 || out==0 {
+		t.Error("Peer traffic not counted", in, out)
+	}
+
+	TrafficMutex.Lock()
+	all := MsgTrafficAll["verack"]
+	TrafficMutex.Unlock()
+	if all==nil || all.InCnt==0 || all.OutCnt==0 {
+		t.Error("Global traffic not counted")
+	}
+}
+
+
+func TestUploadQuota(t *testing.T) {
+	newTestCoin(t)
+	oldbl := chainTop().BlockHash
+	newTestCoin(t)
+
+	common.CFG.Net.UploadQuotaMB = 1
+	HistoricalBlockAge = 30*time.Second
+	common.LockBw()
+	common.UlQuota.Month = time.Now().Year()*12 + int(time.Now().Month())
+	common.UlQuota.Bytes = 2<<20
+	common.UnlockBw()
+	defer func() {
+		common.CFG.Net.UploadQuotaMB = 0
+		HistoricalBlockAge = 7*24*time.Hour
+	}()
+
+	p := connectTestPeer(t, 13)
+	defer p.Close()
+
+	// over the quota the old block should not be served
+	p.send("getdata", invPayload(2, oldbl))
+	p.expectInv("notfound", 2, oldbl)
+
+	// ... but the top one should
+	p.send("getdata", invPayload(2, chainTop().BlockHash))
+	p.expectCmd("block")
+}
+
+
+func TestTrickleTxInvs(t *testing.T) {
+	c := new(OneConnection) // outbound
+	var invs [MaxTxInvsAtOnce+10]*[36]byte
+	for i := range invs {
+		invs[i] = new([36]byte)
+		binary.LittleEndian.PutUint32(invs[i][:4], 1)
+		binary.LittleEndian.PutUint32(invs[i][4:8], uint32(i))
+		c.QueueInv(1, invs[i])
+	}
+	c.NextTxInvs = time.Now().Add(time.Hour)
+	if res := c.trickleTxInvs(); len(res)!=0 {
+		t.Error("Tx invs sent before their time")
+	}
+
+	c.NextTxInvs = time.Now()
+	res := c.trickleTxInvs()
+	if len(res)!=MaxTxInvsAtOnce || len(c.PendingTxInvs)!=10 || !c.NextTxInvs.After(time.Now().Add(-time.Second)) {
+		t.Fatal("Bad trickle", len(res), len(c.PendingTxInvs))
+	}
+	seen := make(map[uint32] bool)
+	var shuffled bool
+	for i, inv := range append(res, c.PendingTxInvs...) {
+		n := binary.LittleEndian.Uint32(inv[4:8])
+		if seen[n] {
+			t.Error("Duplicate inv", n)
+		}
+		seen[n] = true
+		shuffled = shuffled || n!=uint32(i)
+	}
+	if len(seen)!=len(invs) || !shuffled {
+		t.Error("Tx invs not shuffled", len(seen))
+	}
+}
+
+
+func TestOwnTxInv(t *testing.T) {
+	p := connectTestPeer(t, 14)
+	defer p.Close()
+	p.sync()
+
+	// own txs go to peers that never sent us any invs, just like the relayed ones
+	h := btc.NewSha2Hash([]byte("own tx"))
+	if NetRouteInv(1, h, nil)==0 {
+		t.Error("Own tx inv not queued")
+	}
+	p.expectInv("inv", 1, h)
+}
+
+
+func TestFeeFilterZeroFee(t *testing.T) {
+	p := connectTestPeer(t, 15)
+	defer p.Close()
+	var pl [8]byte
+	binary.LittleEndian.PutUint64(pl[:], 1000)
+	p.send("feefilter", pl[:])
+	p.sync()
+	p.conn.Mutex.Lock()
+	p.conn.NextTxInvs = time.Now().Add(time.Hour) // keep the invs in the queue
+	p.conn.Mutex.Unlock()
+
+	queued := func(h *btc.Uint256) (yes bool) {
+		p.conn.Mutex.Lock()
+		for _, inv := range p.conn.PendingTxInvs {
+			yes = yes || bytes.Equal(inv[4:36], h.Hash[:])
+		}
+		p.conn.Mutex.Unlock()
+		return
+	}
+	h := btc.NewSha2Hash([]byte("zero fee tx"))
+	NetRouteInvExt(1, h, nil, 0)
+	if queued(h) {
+		t.Error("Zero fee tx inv went through the feefilter")
+	}
+	NetRouteInv(1, h, nil) // unknown fee
+	if !queued(h) {
+		t.Error("Tx inv of unknown fee not queued")
+	}
+}
+
+
+func TestLimitOrphansDrift(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		TxMutex.Lock()
+		OrphanCnt += 1000000 // more than there are in WaitingForInputs
+		limitOrphans()
+		TxMutex.Unlock()
+		done <- true
+	}()
+	select {
+		case <-done:
+		case <-time.After(testTimeout):
+			t.Fatal("limitOrphans hangs when OrphanCnt is wrong")
+	}
+	TxMutex.Lock()
+	var cnt int
+	for _, w := range WaitingForInputs {
+		cnt += len(w.Ids)
+	}
+	if OrphanCnt!=cnt {
+		t.Error("OrphanCnt not fixed", OrphanCnt, cnt)
+	}
+	TxMutex.Unlock()
+}
+
+
+func TestOwnTxDoubleSpent(t *testing.T) {
+	coin := newTestCoin(t)
+	own := spendTestTx(t, coin, 0, 10000)
+	rec := &OneTxToSend{Tx:own, Data:own.Serialize(), Own:1, Firstseen:time.Now()}
+	TxMutex.Lock()
+	AddToSend(rec)
+	TxMutex.Unlock()
+
+	// once the other tx is mined, the spent output is gone from the unspent db - it must be reported anyway
+	other := spendTestTx(t, coin, 0, 20000)
+	mineTestBlock(t, topTestBlock(t, other))
+	select {
+		case ds := <-NetDoubleSpends:
+			if !ds.TxID.Equal(own.Hash) || !ds.Own || !ds.Mined || len(ds.PrevOuts)!=1 ||
+				ds.PrevOuts[0]==nil || ds.PrevOuts[0].Value!=coin.TxOut[0].Value {
+				t.Error("Bad double spend", ds.String())
+			}
+		default:
+			t.Fatal("Double spend of own tx not reported")
+	}
+	if inMempool(own.Hash) {
+		t.Error("Double spent tx still in the pool")
+	}
+}
+
+
+func TestOwnTxConflict(t *testing.T) {
+	coin := newTestCoin(t)
+	p := connectTestPeer(t, 16)
+	defer p.Close()
+
+	tx := spendTestTx(t, coin, 0, 10000)
+	p.send("inv", invPayload(1, tx.Hash))
+	p.expectInv("getdata", 1, tx.Hash)
+	p.send("tx", tx.Serialize())
+	if !waitUntil(func() bool { return inMempool(tx.Hash) }) {
+		t.Fatal("The tx is not in the memory pool")
+	}
+
+	// an own tx loaded from the pool file replaces the network one, taking over its inputs
+	own := spendTestTx(t, coin, 0, 20000)
+	rec := loadOwnTx(own, own.Serialize(), 1)
+	if rec==nil || inMempool(tx.Hash) {
+		t.Fatal("Own tx did not replace the conflicting one")
+	}
+	TxMutex.Lock()
+	k, ok := SpentOutputs[own.TxIn[0].Input.UIdx()]
+	DeleteToSend(rec)
+	_, left := SpentOutputs[own.TxIn[0].Input.UIdx()]
+	TxMutex.Unlock()
+	if !ok || k!=own.Hash.BIdx() || left {
+		t.Error("Bad SpentOutputs", ok, left)
+	}
+}
+
+
+func TestAddrManKey(t *testing.T) {
+	key := addrKey
+	if v := PeerDB.Get(addrKeyDBKey); !bytes.Equal(v, key[:]) {
+		t.Fatal("Address manager key not in the peers DB")
+	}
+
+	p, e := NewIncomingPeer("12.0.0.1:8333")
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	peerdb_mutex.Lock()
+	s := addrSlots[p.UniqID()]
+	addrRemove(p.UniqID())
+	peerdb_mutex.Unlock()
+
+	// a peer that has been removed must not come back when its connection ends
+	p.Dead()
+	if PeerDB.Get(qdb.KeyType(p.UniqID())) != nil {
+		t.Error("Removed peer saved again")
+	}
+
+	// after a restart the same key must put the peer into the same slot
+	addrKey = [32]byte{}
+	loadAddrMan()
+	if addrKey!=key || newSlot(p)!=s {
+		t.Error("Address manager key not restored")
+	}
+}
+
+
+func TestBadChecksum(t *testing.T) {
+	p := connectTestPeer(t, 17)
+	defer p.Close()
+	defer RemoveBan([4]byte{11,0,0,17}, 32)
+
+	// the broken message should be skipped and scored only once
+	m := protocol.NewMsg(common.Magic, "ping", protocol.PingBytes(1))
+	m[20] ^= 1
+	p.SetWriteDeadline(time.Now().Add(testTimeout))
+	if _, e := p.Write(m); e != nil {
+		t.Fatal(e.Error())
+	}
+	p.sync()
+
+	p.conn.Mutex.Lock()
+	score := p.conn.BanScore
+	p.conn.Mutex.Unlock()
+	if score!=DoSScores["MsgBadChksum"] || IsBanned([]byte{11,0,0,17}) {
+		t.Error("Bad checksum scored", score)
+	}
+}
+
+
+func TestBanForever(t *testing.T) {
+	dur, e := ParseBanTime("1000000h")
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	ip := [4]byte{12,0,0,2}
+	SetBan(ip, 32, dur)
+	defer RemoveBan(ip, 32)
+	BanMutex.Lock()
+	b := BanList[newBan(ip, 32).Key()]
+	BanMutex.Unlock()
+	if b==nil || b.Until!=0 || !IsBanned(ip[:]) {
+		t.Error("Long ban should never expire", b)
+	}
+}
+
+
+func TestWhitelistedTooBig(t *testing.T) {
+	common.CFG.Net.Whitelist = "11.0.0.18"
+	common.Reset()
+	defer func() {
+		common.CFG.Net.Whitelist = ""
+		common.Reset()
+	}()
+
+	p := connectTestPeer(t, 18)
+	defer p.Close()
+
+	// the payload cannot be skipped, so even a whitelisted peer must be dropped
+	m := protocol.NewMsg(common.Magic, "ping", nil)
+	binary.LittleEndian.PutUint32(m[16:20], 0x7fffffff)
+	p.SetWriteDeadline(time.Now().Add(testTimeout))
+	if _, e := p.Write(m); e != nil {
+		t.Fatal(e.Error())
+	}
+	if !p.waitDisconnect() {
+		t.Error("Whitelisted peer not disconnected")
+	}
+	if IsBanned([]byte{11,0,0,18}) {
+		t.Error("Whitelisted peer banned")
+	}
+}
+
+
+func TestMempoolTrickled(t *testing.T) {
+	relayed := spendTestTx(t, newTestCoin(t), 0, 10000)
+	own := spendTestTx(t, newTestCoin(t), 0, 10000)
+	recs := []*OneTxToSend{
+		&OneTxToSend{Tx:relayed, Data:relayed.Serialize(), Fee:10000, Firstseen:time.Now()},
+		&OneTxToSend{Tx:own, Data:own.Serialize(), Fee:10000, Own:1, Firstseen:time.Now()}}
+	TxMutex.Lock()
+	for _, rec := range recs {
+		AddToSend(rec)
+	}
+	TxMutex.Unlock()
+	defer func() {
+		TxMutex.Lock()
+		for _, rec := range recs {
+			DeleteToSend(rec)
+		}
+		TxMutex.Unlock()
+	}()
+
+	p := connectTestPeer(t, 19)
+	defer p.Close()
+	p.sync()
+	p.conn.Mutex.Lock()
+	p.conn.NextTxInvs = time.Now().Add(time.Hour) // keep the invs in the queue
+	p.conn.Mutex.Unlock()
+
+	// the answer should wait in the trickle queue and skip own txs not broadcast yet
+	p.send("mempool", nil)
+	p.sync()
+	var gotrelayed, gotown bool
+	p.conn.Mutex.Lock()
+	for _, inv := range p.conn.PendingTxInvs {
+		gotrelayed = gotrelayed || bytes.Equal(inv[4:36], relayed.Hash.Hash[:])
+		gotown = gotown || bytes.Equal(inv[4:36], own.Hash.Hash[:])
+	}
+	p.conn.Mutex.Unlock()
+	if !gotrelayed || gotown {
+		t.Error("Bad mempool answer", gotrelayed, gotown)
+	}
+}
+
+
+func TestDoubleSpendUnsigned(t *testing.T) {
+	coin := newTestCoin(t)
+	p := connectTestPeer(t, 20)
+	defer p.Close()
+	defer RemoveBan([4]byte{11,0,0,20}, 32)
+	for len(NetDoubleSpends) > 0 {
+		<-NetDoubleSpends
+	}
+
+	tx := spendTestTx(t, coin, 0, 10000)
+	p.send("tx", tx.Serialize())
+	if !waitUntil(func() bool { return inMempool(tx.Hash) }) {
+		t.Fatal("The tx is not in the memory pool")
+	}
+
+	// anyone can make a tx spending the same inputs, but without a valid signature it is no double spend
+	bad := spendTestTx(t, coin, 0, 30000)
+	bad.TxIn[0].ScriptSig[10] ^= 1
+	bad.Hash = btc.NewSha2Hash(bad.Serialize())
+	p.send("tx", bad.Serialize())
+	if !waitUntil(func() bool {
+		TxMutex.Lock()
+		rec := TransactionsRejected[bad.Hash.BIdx()]
+		TxMutex.Unlock()
+		return rec!=nil && rec.Reason==TX_REJECTED_SCRIPT_FAIL
+	}) {
+		t.Fatal("The unsigned tx has not been rejected")
+	}
+	if len(NetDoubleSpends) > 0 {
+		t.Error("Double spend reported for the unsigned tx", (<-NetDoubleSpends).String())
+	}
+	if !inMempool(tx.Hash) {
+		t.Error("The pool tx has been replaced")
+	}
+}
+
+
+func TestOwnTxReplace(t *testing.T) {
+	coin := newTestCoin(t)
+	p := connectTestPeer(t, 21)
+	defer p.Close()
+
+	tx := spendTestTx(t, coin, 0, 10000)
+	tx.TxIn[0].Sequence = RBF_SEQUENCE_MAX
+	if e := tx.Sign(0, testPkScr, btc.SIGHASH_ALL, testPub, testPriv); e != nil {
+		t.Fatal(e.Error())
+	}
+	tx.Hash = btc.NewSha2Hash(tx.Serialize())
+	p.send("tx", tx.Serialize())
+	if !waitUntil(func() bool { return inMempool(tx.Hash) }) {
+		t.Fatal("The tx is not in the memory pool")
+	}
+
+	// loading own txs does not touch the pool tx - it only gets replaced when they are sent (and pay enough)
+	var recs []*OneTxToSend
+	defer func() {
+		TxMutex.Lock()
+		for _, rec := range recs {
+			DeleteToSend(rec)
+		}
+		TxMutex.Unlock()
+	}()
+	for _, fee := range []uint64{10000, 30000} {
+		own := spendTestTx(t, coin, 0, fee)
+		rec := &OneTxToSend{Tx:own, Data:own.Serialize(), Own:1, Fee:fee, Firstseen:time.Now()}
+		TxMutex.Lock()
+		AddToSend(rec)
+		TxMutex.Unlock()
+		recs = append(recs, rec)
+	}
+	if !inMempool(tx.Hash) {
+		t.Fatal("Loading own tx removed the conflicting one")
+	}
+
+	TxMutex.Lock()
+	RouteOwnTx(recs[0])
+	TxMutex.Unlock()
+	if !inMempool(tx.Hash) {
+		t.Fatal("Own tx not paying more replaced the conflicting one")
+	}
+
+	TxMutex.Lock()
+	RouteOwnTx(recs[1])
+	k := SpentOutputs[tx.TxIn[0].Input.UIdx()]
+	TxMutex.Unlock()
+	if inMempool(tx.Hash) || k!=recs[1].Tx.Hash.BIdx() {
+		t.Error("Own tx paying more did not replace the conflicting one")
+	}
+}
+
+
+func TestCmpctTimeout(t *testing.T) {
+	p := connectTestPeer(t, 22)
+	defer p.Close()
+
+	// a compact block whose "blocktxn" never comes must not hold the slot forever
+	var k [btc.Uint256IdxLen]byte
+	p.conn.Mutex.Lock()
+	p.conn.CmpctInProgress[k] = &oneCmpctBlock{start:time.Now().Add(-GetBlockTimeout-time.Second)}
+	p.conn.Mutex.Unlock()
+	if !waitUntil(func() bool {
+		p.conn.Mutex.Lock()
+		defer p.conn.Mutex.Unlock()
+		return len(p.conn.CmpctInProgress)==0
+	}) {
+		t.Error("Compact block in progress has not expired")
+	}
+}
+
+
+func TestHeadersKnown(t *testing.T) {
+	p := connectTestPeer(t, 23)
+	defer p.Close()
+	p.send("sendheaders", nil)
+	p.sync()
+
+	bl := topTestBlock(t)
+	mineTestBlock(t, bl)
+	p.expectCmd("headers")
+
+	// the peer already has the header, so it should get neither headers nor inv again
+	NetRouteBlock(bl, nil)
+	p.conn.Mutex.Lock()
+	invs := len(p.conn.PendingInvs)
+	_, known := p.conn.headersToAnnounce(p.conn.LastHeaderSent.Parent)
+	p.conn.Mutex.Unlock()
+	if invs!=0 {
+		t.Error("Known block announced with inv")
+	}
+	if !known {
+		t.Error("Parent of the last header sent not known")
+	}
+}
@@ -0,0 +1,108 @@
+package network
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"github.com/piotrnar/gocoin/btc"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+const (
+	MaxOrphansPerPeer = 25 // a peer cannot have more txs than this waiting for inputs
+	OrphanInvalidBanScore = 20 // for an orphan that turned out invalid once we got its inputs
+)
+
+var (
+	// Number of txs waiting for inputs (Wait4Input records in TransactionsRejected):
+	OrphanCnt int
+)
+
+
+// Puts the rejected tx into the orphan pool, unless its peer is over the quota.
+// Returns false if the tx has not been added.
+// Make sure to call it with locked TxMutex
+func addOrphan(nrtx *OneTxRejected, missingid *btc.Uint256, ntx *TxRcvd) bool {
+	if ntx.conn!=nil {
+		if ntx.conn.OrphanCnt >= MaxOrphansPerPeer {
+			common.CountSafe("TxOrphanPeerQuota")
+			return false
+		}
+		ntx.conn.OrphanCnt++
+	}
+	nrtx.Wait4Input = &Wait4Input{missingTx: missingid, TxRcvd: ntx}
+	OrphanCnt++
+	return true
+}
+
+
+// Called for each record removed from the orphan pool
+// Make sure to call it with locked TxMutex
+func orphanRemoved(w4i *Wait4Input) {
+	OrphanCnt--
+	if w4i.conn!=nil {
+		w4i.conn.OrphanCnt--
+	}
+}
+
+
+// Evicts random txs from the orphan pool, until it is within the limit
+// Make sure to call it with locked TxMutex
+func limitOrphans() {
+	for OrphanCnt > int(atomic.LoadUint32(&common.CFG.TXPool.MaxOrphans)) {
+		if !evictOrphan(rand.Intn(OrphanCnt)) {
+			// OrphanCnt does not match WaitingForInputs (it should never happen) - recount it
+			OrphanCnt = 0
+			for _, w := range WaitingForInputs {
+				OrphanCnt += len(w.Ids)
+			}
+			common.CountSafe("TxOrphanCntBad")
+		}
+	}
+}
+
+
+// Removes n-th tx from WaitingForInputs. Returns false if there are not so many.
+// Make sure to call it with locked TxMutex
+func evictOrphan(n int) bool {
+	for wk, w := range WaitingForInputs {
+		for k := range w.Ids {
+			if n==0 {
+				if _, ok := TransactionsRejected[k]; ok {
+					deleteRejected(k)
+					common.CountSafe("TxOrphanEvicted")
+				} else {
+					// the record is gone, though it is still waiting
+					delete(w.Ids, k)
+					if len(w.Ids)==0 {
+						delete(WaitingForInputs, wk)
+					}
+					common.CountSafe("TxOrphanStale")
+				}
+				return true
+			}
+			n--
+		}
+	}
+	return false
+}
+
+
+// Forgets all the orphans received from the given peer (e.g. when it disconnects)
+func DropPeerOrphans(c *OneConnection) {
+	TxMutex.Lock()
+	if c.OrphanCnt > 0 {
+		for k, v := range TransactionsRejected {
+			if v.Wait4Input!=nil && v.Wait4Input.conn==c {
+				deleteRejected(k)
+				common.CountSafe("TxOrphanPeerGone")
+			}
+		}
+	}
+	TxMutex.Unlock()
+}
+
+
+// Returns true if the reject reason means that the tx is invalid, not just unwanted
+func invalidTx(reason byte) bool {
+	return reason==TX_REJECTED_BAD_INPUT || reason==TX_REJECTED_OVERSPEND || reason==TX_REJECTED_SCRIPT_FAIL
+}
@@ -27,6 +27,8 @@ var (
 
 type onePeer struct {
 	*utils.OnePeer
+	Tried bool // we have been connected to it (it is in the tried table)
+	SrcGroup uint16 // network group of the peer that told us about this address
 }
 
 
@@ -39,6 +41,27 @@ func NewEmptyPeer() (p *onePeer) {
 func NewPeer(v []byte) (p *onePeer) {
 	p = new(onePeer)
 	p.OnePeer = utils.NewPeer(v)
+	if len(v)>=37 {
+		p.Tried = (v[34]&1)!=0
+		p.SrcGroup = binary.LittleEndian.Uint16(v[35:37])
+	}
+	return
+}
+
+
+/*
+Serialized record in the peers DB:
+ [0:34] - utils.OnePeer (with the ban time always present)
+ [34] - flags: bit 0 set if the peer is in the tried table
+ [35:37] - network group of the address' source (LSB)
+*/
+func (p *onePeer) Bytes() (res []byte) {
+	res = make([]byte, 37)
+	copy(res[:34], p.OnePeer.Bytes())
+	if p.Tried {
+		res[34] = 1
+	}
+	binary.LittleEndian.PutUint16(res[35:37], p.SrcGroup)
 	return
 }
 
@@ -59,12 +82,12 @@ func NewIncomingPeer(ipstr string) (p *onePeer, e error) {
 		p.Services = common.Services
 		copy(p.Ip6[:], ip[:12])
 		p.Port = common.DefaultTcpPort
-		if dbp := PeerDB.Get(qdb.KeyType(p.UniqID())); dbp!=nil && NewPeer(dbp).Banned!=0 {
+		if IsBanned(p.Ip4[:]) && !common.IsWhitelisted(p.Ip4[:]) {
 			e = errors.New(p.Ip() + " is banned")
 			p = nil
 		} else {
 			p.Time = uint32(time.Now().Unix())
-			p.Save()
+			addrAdd(p, netGroup(p.Ip4[:]))
 		}
 	} else {
 		e = errors.New("Error parsing IP '"+ipstr+"'")
@@ -74,13 +97,21 @@ func NewIncomingPeer(ipstr string) (p *onePeer, e error) {
 
 
 func ExpirePeers() {
+	ExpireBans()
 	peerdb_mutex.Lock()
 	var delcnt uint32
 	now := time.Now()
 	todel := make([]qdb.KeyType, PeerDB.Count())
 	PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
+		if !IsPeerKey(k) {
+			return 0
+		}
 		ptim := binary.LittleEndian.Uint32(v[0:4])
-		if now.After(time.Unix(int64(ptim), 0).Add(ExpirePeerAfter)) {
+		exp := ExpirePeerAfter
+		if len(v)>=37 && (v[34]&1)!=0 {
+			exp = ExpireTriedPeerAfter
+		}
+		if now.After(time.Unix(int64(ptim), 0).Add(exp)) {
 			todel[delcnt] = k // we cannot call Del() from here
 			delcnt++
 		}
@@ -90,7 +121,7 @@ func ExpirePeers() {
 		common.CountSafeAdd("PeersExpired", uint64(delcnt))
 		for delcnt > 0 {
 			delcnt--
-			PeerDB.Del(todel[delcnt])
+			addrRemove(uint64(todel[delcnt]))
 		}
 		common.CountSafe("PeerDefragsDone")
 		PeerDB.Defrag()
@@ -101,14 +132,26 @@ func ExpirePeers() {
 }
 
 
+// Make sure to call it with locked peerdb_mutex
 func (p *onePeer) Save() {
 	PeerDB.Put(qdb.KeyType(p.UniqID()), p.Bytes())
 }
 
 
+// Saves the peer, unless it has been removed from the tables in the meantime
+func (p *onePeer) update() {
+	peerdb_mutex.Lock()
+	if s, ok := addrSlots[p.UniqID()]; ok {
+		p.Tried = s.tried // it might have been moved, through another record of the same peer
+		p.Save()
+	}
+	peerdb_mutex.Unlock()
+}
+
+
+// Bans the peer's IP for the configured time
 func (p *onePeer) Ban() {
-	p.Banned = uint32(time.Now().Unix())
-	p.Save()
+	SetBan(p.Ip4, 32, BanTime())
 }
 
 
@@ -117,14 +160,14 @@ func (p *onePeer) Alive() {
 	now := time.Now().Unix()
 	p.Time = uint32(now)
 	if now-prv >= 60 {
-		p.Save() // Do not save more often than once per minute
+		p.update() // Do not save more often than once per minute
 	}
 }
 
 
 func (p *onePeer) Dead() {
 	p.Time -= 600 // make it 10 min older
-	p.Save()
+	p.update()
 }
 
 
@@ -137,10 +180,9 @@ func (p *onePeer) String() (s string) {
 	s = fmt.Sprintf("%21s", p.Ip())
 
 	now := uint32(time.Now().Unix())
-	if p.Banned != 0 {
-		s += fmt.Sprintf("  *BAN %3d min ago", (now-p.Banned)/60)
-	} else {
-		s += fmt.Sprintf("  Seen %3d min ago", (now-p.Time)/60)
+	s += fmt.Sprintf("  Seen %3d min ago", (now-p.Time)/60)
+	if IsBanned(p.Ip4[:]) {
+		s += "  *BANNED"
 	}
 	return
 }
@@ -173,8 +215,11 @@ func GetBestPeers(limit uint, unconnected bool) (res manyPeers) {
 	peerdb_mutex.Lock()
 	tmp := make(manyPeers, 0)
 	PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
+		if !IsPeerKey(k) {
+			return 0
+		}
 		ad := NewPeer(v)
-		if ad.Banned==0 && utils.ValidIp4(ad.Ip4[:]) && !common.IsIPBlocked(ad.Ip4[:]) {
+		if !IsBanned(ad.Ip4[:]) && utils.ValidIp4(ad.Ip4[:]) && !common.IsIPBlocked(ad.Ip4[:]) {
 			if !unconnected || !ConnectionActive(ad) {
 				tmp = append(tmp, ad)
 			}
@@ -195,32 +240,14 @@ func GetBestPeers(limit uint, unconnected bool) (res manyPeers) {
 }
 
 
-func initSeeds(seeds []string, port uint16) {
-	for i := range seeds {
-		ad, er := net.LookupHost(seeds[i])
-		if er == nil {
-			for j := range ad {
-				ip := net.ParseIP(ad[j])
-				if ip != nil && len(ip)==16 {
-					p := NewEmptyPeer()
-					p.Time = uint32(time.Now().Unix())
-					p.Services = 1
-					copy(p.Ip6[:], ip[:12])
-					copy(p.Ip4[:], ip[12:16])
-					p.Port = port
-					p.Save()
-				}
-			}
-		} else {
-			println("initSeeds LookupHost", seeds[i], "-", er.Error())
-		}
-	}
-}
-
-
 // shall be called from the main thread
 func InitPeers(dir string) {
-	PeerDB, _ = qdb.NewDB(dir+"peers3", true)
+	PeerDB, _ = qdb.NewDB(dir+"peers4", true)
+	if PeerDB.Count()==0 {
+		migratePeers3(dir)
+	}
+	loadBans()
+	loadAddrMan()
 
 	if common.CFG.ConnectOnly != "" {
 		x := strings.Index(common.CFG.ConnectOnly, ":")
@@ -239,15 +266,7 @@ func InitPeers(dir string) {
 		fmt.Printf("Connect to bitcoin network via %d.%d.%d.%d:%d\n",
 			oa.IP[0], oa.IP[1], oa.IP[2], oa.IP[3], oa.Port)
 	} else {
-		go func() {
-			if !common.CFG.Testnet {
-				initSeeds([]string{"seed.bitcoin.sipa.be", "dnsseed.bluematt.me",
-					/*"dnsseed.bitcoin.dashjr.org",*/ "bitseed.xf2.org"}, 8333)
-			} else {
-				initSeeds([]string{/*"bitcoin.petertodd.org",*/ "testnet-seed.bitcoin.petertodd.org",
-					/*"bluematt.me",*/ "testnet-seed.bluematt.me"}, 18333)
-			}
-		}()
+		DNSSeedIfNeeded()
 	}
 }
 
@@ -50,6 +50,10 @@ func drop_slowest_peer() {
 			continue
 		}
 		v.Mutex.Lock()
+		if v.Whitelisted || v.AddNode {
+			v.Mutex.Unlock()
+			continue
+		}
 		ap := v.GetAveragePing()
 		v.Mutex.Unlock()
 		if ap > worst_ping {
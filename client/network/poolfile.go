@@ -0,0 +1,237 @@
+package network
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"time"
+	"bufio"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/btc"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+const (
+	MempoolFileName = "mempool.dat"
+	mempoolFileVersion = 1
+
+	OwnTxRebroadcast = 30*time.Minute // how often to re-send invs of own unconfirmed txs
+)
+
+
+// Stores the memory pool in the given file, so it survives a restart.
+// Each record: own(1), firstseen(8), invsentcnt(4), raw tx length(vlen), raw tx
+func SaveMempool(fn string) {
+	TxMutex.Lock()
+	txs := make([]*OneTxToSend, 0, len(TransactionsToSend))
+	for _, v := range TransactionsToSend {
+		txs = append(txs, v)
+	}
+	sortByAncestors(txs) // parents first, so they get loaded first
+	TxMutex.Unlock()
+
+	f, e := os.Create(fn+".tmp")
+	if e != nil {
+		println("SaveMempool:", e.Error())
+		return
+	}
+	wr := bufio.NewWriter(f)
+	wr.WriteByte(mempoolFileVersion)
+	binary.Write(wr, binary.LittleEndian, uint32(len(txs)))
+	for _, v := range txs {
+		wr.WriteByte(v.Own)
+		binary.Write(wr, binary.LittleEndian, v.Firstseen.Unix())
+		binary.Write(wr, binary.LittleEndian, uint32(v.Invsentcnt))
+		btc.WriteVlen(wr, uint32(len(v.Data)))
+		wr.Write(v.Data)
+	}
+	if e = wr.Flush(); e == nil {
+		e = f.Close()
+	} else {
+		f.Close()
+	}
+	if e != nil {
+		println("SaveMempool:", e.Error())
+		os.Remove(fn+".tmp")
+		return
+	}
+	os.Rename(fn+".tmp", fn)
+	fmt.Println(len(txs), "transactions saved to", fn)
+}
+
+
+// Loads the txs saved by SaveMempool, putting back into the pool the ones that are still valid.
+// Must be called from the chain's thread
+func LoadMempool(fn string) {
+	f, e := os.Open(fn)
+	if e != nil {
+		return // no file - nothing to load
+	}
+	defer f.Close()
+	rd := bufio.NewReader(f)
+
+	var cnt uint32
+	if ver, _ := rd.ReadByte(); ver!=mempoolFileVersion {
+		println("LoadMempool: unsupported file version", ver)
+		return
+	}
+	if e = binary.Read(rd, binary.LittleEndian, &cnt); e != nil {
+		println("LoadMempool:", e.Error())
+		return
+	}
+
+	var ok, owncnt int
+	for i:=uint32(0); i<cnt; i++ {
+		var fs int64
+		var invs uint32
+		own, e := rd.ReadByte()
+		if e == nil {
+			e = binary.Read(rd, binary.LittleEndian, &fs)
+		}
+		if e == nil {
+			e = binary.Read(rd, binary.LittleEndian, &invs)
+		}
+		var le uint64
+		if e == nil {
+			le, e = btc.ReadVLen(rd)
+		}
+		if e == nil && le > btc.MAX_BLOCK_SIZE {
+			e = fmt.Errorf("tx too big (%d bytes)", le)
+		}
+		raw := make([]byte, int(le))
+		if e == nil {
+			_, e = io.ReadFull(rd, raw)
+		}
+		if e != nil {
+			println("LoadMempool:", e.Error())
+			break
+		}
+
+		tx, n := btc.NewTx(raw)
+		if tx==nil || n!=len(raw) {
+			println("LoadMempool: bad tx at index", i)
+			continue
+		}
+		tx.Hash = btc.NewSha2Hash(raw)
+
+		var rec *OneTxToSend
+		if own!=0 {
+			rec = loadOwnTx(tx, raw, own)
+		} else if HandleNetTx(&TxRcvd{tx:tx, raw:raw}, true) {
+			TxMutex.Lock()
+			rec = TransactionsToSend[tx.Hash.BIdx()]
+			TxMutex.Unlock()
+		}
+		if rec != nil {
+			rec.Firstseen = time.Unix(fs, 0)
+			if own!=0 {
+				rec.Invsentcnt = uint(invs)
+				owncnt++
+			}
+			ok++
+		}
+	}
+	fmt.Println(ok, "out of", cnt, "transactions loaded from", fn, "-", owncnt, "own")
+}
+
+
+// Puts own tx back to the pool, unless it has been mined (or double spent) in the meantime.
+// An own tx that had unknown inputs when it was loaded, stays as such.
+func loadOwnTx(tx *btc.Tx, raw []byte, own byte) (rec *OneTxToSend) {
+	TxMutex.Lock()
+	defer TxMutex.Unlock()
+	if _, ok := TransactionsToSend[tx.Hash.BIdx()]; ok {
+		return
+	}
+	// The own tx wins over the pool txs that spend the same inputs, but not over another own one
+	conflicts := Conflicts(tx)
+	for _, c := range conflicts {
+		if c.Own!=0 {
+			common.CountSafe("TxOwnConflict")
+			return
+		}
+	}
+	for _, c := range conflicts {
+		ReplaceToSend(c)
+	}
+	var totinp, totout uint64
+	for i := range tx.TxIn {
+		var po *btc.TxOut
+		inpid := btc.NewUint256(tx.TxIn[i].Input.Hash[:])
+		if txinmem, ok := TransactionsToSend[inpid.BIdx()]; ok {
+			if int(tx.TxIn[i].Input.Vout) < len(txinmem.TxOut) {
+				po = txinmem.TxOut[tx.TxIn[i].Input.Vout]
+			}
+		} else {
+			po, _ = common.BlockChain.Unspent.UnspentGet(&tx.TxIn[i].Input)
+		}
+		if po == nil {
+			if own==1 {
+				common.CountSafe("TxOwnGone")
+				return
+			}
+			continue
+		}
+		totinp += po.Value
+	}
+	for i := range tx.TxOut {
+		totout += tx.TxOut[i].Value
+	}
+	rec = &OneTxToSend{Tx:tx, Data:raw, Own:own, Volume:totinp}
+	if own==1 && totinp>=totout {
+		rec.Fee = totinp-totout
+	}
+	AddToSend(rec)
+	return
+}
+
+
+// Broadcasts own tx. If it is not final yet, it gets sent as soon as it becomes final.
+// The pool txs that it double spends get replaced first - if they cannot be, it is not sent.
+// Make sure to call it with locked TxMutex
+func RouteOwnTx(v *OneTxToSend) (cnt uint) {
+	if !IsFinalNow(v.Tx) {
+		v.SendWhenFinal = true
+		return
+	}
+	v.SendWhenFinal = false
+	if ReplaceConflicts(v)!=0 {
+		common.CountSafe("TxOwnNotReplacing")
+		return
+	}
+	cnt = v.routeOwnInv()
+	v.Invsentcnt += cnt
+	v.LastInvSent = time.Now()
+	return
+}
+
+
+// Own txs with unknown inputs have unknown fee, so these go regardless of peers' feefilter
+func (v *OneTxToSend) routeOwnInv() uint {
+	if v.Own==2 {
+		return NetRouteInv(1, v.Tx.Hash, nil)
+	}
+	return NetRouteInvExt(1, v.Tx.Hash, nil, v.SPKB())
+}
+
+
+// Re-sends invs of own txs that have been broadcast, but not confirmed yet.
+// Also sends the ones that were waiting to become final.
+func RebroadcastOwnTxs() {
+	TxMutex.Lock()
+	defer TxMutex.Unlock()
+	for _, v := range TransactionsToSend {
+		if v.SendWhenFinal {
+			if IsFinalNow(v.Tx) {
+				RouteOwnTx(v)
+				common.CountSafe("TxOwnNowFinal")
+			}
+			continue
+		}
+		if v.Own==1 && v.Invsentcnt>0 && time.Now().Sub(v.LastInvSent) >= OwnTxRebroadcast {
+			v.Invsentcnt += v.routeOwnInv()
+			v.LastInvSent = time.Now()
+			common.CountSafe("TxOwnRebroadcast")
+		}
+	}
+}
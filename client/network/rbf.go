@@ -0,0 +1,171 @@
+package network
+
+import (
+	"sync/atomic"
+	"github.com/piotrnar/gocoin/btc"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+const (
+	RBF_SEQUENCE_MAX = 0xfffffffd // BIP125: any input with sequence not above it signals replaceability
+	MaxReplacementEvictions = 100 // BIP125 rule #5
+)
+
+
+// Returns true if the tx explicitly signals opt-in replace-by-fee
+func SignalsRBF(tx *btc.Tx) bool {
+	for i := range tx.TxIn {
+		if tx.TxIn[i].Sequence <= RBF_SEQUENCE_MAX {
+			return true
+		}
+	}
+	return false
+}
+
+
+// A tx is replaceable if it, or any of its in-pool ancestors, signals it
+// Make sure to call it with locked TxMutex
+func (t *OneTxToSend) Replaceable() bool {
+	if SignalsRBF(t.Tx) {
+		return true
+	}
+	for _, a := range t.Ancestors() {
+		if SignalsRBF(a.Tx) {
+			return true
+		}
+	}
+	return false
+}
+
+
+// Returns the pool txs that spend any of the inputs of the given tx.
+// Make sure to call it with locked TxMutex
+func Conflicts(tx *btc.Tx) (res map[[btc.Uint256IdxLen]byte] *OneTxToSend) {
+	res = make(map[[btc.Uint256IdxLen]byte] *OneTxToSend)
+	for i := range tx.TxIn {
+		if k, ok := SpentOutputs[tx.TxIn[i].Input.UIdx()]; ok {
+			if rec, ok := TransactionsToSend[k]; ok {
+				res[k] = rec
+			}
+		}
+	}
+	return
+}
+
+
+// Checks the BIP125 rules for a tx that conflicts with the given pool txs.
+// Returns all the txs that would need to be removed from the pool (conflicts with
+// their descendants), or a non-zero rejection reason.
+// Own txs can only be replaced by own txs.
+// Make sure to call it with locked TxMutex
+func checkReplacement(tx *btc.Tx, size int, fee uint64, conflicts map[[btc.Uint256IdxLen]byte] *OneTxToSend,
+	own bool) (torem map[[btc.Uint256IdxLen]byte] *OneTxToSend, reason byte) {
+	torem = make(map[[btc.Uint256IdxLen]byte] *OneTxToSend)
+	spkb := 1000*fee/uint64(size)
+	for k, c := range conflicts {
+		// Own txs are never replaced by the ones from the network
+		if c.Own!=0 && !own {
+			common.CountSafe("RbfOwnTx")
+			return nil, TX_REJECTED_DOUBLE_SPEND
+		}
+		// Rule #1: the originals must signal replaceability
+		if !c.Replaceable() {
+			common.CountSafe("RbfNotReplaceable")
+			return nil, TX_REJECTED_DOUBLE_SPEND
+		}
+		// Replacement must pay a higher fee rate than what it replaces
+		if spkb <= c.SPKB() {
+			common.CountSafe("RbfLowFeeRate")
+			return nil, TX_REJECTED_LOW_FEE
+		}
+		torem[k] = c
+		for kd, d := range c.Descendants() {
+			if d.Own!=0 && !own {
+				common.CountSafe("RbfOwnTx")
+				return nil, TX_REJECTED_DOUBLE_SPEND
+			}
+			torem[kd] = d
+		}
+	}
+
+	// Rule #5: do not evict too many txs
+	if len(torem) > MaxReplacementEvictions {
+		common.CountSafe("RbfTooManyEvictions")
+		return nil, TX_REJECTED_DOUBLE_SPEND
+	}
+
+	// Rule #2: no new unconfirmed inputs (and no spending from what is being replaced)
+	for k := range poolParents(tx) {
+		if _, ok := torem[k]; ok {
+			common.CountSafe("RbfSpendsConflict")
+			return nil, TX_REJECTED_BAD_INPUT
+		}
+		var old bool
+		for _, c := range conflicts {
+			if _, old = c.Parents[k]; old {
+				break
+			}
+		}
+		if !old {
+			common.CountSafe("RbfNewUnconfirmed")
+			return nil, TX_REJECTED_NOT_MINED
+		}
+	}
+
+	// Rule #3 and #4: pay for all the replaced txs, plus the relay fee of the new one
+	var oldfee uint64
+	for _, r := range torem {
+		oldfee += r.Fee
+	}
+	if fee < oldfee || 1000*(fee-oldfee) < uint64(size)*1000*atomic.LoadUint64(&common.CFG.TXPool.FeePerByte) {
+		common.CountSafe("RbfLowFee")
+		return nil, TX_REJECTED_LOW_FEE
+	}
+	return
+}
+
+
+// Removes the pool txs that the own tx double spends, so it can be sent, and takes over their inputs.
+// The same BIP125 rules apply as to the replacements coming from the network.
+// Returns a non-zero rejection reason if the conflicts cannot be replaced.
+// Make sure to call it with locked TxMutex
+func ReplaceConflicts(v *OneTxToSend) (reason byte) {
+	bidx := v.Tx.Hash.BIdx()
+	conflicts := Conflicts(v.Tx)
+	delete(conflicts, bidx)
+	if len(conflicts)==0 {
+		return
+	}
+	if v.Own!=1 {
+		common.CountSafe("RbfOwnUnknownFee")
+		return TX_REJECTED_NO_TXOU // own tx with unknown inputs - we do not know its fee
+	}
+	if _, reason = checkReplacement(v.Tx, len(v.Data), v.Fee, conflicts, true); reason!=0 {
+		return
+	}
+	for _, c := range conflicts {
+		ReplaceToSend(c)
+	}
+	for i := range v.TxIn {
+		idx := v.TxIn[i].Input.UIdx()
+		if _, ok := SpentOutputs[idx]; !ok {
+			v.Spent = append(v.Spent, idx)
+			SpentOutputs[idx] = bidx
+		}
+	}
+	common.CountSafe("TxOwnReplaced")
+	return
+}
+
+
+// Removes the tx (with all its descendants) from the pool, putting them on the rejected list
+// Make sure to call it with locked TxMutex
+func ReplaceToSend(rec *OneTxToSend) {
+	torem := rec.Descendants()
+	torem[rec.Tx.Hash.BIdx()] = rec
+	for _, r := range torem {
+		RejectTx(r.Tx.Hash, len(r.Data), TX_REJECTED_REPLACED)
+	}
+	DeleteToSend(rec)
+	common.CountSafeAdd("TxReplaced", uint64(len(torem)))
+}
@@ -0,0 +1,148 @@
+package network
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"github.com/piotrnar/gocoin/btc"
+	"github.com/piotrnar/gocoin/protocol"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+const (
+	RejectMinProtoVersion = 70002 // BIP61
+	MaxPeerRejects = 100 // how many recent rejects received from peers to remember
+)
+
+// A "reject" message received from a peer
+type PeerReject struct {
+	time.Time
+	Peer string
+	*protocol.Reject
+	Own bool // the rejected tx is our own one
+}
+
+var (
+	PeerRejects []*PeerReject
+	PeerRejectsMutex sync.Mutex
+
+	// Rejects of own txs are also reported to the main thread
+	NetOwnTxRejects chan *PeerReject = make(chan *PeerReject, 100)
+)
+
+
+func (pr *PeerReject) String() (s string) {
+	if pr.Own {
+		s = "Own tx "
+	} else {
+		s = pr.Message + " "
+	}
+	if pr.Hash != nil {
+		s += pr.Hash.String() + " "
+	}
+	s += fmt.Sprintf("rejected by %s with 0x%02x: %s", pr.Peer, pr.Code, pr.Reason)
+	return
+}
+
+
+// Returns the BIP61 code and the reason to report to the peer, for the given TX_REJECTED_* value.
+// Returns zero code if the peer should not be told about it.
+func txRejectCode(reason byte) (code byte, s string) {
+	switch reason {
+		case TX_REJECTED_TOO_BIG: return protocol.REJECT_NONSTANDARD, "tx-size"
+		case TX_REJECTED_FORMAT: return protocol.REJECT_MALFORMED, "error parsing message"
+		case TX_REJECTED_LEN_MISMATCH: return protocol.REJECT_MALFORMED, "extra data after tx"
+		case TX_REJECTED_EMPTY_INPUT: return protocol.REJECT_INVALID, "bad-txns-vin-empty"
+		case TX_REJECTED_NONSTD_VERSION: return protocol.REJECT_NONSTANDARD, "version"
+		case TX_REJECTED_SCRIPTSIG_SIZE: return protocol.REJECT_NONSTANDARD, "scriptsig-size"
+		case TX_REJECTED_SCRIPTSIG_PUSH: return protocol.REJECT_NONSTANDARD, "scriptsig-not-pushonly"
+		case TX_REJECTED_SCRIPTPUBKEY: return protocol.REJECT_NONSTANDARD, "scriptpubkey"
+		case TX_REJECTED_BARE_MULTISIG: return protocol.REJECT_NONSTANDARD, "bare-multisig"
+		case TX_REJECTED_DATACARRIER: return protocol.REJECT_NONSTANDARD, "multi-op-return"
+		case TX_REJECTED_DOUBLE_SPEND: return protocol.REJECT_DUPLICATE, "txn-mempool-conflict"
+		case TX_REJECTED_DUST: return protocol.REJECT_DUST, "dust"
+		case TX_REJECTED_OVERSPEND: return protocol.REJECT_INVALID, "bad-txns-in-belowout"
+		case TX_REJECTED_LOW_FEE: return protocol.REJECT_INSUFFICIENTFEE, "insufficient fee"
+		case TX_REJECTED_SCRIPT_FAIL: return protocol.REJECT_INVALID, "mandatory-script-verify-flag-failed"
+		case TX_REJECTED_BAD_INPUT: return protocol.REJECT_INVALID, "bad-txns-inputs-missingorspent"
+		case TX_REJECTED_NOT_MINED: return protocol.REJECT_NONSTANDARD, "unconfirmed-inputs"
+		case TX_REJECTED_CHAIN_LIMIT: return protocol.REJECT_NONSTANDARD, "too-long-mempool-chain"
+		case TX_REJECTED_NOT_FINAL: return protocol.REJECT_NONSTANDARD, "non-final"
+	}
+	// TX_REJECTED_NO_TXOU (orphans), TX_REJECTED_DISABLED and TX_REJECTED_REPLACED are not reported
+	return
+}
+
+
+// Sends "reject" message, if the peer's protocol version supports it
+func (c *OneConnection) SendReject(msg string, code byte, reason string, hash *btc.Uint256) {
+	if c==nil || c.Node.Version<RejectMinProtoVersion {
+		return
+	}
+	rj := &protocol.Reject{Message:msg, Code:code, Reason:reason, Hash:hash}
+	c.SendRawMsg("reject", rj.Bytes())
+	common.CountSafe("RejectSent_"+msg)
+}
+
+
+// Tells the peer why its tx has been rejected (TX_REJECTED_* value)
+func (c *OneConnection) sendTxReject(id *btc.Uint256, reason byte) {
+	if code, s := txRejectCode(reason); code!=0 {
+		c.SendReject("tx", code, s, id)
+	}
+}
+
+
+// Handles "reject" message - logs it against the referenced tx or block
+func (c *OneConnection) HandleReject(pl []byte) {
+	rj, e := protocol.ParseReject(pl)
+	if e != nil {
+		common.CountSafe("RejectBroken")
+		return
+	}
+	if rj.Message=="tx" || rj.Message=="block" {
+		common.CountSafe("RejectRcvd_"+rj.Message)
+	} else {
+		common.CountSafe("RejectRcvdOther") // do not let peers create new counters
+	}
+	pr := &PeerReject{Time:time.Now(), Peer:c.PeerAddr.Ip(), Reject:rj}
+
+	if rj.Message=="tx" && rj.Hash!=nil {
+		TxMutex.Lock()
+		if rec, ok := TransactionsToSend[rj.Hash.BIdx()]; ok {
+			pr.Own = rec.Own!=0
+		}
+		TxMutex.Unlock()
+	} else if rj.Message=="block" && rj.Hash!=nil {
+		common.BlockChain.BlockIndexAccess.Lock()
+		node, known := common.BlockChain.BlockIndex[rj.Hash.BIdx()]
+		common.BlockChain.BlockIndexAccess.Unlock()
+		if known {
+			println(c.PeerAddr.Ip(), "rejected block", node.Height, rj.Hash.String(), "-", rj.Reason)
+		}
+	}
+	if common.DebugLevel>0 {
+		println(pr.String())
+	}
+
+	PeerRejectsMutex.Lock()
+	PeerRejects = append(PeerRejects, pr)
+	if len(PeerRejects) > MaxPeerRejects {
+		PeerRejects = PeerRejects[len(PeerRejects)-MaxPeerRejects:]
+	}
+	PeerRejectsMutex.Unlock()
+
+	if pr.Own {
+		select {
+			case NetOwnTxRejects <- pr:
+			default:
+				common.CountSafe("OwnTxRejectDropped")
+		}
+	}
+}
+
+
+// Tells the peer that its block has failed the checks
+func (c *OneConnection) RejectBlock(bl *btc.Block, e error) {
+	c.SendReject("block", protocol.REJECT_INVALID, e.Error(), bl.Hash)
+}
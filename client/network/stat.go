@@ -50,6 +50,12 @@ func (v *OneConnection) Stats() (s string) {
 	} else {
 		s += fmt.Sprintln("Going to", v.PeerAddr.Ip())
 	}
+	if v.Whitelisted {
+		s += fmt.Sprintln("Whitelisted peer")
+	}
+	if v.AddNode {
+		s += fmt.Sprintln("Added node (always reconnected)")
+	}
 	if !v.ConnectedAt.IsZero() {
 		v.Mutex.Lock()
 		s += fmt.Sprintln("Connected at", v.ConnectedAt.Format("2006-01-02 15:04:05"))
@@ -78,6 +84,9 @@ func (v *OneConnection) Stats() (s string) {
 		if len(v.PendingInvs)>0 {
 			s += fmt.Sprintln("Invs to send:", len(v.PendingInvs))
 		}
+		if len(v.PendingTxInvs)>0 {
+			s += fmt.Sprintln("Tx invs to trickle:", len(v.PendingTxInvs), "in", v.NextTxInvs.Sub(time.Now()).String())
+		}
 
 		s += fmt.Sprintln("GetBlockInProgress:", len(v.GetBlockInProgress))
 
@@ -91,6 +100,10 @@ func (v *OneConnection) Stats() (s string) {
 
 		s += fmt.Sprintln(" ->", v.GetAveragePing(), "ms")
 
+		s += fmt.Sprintf("Traffic over the last %s: %d B/s in, %d B/s out\n", TrafficWindowLen.String(),
+			v.TrafficIn.BPS(), v.TrafficOut.BPS())
+		s += TrafficTable(v.MsgTraffic)
+
 		v.Mutex.Unlock()
 	} else {
 		s += fmt.Sprintln("Not yet connected")
@@ -103,7 +116,12 @@ func DropPeer(ip string) {
 	c := Look4conn(ip)
 	if c!=nil {
 		c.DoS("FromUI")
-		fmt.Println("The connection with", c.PeerAddr.Ip(), "is being dropped and the peer is banned")
+		if c.Whitelisted {
+			c.Disconnect()
+			fmt.Println("The connection with", c.PeerAddr.Ip(), "is being dropped (whitelisted peer - not banned)")
+		} else {
+			fmt.Println("The connection with", c.PeerAddr.Ip(), "is being dropped and the peer is banned")
+		}
 	} else {
 		fmt.Println("There is no such an active connection")
 	}
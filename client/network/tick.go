@@ -5,7 +5,6 @@ import (
 	"net"
 	"time"
 	"bytes"
-	"math/rand"
 	"sync/atomic"
 	"github.com/piotrnar/gocoin/client/common"
 )
@@ -81,16 +80,32 @@ func (c *OneConnection) Tick() {
 		return
 	}
 
+	// Need to tell the peer about our new fee rate...?
+	if c.SendFeeFilter() {
+		return
+	}
+
 	// Timeout getdata for blocks in progress, so the map does not grow to infinity
 	for k, v := range c.GetBlockInProgress {
 		if time.Now().After(v.start.Add(GetBlockTimeout)) {
 			common.CountSafe("GetBlockTimeout")
 			c.Mutex.Lock()
 			delete(c.GetBlockInProgress, k)
+			delete(c.CmpctInProgress, k)
 			c.Mutex.Unlock()
 		}
 	}
 
+	// ... and the same for compact blocks waiting for "blocktxn"
+	c.Mutex.Lock()
+	for k, v := range c.CmpctInProgress {
+		if time.Now().After(v.start.Add(GetBlockTimeout)) {
+			common.CountSafe("CmpctTimeout")
+			delete(c.CmpctInProgress, k)
+		}
+	}
+	c.Mutex.Unlock()
+
 	// Need to send getblocks...?
 	if len(c.GetBlockInProgress)==0 && c.getblocksNeeded() {
 		return
@@ -101,9 +116,9 @@ func (c *OneConnection) Tick() {
 }
 
 
-func DoNetwork(ad *onePeer) {
+func DoNetwork(ad *onePeer) (conn *OneConnection) {
 	var e error
-	conn := NewConnection(ad)
+	conn = NewConnection(ad)
 	Mutex_net.Lock()
 	if _, ok := OpenCons[ad.UniqID()]; ok {
 		if common.DebugLevel>0 {
@@ -111,6 +126,7 @@ func DoNetwork(ad *onePeer) {
 		}
 		common.CountSafe("ConnectingAgain")
 		Mutex_net.Unlock()
+		conn = nil
 		return
 	}
 	OpenCons[ad.UniqID()] = conn
@@ -137,6 +153,7 @@ func DoNetwork(ad *onePeer) {
 		Mutex_net.Unlock()
 		ad.Dead()
 	}()
+	return
 }
 
 
@@ -180,11 +197,11 @@ func tcp_server() {
 				}
 				ad, e := NewIncomingPeer(tc.RemoteAddr().String())
 				if e == nil {
-					// Hammering protection
+					// Hammering protection (whitelisted peers are exempt)
 					HammeringMutex.Lock()
 					ti, ok := RecentlyDisconencted[ad.NetAddr.Ip4]
 					HammeringMutex.Unlock()
-					if ok && time.Now().Sub(ti) < HammeringMinReconnect {
+					if ok && time.Now().Sub(ti) < HammeringMinReconnect && !common.IsWhitelisted(ad.Ip4[:]) {
 						//println(ad.Ip(), "is hammering within", time.Now().Sub(ti).String())
 						common.CountSafe("InConnHammer")
 						ad.Ban()
@@ -283,9 +300,16 @@ func NetworkTick() {
 		next_clean_hammers = time.Now().Add(HammeringMinReconnect)
 	}
 
+	addNodesTick()
+
+	Mutex_net.Lock()
+	conn_cnt = OutConsActive
+	Mutex_net.Unlock()
+
 	for conn_cnt < atomic.LoadUint32(&common.CFG.Net.MaxOutCons) {
-		adrs := GetBestPeers(16, true)
-		if len(adrs)==0 {
+		ad := SelectOutboundPeer()
+		if ad==nil {
+			DNSSeedIfNeeded()
 			common.LockCfg()
 			if common.CFG.ConnectOnly=="" && common.DebugLevel>0 {
 				println("no new peers", len(OpenCons), conn_cnt)
@@ -293,7 +317,7 @@ func NetworkTick() {
 			common.UnlockCfg()
 			break
 		}
-		DoNetwork(adrs[rand.Int31n(int32(len(adrs)))])
+		DoNetwork(ad)
 		Mutex_net.Lock()
 		conn_cnt = OutConsActive
 		Mutex_net.Unlock()
@@ -303,6 +327,12 @@ func NetworkTick() {
 
 // Process that handles communication with a single peer
 func (c *OneConnection) Run() {
+	if common.CFG.Net.CaptureAll {
+		if _, e := c.StartCapture(CaptureDir()); e != nil {
+			println("StartCapture:", e.Error())
+		}
+	}
+
 	c.SendVersion()
 
 	c.Mutex.Lock()
@@ -366,9 +396,14 @@ func (c *OneConnection) Run() {
 
 			case "verack":
 				c.VerackReceived = true
+				if !c.Incoming {
+					addrGood(c.PeerAddr)
+				}
 				if common.CFG.Net.ListenTCP {
 					c.SendOwnAddr()
 				}
+				c.SendHeaders()
+				c.SendCmpct()
 
 			case "inv":
 				c.ProcessInv(cmd.pl)
@@ -379,7 +414,7 @@ func (c *OneConnection) Run() {
 				}
 
 			case "addr":
-				ParseAddr(cmd.pl)
+				c.ParseAddr(cmd.pl)
 
 			case "block": //block received
 				netBlockReceived(c, cmd.pl)
@@ -416,12 +451,50 @@ func (c *OneConnection) Run() {
 			case "notfound":
 				common.CountSafe("NotFound")
 
+			case "reject":
+				c.HandleReject(cmd.pl)
+
+			case "sendheaders":
+				c.HandleSendHeaders()
+
+			case "headers":
+				c.HandleHeaders(cmd.pl)
+
+			case "sendcmpct":
+				c.HandleSendCmpct(cmd.pl)
+
+			case "cmpctblock":
+				c.HandleCmpctBlock(cmd.pl)
+
+			case "getblocktxn":
+				c.GetBlockTxn(cmd.pl)
+
+			case "blocktxn":
+				c.HandleBlockTxn(cmd.pl)
+
+			case "feefilter":
+				c.HandleFeeFilter(cmd.pl)
+
+			case "mempool":
+				c.HandleMempool()
+
+			case "getcfilters":
+				c.GetCFilters(cmd.pl)
+
+			case "getcfheaders":
+				c.GetCFHeaders(cmd.pl)
+
+			case "getcfcheckpt":
+				c.GetCFCheckpt(cmd.pl)
+
 			default:
 				if common.DebugLevel>0 {
 					println(cmd.cmd, "from", c.PeerAddr.Ip())
 				}
 		}
 	}
+	DropPeerOrphans(c)
+	c.StopCapture()
 	c.Mutex.Lock()
 	ban := c.banit
 	c.Mutex.Unlock()
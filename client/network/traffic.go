@@ -0,0 +1,159 @@
+package network
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+const (
+	TrafficSlotSecs = 10
+	TrafficSlots = 30 // so the sliding window covers the last 5 minutes
+	TrafficWindowLen = TrafficSlotSecs*TrafficSlots*time.Second
+)
+
+// Bytes counted over a sliding window of time
+type TrafficWindow struct {
+	slots [TrafficSlots]uint64
+	last int64 // the most recent slot
+}
+
+// Traffic of one message type
+type MsgTraffic struct {
+	InCnt, OutCnt uint64
+	InBytes, OutBytes uint64
+	In, Out TrafficWindow
+}
+
+var (
+	HistoricalBlockAge = 7*24*time.Hour // such old blocks are not served when over the upload quota
+
+	// Traffic of all the peers, by message type:
+	MsgTrafficAll map[string] *MsgTraffic = make(map[string] *MsgTraffic)
+	TrafficMutex sync.Mutex
+
+	// Only these commands get their own counters - the rest goes into "other"
+	trafficCmds = map[string] bool {"version":true, "verack":true, "addr":true, "inv":true,
+		"getdata":true, "notfound":true, "getblocks":true, "getheaders":true, "tx":true,
+		"block":true, "headers":true, "getaddr":true, "mempool":true, "ping":true, "pong":true,
+		"reject":true, "alert":true, "sendheaders":true, "feefilter":true, "sendcmpct":true,
+		"cmpctblock":true, "getblocktxn":true, "blocktxn":true, "getcfilters":true, "cfilter":true}
+)
+
+
+// Moves the window to the current slot, zeroing the slots that have passed
+func (w *TrafficWindow) move(now int64) {
+	slot := now/TrafficSlotSecs
+	if slot-w.last >= TrafficSlots {
+		w.slots = [TrafficSlots]uint64{}
+	} else {
+		for w.last < slot {
+			w.last++
+			w.slots[w.last%TrafficSlots] = 0
+		}
+	}
+	w.last = slot
+}
+
+
+func (w *TrafficWindow) Add(n uint64) {
+	w.move(time.Now().Unix())
+	w.slots[w.last%TrafficSlots] += n
+}
+
+
+// Returns number of bytes within the window
+func (w *TrafficWindow) Sum() (sum uint64) {
+	w.move(time.Now().Unix())
+	for i := range w.slots {
+		sum += w.slots[i]
+	}
+	return
+}
+
+
+// Returns the average speed within the window, in bytes per second
+func (w *TrafficWindow) BPS() uint64 {
+	return w.Sum() / uint64(TrafficWindowLen/time.Second)
+}
+
+
+func (t *MsgTraffic) add(out bool, n uint64) {
+	if out {
+		t.OutCnt++
+		t.OutBytes += n
+		t.Out.Add(n)
+	} else {
+		t.InCnt++
+		t.InBytes += n
+		t.In.Add(n)
+	}
+}
+
+
+// Counts a message sent to (out) or received from the peer. n includes the message header.
+// Make sure to call it with locked c.Mutex
+func (c *OneConnection) countTraffic(out bool, cmd string, n int) {
+	if !trafficCmds[cmd] {
+		cmd = "other"
+	}
+	if out {
+		c.TrafficOut.Add(uint64(n))
+	} else {
+		c.TrafficIn.Add(uint64(n))
+	}
+	t := c.MsgTraffic[cmd]
+	if t == nil {
+		t = new(MsgTraffic)
+		c.MsgTraffic[cmd] = t
+	}
+	t.add(out, uint64(n))
+
+	TrafficMutex.Lock()
+	if t = MsgTrafficAll[cmd]; t == nil {
+		t = new(MsgTraffic)
+		MsgTrafficAll[cmd] = t
+	}
+	t.add(out, uint64(n))
+	TrafficMutex.Unlock()
+}
+
+
+// Returns the message types of the map, sorted by name
+func SortedCmds(m map[string] *MsgTraffic) (res []string) {
+	res = make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return
+}
+
+
+// Returns a text table with the traffic by message type
+func TrafficTable(m map[string] *MsgTraffic) (s string) {
+	s = fmt.Sprintf("%-12s %8s %10s %8s   %8s %10s %8s\n", "Message", "In", "Bytes", "B/s", "Out", "Bytes", "B/s")
+	for _, cmd := range SortedCmds(m) {
+		t := m[cmd]
+		s += fmt.Sprintf("%-12s %8d %10d %8d   %8d %10d %8d\n", cmd, t.InCnt, t.InBytes, t.In.BPS(),
+			t.OutCnt, t.OutBytes, t.Out.BPS())
+	}
+	return
+}
+
+
+// Returns true if we should not serve the block to the peer, because of the upload quota.
+// Only blocks older than HistoricalBlockAge (comparing to our top block) are held back.
+func (c *OneConnection) blockOverQuota(bl []byte) bool {
+	if c.Whitelisted || len(bl)<80 || !common.UploadQuotaExceeded() {
+		return false
+	}
+	common.Last.Mutex.Lock()
+	top := common.Last.Block.Timestamp()
+	common.Last.Mutex.Unlock()
+	ts := binary.LittleEndian.Uint32(bl[68:72])
+	return int64(ts) < int64(top) - int64(HistoricalBlockAge/time.Second)
+}
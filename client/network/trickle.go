@@ -0,0 +1,102 @@
+package network
+
+import (
+	"math"
+	"sync"
+	"time"
+	"math/rand"
+	"github.com/piotrnar/gocoin/client/common"
+)
+
+/*
+Tx invs are not sent right away, but queued for each peer and "trickled" at random
+(Poisson distributed) intervals, in a random order. This way it is hard to tell
+which node has been the first to announce a tx, so our own txs look just like the
+ones that we relay.
+All the inbound peers share one timer (otherwise an attacker could just open many
+connections to us), with a longer average delay. Outbound peers have their own timers.
+*/
+
+const (
+	MaxTxInvsQueued = 5000 // per peer
+	MaxTxInvsAtOnce = 1000 // in one "inv" message (the rest waits for the next round)
+)
+
+var (
+	TxInvDelayIn = 5*time.Second // average interval of sending tx invs to inbound peers
+	TxInvDelayOut = 2*time.Second // average interval of sending tx invs to each outbound peer
+
+	nextInboundTxInvs time.Time
+	inboundTxInvsMutex sync.Mutex
+)
+
+
+// Returns a random interval from the exponential distribution, so the events come as a Poisson process
+func poissonDelay(avg time.Duration) time.Duration {
+	return time.Duration(-math.Log(1.0-rand.Float64()) * float64(avg))
+}
+
+
+// Sets the time when the peer's queued tx invs are to be sent next.
+// Make sure to call it with locked c.Mutex
+func (c *OneConnection) setNextTxInvs(now time.Time) {
+	if c.Incoming {
+		inboundTxInvsMutex.Lock()
+		if !nextInboundTxInvs.After(now) {
+			nextInboundTxInvs = now.Add(poissonDelay(TxInvDelayIn))
+		}
+		c.NextTxInvs = nextInboundTxInvs
+		inboundTxInvsMutex.Unlock()
+	} else {
+		c.NextTxInvs = now.Add(poissonDelay(TxInvDelayOut))
+	}
+}
+
+
+// Queues the inv for the peer - block invs go with the next tick, tx invs get trickled.
+// Returns false if the tx queue is full.
+// Call this function only when v.Mutex is locked
+func (v *OneConnection) QueueInv(typ uint32, inv *[36]byte) bool {
+	if typ!=1 {
+		v.PendingInvs = append(v.PendingInvs, inv)
+		return true
+	}
+	if len(v.PendingTxInvs)>=MaxTxInvsQueued {
+		common.CountSafe("SendTxInvQueueFull")
+		return false
+	}
+	if v.NextTxInvs.IsZero() {
+		v.setNextTxInvs(time.Now())
+	}
+	v.PendingTxInvs = append(v.PendingTxInvs, inv)
+	return true
+}
+
+
+// Returns the queued tx invs, if it is time to send them (in a random order).
+// Call this function only when c.Mutex is locked
+func (c *OneConnection) trickleTxInvs() (res []*[36]byte) {
+	now := time.Now()
+	if c.NextTxInvs.IsZero() || now.Before(c.NextTxInvs) {
+		return
+	}
+	// the timer keeps running even when there is nothing to send,
+	// so the first tx after a quiet period does not go out right away
+	c.setNextTxInvs(now)
+	if len(c.PendingTxInvs)==0 {
+		return
+	}
+	for i := range c.PendingTxInvs {
+		j := rand.Intn(i+1)
+		c.PendingTxInvs[i], c.PendingTxInvs[j] = c.PendingTxInvs[j], c.PendingTxInvs[i]
+	}
+	if len(c.PendingTxInvs) > MaxTxInvsAtOnce {
+		res = c.PendingTxInvs[:MaxTxInvsAtOnce]
+		c.PendingTxInvs = c.PendingTxInvs[MaxTxInvsAtOnce:]
+	} else {
+		res = c.PendingTxInvs
+		c.PendingTxInvs = nil
+	}
+	common.CountSafeAdd("SendTxInvTrickled", uint64(len(res)))
+	return
+}
@@ -7,7 +7,9 @@ import (
 	"sync/atomic"
 	"encoding/hex"
 	"github.com/piotrnar/gocoin/btc"
+	"github.com/piotrnar/gocoin/protocol"
 	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/policy"
 )
 
 
@@ -18,6 +20,12 @@ const (
 	TX_REJECTED_FORMAT       = 102
 	TX_REJECTED_LEN_MISMATCH = 103
 	TX_REJECTED_EMPTY_INPUT  = 104
+	TX_REJECTED_NONSTD_VERSION = policy.NONSTD_VERSION
+	TX_REJECTED_SCRIPTSIG_SIZE = policy.SCRIPTSIG_SIZE
+	TX_REJECTED_SCRIPTSIG_PUSH = policy.SCRIPTSIG_PUSH
+	TX_REJECTED_SCRIPTPUBKEY   = policy.SCRIPTPUBKEY
+	TX_REJECTED_BARE_MULTISIG  = policy.BARE_MULTISIG
+	TX_REJECTED_DATACARRIER    = policy.DATACARRIER
 
 	TX_REJECTED_DOUBLE_SPEND = 201
 	TX_REJECTED_NO_TXOU      = 202
@@ -27,6 +35,9 @@ const (
 	TX_REJECTED_SCRIPT_FAIL  = 206
 	TX_REJECTED_BAD_INPUT    = 207
 	TX_REJECTED_NOT_MINED    = 208
+	TX_REJECTED_CHAIN_LIMIT  = 209
+	TX_REJECTED_REPLACED     = 210
+	TX_REJECTED_NOT_FINAL    = 211
 )
 
 var (
@@ -49,6 +60,9 @@ var (
 	TransactionsPending map[[btc.Uint256IdxLen]byte] bool =
 		make(map[[btc.Uint256IdxLen]byte] bool)
 
+	// Orphaned blocks, whose txs are to be returned to the pool:
+	DisconnectedBlocks []*btc.Block
+
 	// Transactions that are waiting for inputs:
 	WaitingForInputs map[[btc.Uint256IdxLen]byte] *OneWaitingList =
 		make(map[[btc.Uint256IdxLen]byte] *OneWaitingList)
@@ -59,11 +73,30 @@ type OneTxToSend struct {
 	Data []byte
 	Invsentcnt, SentCnt uint
 	Firstseen, Lastsent time.Time
+	LastInvSent time.Time // for re-broadcasting own txs
+	EntryHeight uint32 // chain height when it came from the network (for the fee estimator)
+	SendWhenFinal bool // own tx that has been broadcast, but it was not final yet
+	Whitelisted bool // received from a whitelisted peer, so routed regardless of its fee
 	Own byte // 0-not own, 1-own and OK, 2-own but with UNKNOWN input
 	Spent []uint64 // Which records in SpentOutputs this TX added
+	PrevOuts []*btc.TxOut // outputs spent by the tx (nil where unknown) - for reporting double spends
 	Volume, Fee, Minout uint64
 	*btc.Tx
 	Blocked byte // if non-zero, it gives you the reason why this tx nas not been routed
+	feeIdx int // position in txsByFee (-1 if not there)
+
+	// In-pool txs that this one spends from and the ones spending from it:
+	Parents, Children map[[btc.Uint256IdxLen]byte] *OneTxToSend
+	// Totals of the tx together with all its in-pool ancestors / descendants:
+	AncCnt, DescCnt uint
+	AncSize, DescSize uint64
+	AncFee, DescFee uint64
+}
+
+
+// Returns the fee rate in satoshis per 1000 bytes
+func (t *OneTxToSend) SPKB() uint64 {
+	return 1000*t.Fee/uint64(len(t.Data))
 }
 
 
@@ -125,6 +158,7 @@ func (c *OneConnection) TxInvNotify(hash []byte) {
 // Make sure to call it with locked TxMutex.
 // Returns the OneTxRejected or nil if it has not been added.
 func RejectTx(id *btc.Uint256, size int, why byte) *OneTxRejected {
+	deleteRejected(id.BIdx()) // an orphan that gets rejected again must not leave its Wait4Input behind
 	rec := new(OneTxRejected)
 	rec.Id = id
 	rec.Time = time.Now()
@@ -143,26 +177,29 @@ func (c *OneConnection) ParseTxNet(pl []byte) {
 		if uint32(len(pl)) > atomic.LoadUint32(&common.CFG.TXPool.MaxTxSize) {
 			common.CountSafe("TxTooBig")
 			RejectTx(tid, len(pl), TX_REJECTED_TOO_BIG)
+			c.sendTxReject(tid, TX_REJECTED_TOO_BIG)
 			return
 		}
-		tx, le := btc.NewTx(pl)
-		if tx == nil {
-			RejectTx(tid, len(pl), TX_REJECTED_FORMAT)
-			c.DoS("TxBroken")
-			return
-		}
-		if le != len(pl) {
+		tx, e := protocol.ParseTx(pl)
+		if e == protocol.ErrTxLength {
 			RejectTx(tid, len(pl), TX_REJECTED_LEN_MISMATCH)
+			c.sendTxReject(tid, TX_REJECTED_LEN_MISMATCH)
 			c.DoS("TxLenMismatch")
 			return
 		}
-		if len(tx.TxIn)<1 {
+		if e == protocol.ErrTxNoInputs {
 			RejectTx(tid, len(pl), TX_REJECTED_EMPTY_INPUT)
+			c.sendTxReject(tid, TX_REJECTED_EMPTY_INPUT)
 			c.DoS("TxNoInputs")
 			return
 		}
+		if e != nil {
+			RejectTx(tid, len(pl), TX_REJECTED_FORMAT)
+			c.sendTxReject(tid, TX_REJECTED_FORMAT)
+			c.DoS("TxBroken")
+			return
+		}
 
-		tx.Hash = tid
 		select {
 			case NetTxs <- &TxRcvd{conn:c, tx:tx, raw:pl}:
 				TransactionsPending[tid.BIdx()] = true
@@ -186,6 +223,20 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 	var totinp, totout uint64
 	var frommem bool
 
+	if !retry && ntx.conn!=nil {
+		defer func() {
+			if !accepted {
+				// let the peer know why (BIP61)
+				TxMutex.Lock()
+				rec := TransactionsRejected[tx.Hash.BIdx()]
+				TxMutex.Unlock()
+				if rec!=nil {
+					ntx.conn.sendTxReject(tx.Hash, rec.Reason)
+				}
+			}
+		}()
+	}
+
 	TxMutex.Lock()
 
 	if !retry {
@@ -202,18 +253,30 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 		deleteRejected(tx.Hash.BIdx())
 	}
 
+	if reason := policy.IsStandard(tx, PolicyConfig()); reason!=0 {
+		RejectTx(ntx.tx.Hash, len(ntx.raw), reason)
+		TxMutex.Unlock()
+		common.CountSafe("TxRejectedNonStd")
+		return
+	}
+
+	if !IsFinalNow(tx) {
+		RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_NOT_FINAL)
+		TxMutex.Unlock()
+		common.CountSafe("TxRejectedNotFinal")
+		return
+	}
+
 	pos := make([]*btc.TxOut, len(tx.TxIn))
 	spent := make([]uint64, len(tx.TxIn))
+	conflicts := make(map[[btc.Uint256IdxLen]byte] *OneTxToSend)
 
 	// Check if all the inputs exist in the chain
 	for i := range tx.TxIn {
 		spent[i] = tx.TxIn[i].Input.UIdx()
 
-		if _, ok := SpentOutputs[spent[i]]; ok {
-			RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_DOUBLE_SPEND)
-			TxMutex.Unlock()
-			common.CountSafe("TxRejectedDoubleSpend")
-			return
+		if k, ok := SpentOutputs[spent[i]]; ok {
+			conflicts[k] = TransactionsToSend[k] // it may be a replacement (BIP125)
 		}
 
 		inptx := btc.NewUint256(tx.TxIn[i].Input.Hash[:])
@@ -242,9 +305,7 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 				missingid := btc.NewUint256(tx.TxIn[i].Input.Hash[:])
 				nrtx := RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_NO_TXOU)
 
-				if nrtx != nil {
-					nrtx.Wait4Input = &Wait4Input{missingTx: missingid, TxRcvd: ntx}
-
+				if nrtx != nil && addOrphan(nrtx, missingid, ntx) {
 					// Add to waiting list:
 					var rec *OneWaitingList
 					if rec, _ = WaitingForInputs[nrtx.Wait4Input.missingTx.BIdx()]; rec==nil {
@@ -255,6 +316,7 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 					}
 					rec.Ids[tx.Hash.BIdx()] = time.Now()
 					WaitingForInputs[nrtx.Wait4Input.missingTx.BIdx()] = rec
+					limitOrphans()
 				}
 
 				TxMutex.Unlock()
@@ -288,51 +350,98 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 	if totout > totinp {
 		RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_OVERSPEND)
 		TxMutex.Unlock()
-		ntx.conn.DoS("TxOverspend")
+		if !retry {
+			ntx.conn.DoS("TxOverspend") // orphans get penalized in RetryWaitingForInput
+		}
 		return
 	}
 
-	// Check for a proper fee
+	// Check for a proper fee (txs from whitelisted peers are taken regardless)
 	fee := totinp - totout
-	if fee < (uint64(len(ntx.raw)) * atomic.LoadUint64(&common.CFG.TXPool.FeePerByte)) {
+	whitelisted := ntx.conn!=nil && ntx.conn.Whitelisted
+	if !whitelisted && 1000*fee < uint64(len(ntx.raw)) * MinFeeSPKB() {
 		RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_LOW_FEE)
 		TxMutex.Unlock()
 		common.CountSafe("TxRejectedLowFee")
 		return
 	}
 
+	// Check if it can replace the txs it double spends
+	// (if not, it gets rejected after verifying the scripts, so only a signed tx is reported)
+	var torem map[[btc.Uint256IdxLen]byte] *OneTxToSend
+	var dsreason byte
+	if len(conflicts)>0 {
+		if !common.CFG.TXPool.AllowRBF {
+			dsreason = TX_REJECTED_DOUBLE_SPEND
+		} else {
+			torem, dsreason = checkReplacement(tx, len(ntx.raw), fee, conflicts, false)
+		}
+	}
+
+	// Check if it would not make too long chain of unconfirmed txs
+	if frommem && !chainLimitsOK(poolParents(tx), len(ntx.raw)) {
+		RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_CHAIN_LIMIT)
+		TxMutex.Unlock()
+		common.CountSafe("TxRejectedChainLimit")
+		return
+	}
+
 	// Verify scripts
 	for i := range tx.TxIn {
 		if !btc.VerifyTxScript(tx.TxIn[i].ScriptSig, pos[i].Pk_script, i, tx, true) {
 			RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_SCRIPT_FAIL)
 			TxMutex.Unlock()
-			ntx.conn.DoS("TxScriptFail")
+			if !retry {
+				ntx.conn.DoS("TxScriptFail")
+			}
 			return
 		}
 	}
 
-	rec := &OneTxToSend{Data:ntx.raw, Spent:spent, Volume:totinp, Fee:fee, Firstseen:time.Now(), Tx:tx, Minout:minout}
-	TransactionsToSend[tx.Hash.BIdx()] = rec
+	for _, c := range conflicts {
+		doubleSpendSeen(c, tx, false)
+	}
+	if dsreason!=0 {
+		RejectTx(ntx.tx.Hash, len(ntx.raw), dsreason)
+		TxMutex.Unlock()
+		common.CountSafe("TxRejectedDoubleSpend")
+		return
+	}
+
+	if torem!=nil {
+		for _, c := range conflicts {
+			ReplaceToSend(c)
+		}
+		common.CountSafe("TxAcceptedRBF")
+	}
+
+	rec := &OneTxToSend{Data:ntx.raw, Spent:spent, Volume:totinp, Fee:fee, Firstseen:time.Now(), Tx:tx, Minout:minout,
+		Whitelisted:whitelisted, PrevOuts:pos}
+	if !retry {
+		rec.EntryHeight = common.BlockChain.BlockTreeEnd.Height
+	}
+	AddToSend(rec)
 	for i := range spent {
 		SpentOutputs[spent[i]] = tx.Hash.BIdx()
 	}
 
+	// Make room for it, if the pool has grown too big
+	limitPoolSize()
+	if _, ok := TransactionsToSend[tx.Hash.BIdx()]; !ok {
+		RejectTx(ntx.tx.Hash, len(ntx.raw), TX_REJECTED_LOW_FEE)
+		TxMutex.Unlock()
+		common.CountSafe("TxRejectedPoolFull")
+		return
+	}
+
 	wtg := WaitingForInputs[tx.Hash.BIdx()]
 	if wtg != nil {
 		defer RetryWaitingForInput(wtg) // Redo waiting txs when leaving this function
 	}
 
-	TxMutex.Unlock()
 	common.CountSafe("TxAccepted")
-
-	if frommem {
-		// Gocoin does not route txs that need unconfirmed inputs
-		rec.Blocked = TX_REJECTED_NOT_MINED
-		common.CountSafe("TxRouteNotMined")
-	} else if isRoutable(rec) {
-		rec.Invsentcnt += NetRouteInv(1, tx.Hash, ntx.conn)
-		common.CountSafe("TxRouteOK")
-	}
+	routeToSend(rec, ntx.conn)
+	TxMutex.Unlock()
 
 	accepted = true
 	return
@@ -350,7 +459,9 @@ func isRoutable(rec *OneTxToSend) bool {
 		rec.Blocked = TX_REJECTED_TOO_BIG
 		return false
 	}
-	if rec.Fee < (uint64(len(rec.Data))*atomic.LoadUint64(&common.CFG.TXRoute.FeePerByte)) {
+	// Descendants in the pool can pay for a low fee parent
+	minfee := 1000*atomic.LoadUint64(&common.CFG.TXRoute.FeePerByte)
+	if !rec.Whitelisted && rec.SPKB() < minfee && rec.DescSPKB() < minfee {
 		common.CountSafe("TxRouteLowFee")
 		rec.Blocked = TX_REJECTED_LOW_FEE
 		return false
@@ -377,17 +488,24 @@ func RetryWaitingForInput(wtg *OneWaitingList) {
 			if common.DebugLevel>0 {
 				fmt.Println(pendtxrcv.tx.Hash.String(), "still rejected", TransactionsRejected[k].Reason)
 			}
+			if invalidTx(TransactionsRejected[k].Reason) {
+				pendtxrcv.conn.Misbehave("TxOrphanInvalid", OrphanInvalidBanScore)
+			}
 		}
 	}
 }
 
 
-// Make sure to call it with locked TxMutex
-func deleteToSend(rec *OneTxToSend) {
-	for i := range rec.Spent {
-		delete(SpentOutputs, rec.Spent[i])
-	}
-	delete(TransactionsToSend, rec.Tx.Hash.BIdx())
+// Returns true if the tx can be mined in the next block
+func IsFinalNow(tx *btc.Tx) bool {
+	return tx.IsFinal(common.BlockChain.BlockTreeEnd.Height+1, uint32(time.Now().Unix()))
+}
+
+
+// Returns the standardness policy, as set in the config
+func PolicyConfig() *policy.Config {
+	return &policy.Config{BareMultisig:common.CFG.TXPool.BareMultisig, DataCarrier:common.CFG.TXPool.DataCarrier,
+		DataCarrierSize:int(common.CFG.TXPool.DataCarrierSize)}
 }
 
 
@@ -397,7 +515,8 @@ func TxMined(tx *btc.Tx) {
 	TxMutex.Lock()
 	if rec, ok := TransactionsToSend[h.BIdx()]; ok {
 		common.CountSafe("TxMinedToSend")
-		deleteToSend(rec)
+		feeEstMined(rec, common.BlockChain.BlockTreeEnd.Height)
+		removeToSend(rec) // its children stay in the pool
 	}
 	if _, ok := TransactionsRejected[h.BIdx()]; ok {
 		common.CountSafe("TxMinedRejected")
@@ -415,11 +534,11 @@ func TxMined(tx *btc.Tx) {
 			if rec, _ := TransactionsToSend[val]; rec != nil {
 				if rec.Own!=0 {
 					common.CountSafe("TxMinedMalleabled")
-					NetAlerts <- fmt.Sprint("Input from own ", rec.Tx.Hash.String(), " mined in ", tx.Hash.String())
 				} else {
 					common.CountSafe("TxMinedOtherSpend")
 				}
-				deleteToSend(rec)
+				doubleSpendSeen(rec, tx, true)
+				DeleteToSend(rec)
 			} else {
 				common.CountSafe("TxMinedSpentERROR")
 				NetAlerts <- fmt.Sprint("WTF? Input from ", rec.Tx.Hash.String(), " in mem-spent, but tx not in the mem-pool")
@@ -439,6 +558,58 @@ func TxMined(tx *btc.Tx) {
 }
 
 
+// Called by the chain for each block that gets orphaned
+func blockDisconnected(bl *btc.Block) {
+	TxMutex.Lock()
+	DisconnectedBlocks = append(DisconnectedBlocks, bl)
+	TxMutex.Unlock()
+	common.CountSafe("BlockDisconnected")
+}
+
+
+// Puts the txs from orphaned blocks back into the memory pool, so they get re-mined.
+// Must be called from the chain's thread
+func ReturnDisconnectedTxs() {
+	TxMutex.Lock()
+	bls := DisconnectedBlocks
+	DisconnectedBlocks = nil
+	TxMutex.Unlock()
+
+	if !common.CFG.TXPool.Enabled {
+		return
+	}
+
+	// Blocks get disconnected from the top, so do the oldest one first
+	for i:=len(bls)-1; i>=0; i-- {
+		for _, tx := range bls[i].Txs[1:] {
+			TxMutex.Lock()
+			_, inpool := TransactionsToSend[tx.Hash.BIdx()]
+			if !inpool {
+				for j := range tx.TxIn {
+					h := btc.NewUint256(tx.TxIn[j].Input.Hash[:])
+					if _, ok := TransactionsToSend[h.BIdx()]; !ok {
+						if o, _ := common.BlockChain.Unspent.UnspentGet(&tx.TxIn[j].Input); o==nil {
+							inpool = true // spent in the new branch already (or its coinbase is gone)
+							break
+						}
+					}
+				}
+			}
+			TxMutex.Unlock()
+			if inpool {
+				common.CountSafe("TxReorgSkipped")
+				continue
+			}
+			if HandleNetTx(&TxRcvd{tx:tx, raw:tx.Serialize()}, true) {
+				common.CountSafe("TxReorgReturned")
+			} else {
+				common.CountSafe("TxReorgRejected")
+			}
+		}
+	}
+}
+
+
 func txChecker(h *btc.Uint256) bool {
 	TxMutex.Lock()
 	rec, ok := TransactionsToSend[h.BIdx()]
@@ -457,6 +628,7 @@ func txChecker(h *btc.Uint256) bool {
 
 func init() {
 	btc.TrustedTxChecker = txChecker
+	btc.BlockDisconnected = blockDisconnected
 }
 
 
@@ -476,6 +648,7 @@ func expireTime(size int) (t time.Time) {
 func deleteRejected(bidx [btc.Uint256IdxLen]byte) {
 	if tr, ok := TransactionsRejected[bidx]; ok {
 		if tr.Wait4Input!=nil {
+			orphanRemoved(tr.Wait4Input)
 			w4i, _ := WaitingForInputs[tr.Wait4Input.missingTx.BIdx()]
 			delete(w4i.Ids, bidx)
 			if len(w4i.Ids)==0 {
@@ -493,7 +666,7 @@ func ExpireTxs() {
 	TxMutex.Lock()
 	for _, v := range TransactionsToSend {
 		if v.Own==0 && v.Firstseen.Before(expireTime(len(v.Data))) {  // Do not expire own txs
-			deleteToSend(v)
+			DeleteToSend(v)
 			if v.Blocked==0 {
 				cnt1a++
 			} else {
@@ -0,0 +1,127 @@
+// Standardness rules for transactions that the node accepts to its memory pool
+// and relays. Consensus rules stay in the btc package; these ones are just
+// what the miners are willing to mine.
+package policy
+
+import (
+	"github.com/piotrnar/gocoin/btc"
+)
+
+const (
+	MAX_STANDARD_VERSION = 1
+	MAX_SCRIPTSIG_SIZE = 1650 // enough for a P2SH 15-of-15 multisig spend
+	MAX_MULTISIG_KEYS = 3 // bare multisig outputs can have up to 3 keys
+
+	// Output script types:
+	TX_NONSTANDARD = 0
+	TX_PUBKEY = 1
+	TX_PUBKEYHASH = 2
+	TX_SCRIPTHASH = 3
+	TX_MULTISIG = 4
+	TX_NULL_DATA = 5
+
+	// Rejection reasons - the values are used as client's network.TX_REJECTED_* codes
+	NONSTD_VERSION   = 105
+	SCRIPTSIG_SIZE   = 106
+	SCRIPTSIG_PUSH   = 107
+	SCRIPTPUBKEY     = 108
+	BARE_MULTISIG    = 109
+	DATACARRIER      = 110
+)
+
+// Adjustable parts of the policy
+type Config struct {
+	BareMultisig bool // relay txs with bare (non-P2SH) multisig outputs
+	DataCarrier bool // relay txs with an OP_RETURN output
+	DataCarrierSize int // max size of the OP_RETURN output script
+}
+
+
+func isPubKey(d []byte) bool {
+	return len(d)==33 && (d[0]==2 || d[0]==3) || len(d)==65 && d[0]==4
+}
+
+
+// Returns the type of the given output script.
+// For TX_MULTISIG it also returns the number of the keys.
+func ScriptType(pk []byte) (typ int, keys int) {
+	if len(pk)==25 && pk[0]==0x76/*OP_DUP*/ && pk[1]==btc.OP_HASH160 && pk[2]==20 &&
+		pk[23]==0x88/*OP_EQUALVERIFY*/ && pk[24]==0xac/*OP_CHECKSIG*/ {
+		return TX_PUBKEYHASH, 0
+	}
+	if btc.IsP2SH(pk) {
+		return TX_SCRIPTHASH, 0
+	}
+	if len(pk)>0 && pk[len(pk)-1]==0xac/*OP_CHECKSIG*/ && int(pk[0])==len(pk)-2 && isPubKey(pk[1:len(pk)-1]) {
+		return TX_PUBKEY, 0
+	}
+	if len(pk)>0 && pk[0]==0x6a/*OP_RETURN*/ {
+		if btc.IsPushOnly(pk[1:]) {
+			return TX_NULL_DATA, 0
+		}
+		return TX_NONSTANDARD, 0
+	}
+	if len(pk)>=3 && pk[len(pk)-1]==btc.OP_CHECKMULTISIG {
+		m, n := int(pk[0])-btc.OP_1+1, int(pk[len(pk)-2])-btc.OP_1+1
+		if m<1 || n<m || n>16 {
+			return TX_NONSTANDARD, 0
+		}
+		idx := 1
+		for i:=0; i<n; i++ {
+			if idx >= len(pk)-2 {
+				return TX_NONSTANDARD, 0
+			}
+			_, dat, le, e := btc.GetOpcode(pk[idx:len(pk)-2])
+			if e!=nil || !isPubKey(dat) {
+				return TX_NONSTANDARD, 0
+			}
+			idx += le
+		}
+		if idx!=len(pk)-2 {
+			return TX_NONSTANDARD, 0
+		}
+		return TX_MULTISIG, n
+	}
+	return TX_NONSTANDARD, 0
+}
+
+
+// Checks if the transaction is standard. Returns zero if it is, or the reason why not.
+func IsStandard(tx *btc.Tx, cfg *Config) byte {
+	if tx.Version<1 || tx.Version>MAX_STANDARD_VERSION {
+		return NONSTD_VERSION
+	}
+
+	for i := range tx.TxIn {
+		if len(tx.TxIn[i].ScriptSig) > MAX_SCRIPTSIG_SIZE {
+			return SCRIPTSIG_SIZE
+		}
+		if !btc.IsPushOnly(tx.TxIn[i].ScriptSig) {
+			return SCRIPTSIG_PUSH
+		}
+	}
+
+	var nulldata int
+	for i := range tx.TxOut {
+		typ, keys := ScriptType(tx.TxOut[i].Pk_script)
+		switch typ {
+			case TX_NONSTANDARD:
+				return SCRIPTPUBKEY
+
+			case TX_MULTISIG:
+				if keys > MAX_MULTISIG_KEYS {
+					return SCRIPTPUBKEY
+				}
+				if !cfg.BareMultisig {
+					return BARE_MULTISIG
+				}
+
+			case TX_NULL_DATA:
+				nulldata++
+				if !cfg.DataCarrier || nulldata>1 || len(tx.TxOut[i].Pk_script) > cfg.DataCarrierSize {
+					return DATACARRIER
+				}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,58 @@
+package policy
+
+import (
+	"testing"
+	"encoding/hex"
+	"github.com/piotrnar/gocoin/btc"
+)
+
+func TestScriptType(t *testing.T) {
+	var tst = []struct {
+		scr string
+		typ, keys int
+	} {
+		{"76a91489abcdefabbaabbaabbaabbaabbaabbaabbaabba88ac", TX_PUBKEYHASH, 0},
+		{"a91489abcdefabbaabbaabbaabbaabbaabbaabbaabba87", TX_SCRIPTHASH, 0},
+		{"21021111111111111111111111111111111111111111111111111111111111111111ac", TX_PUBKEY, 0},
+		{"6a0401020304", TX_NULL_DATA, 0},
+		{"6aac", TX_NONSTANDARD, 0},
+		{"5121021111111111111111111111111111111111111111111111111111111111111111" +
+			"2103111111111111111111111111111111111111111111111111111111111111111121021111" +
+			"11111111111111111111111111111111111111111111111111111111111153ae", TX_MULTISIG, 3},
+		{"51ae", TX_NONSTANDARD, 0},
+	}
+	for i := range tst {
+		d, _ := hex.DecodeString(tst[i].scr)
+		if typ, keys := ScriptType(d); typ!=tst[i].typ || keys!=tst[i].keys {
+			t.Error("Bad type of", tst[i].scr, typ, keys)
+		}
+	}
+}
+
+
+func TestIsStandard(t *testing.T) {
+	cfg := &Config{BareMultisig:true, DataCarrier:true, DataCarrierSize:83}
+	p2sh, _ := hex.DecodeString("a91489abcdefabbaabbaabbaabbaabbaabbaabbaabba87")
+	tx := &btc.Tx{Version:1, TxIn:[]*btc.TxIn{&btc.TxIn{ScriptSig:[]byte{1, 1}}},
+		TxOut:[]*btc.TxOut{&btc.TxOut{Pk_script:p2sh}, &btc.TxOut{Pk_script:[]byte{0x6a, 1, 1}}}}
+	if r := IsStandard(tx, cfg); r!=0 {
+		t.Error("Should be standard", r)
+	}
+
+	tx.TxOut = append(tx.TxOut, &btc.TxOut{Pk_script:[]byte{0x6a}})
+	if r := IsStandard(tx, cfg); r!=DATACARRIER {
+		t.Error("Two OP_RETURN outputs", r)
+	}
+	tx.TxOut = tx.TxOut[:2]
+
+	tx.TxIn[0].ScriptSig = []byte{0xac}
+	if r := IsStandard(tx, cfg); r!=SCRIPTSIG_PUSH {
+		t.Error("Not push only", r)
+	}
+	tx.TxIn[0].ScriptSig = []byte{1, 1}
+
+	tx.Version = 2
+	if r := IsStandard(tx, cfg); r!=NONSTD_VERSION {
+		t.Error("Bad version", r)
+	}
+}
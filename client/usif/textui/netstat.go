@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"sort"
 	"time"
+	"strings"
 	"github.com/piotrnar/gocoin/client/network"
 	"github.com/piotrnar/gocoin/client/common"
 )
@@ -73,7 +74,16 @@ func net_stats(par string) {
 		if v.Send.Buf !=nil {
 			fmt.Print("  ", len(v.Send.Buf))
 		}
+		if v.Whitelisted {
+			fmt.Print("  WL")
+		}
+		if v.AddNode {
+			fmt.Print("  ADDNODE")
+		}
 		v.Mutex.Unlock()
+		if v.Capturing() {
+			fmt.Print("  CAP")
+		}
 		fmt.Println()
 	}
 
@@ -103,8 +113,97 @@ func net_stats(par string) {
 }
 
 
+func list_banned(par string) {
+	bans := network.GetBans()
+	if len(bans)==0 {
+		fmt.Println("Nothing is banned")
+		return
+	}
+	for i := range bans {
+		fmt.Printf("%4d) %s\n", i+1, bans[i].String())
+	}
+}
+
+
+func net_capture(par string) {
+	ps := strings.Fields(par)
+	if len(ps)<1 || len(ps)>2 || len(ps)==2 && ps[1]!="off" {
+		fmt.Println("Specify: <connid> [off]")
+		return
+	}
+	c := network.Look4conn(ps[0])
+	if c == nil {
+		fmt.Println("There is no such an active connection")
+		return
+	}
+	if len(ps)==2 {
+		c.StopCapture()
+		fmt.Println("Capture of", c.PeerAddr.Ip(), "stopped")
+		return
+	}
+	fn, e := c.StartCapture(network.CaptureDir())
+	if e != nil {
+		fmt.Println(e.Error())
+		return
+	}
+	fmt.Println("Capturing messages of", c.PeerAddr.Ip(), "into", fn)
+}
+
+
+func list_addnodes(par string) {
+	ans := network.GetAddNodes()
+	if len(ans)==0 {
+		fmt.Println("No nodes in Net.AddNodes")
+		return
+	}
+	for i := range ans {
+		fmt.Printf("%4d) %s\n", i+1, ans[i])
+	}
+}
+
+
+func set_ban(par string) {
+	ps := strings.Fields(par)
+	if len(ps)<2 || (ps[0]!="add" && ps[0]!="remove") {
+		fmt.Println("Specify: add|remove <ip/subnet> [<duration>]")
+		return
+	}
+	ip4, bits, e := network.ParseSubnet(ps[1])
+	if e != nil {
+		fmt.Println(e.Error())
+		return
+	}
+	if ps[0]=="remove" {
+		if !network.RemoveBan(ip4, bits) {
+			fmt.Println(ps[1], "is not banned")
+		}
+		return
+	}
+	var durs string
+	if len(ps)>2 {
+		durs = ps[2]
+	}
+	dur, e := network.ParseBanTime(durs)
+	if e != nil {
+		fmt.Println(e.Error())
+		return
+	}
+	network.SetBan(ip4, bits, dur)
+}
+
+
+func clear_banned(par string) {
+	fmt.Println(network.ClearBans(), "ban(s) removed")
+}
+
+
 func init() {
 	newUi("net n", false, net_stats, "Show network statistics. Specify ID to see its details.")
 	newUi("drop", false, net_drop, "Disconenct from node with a given IP")
 	newUi("conn", false, net_conn, "Connect to the given node (specify IP and optionally a port)")
+	newUi("listbanned", false, list_banned, "List the banned IPs and subnets")
+	newUi("setban", false, set_ban, "Ban or unban IP / subnet: add|remove <ip/subnet> [<duration> - e.g. 3600, 48h or forever]")
+	newUi("clearbanned", false, clear_banned, "Remove all the bans")
+	newUi("capture", false, net_capture, "Capture messages of the given connection into a file: <connid> [off]")
+	newUi("addnodes", false, list_addnodes, "Show state of the peers that we always stay connected to")
 }
@@ -167,8 +167,8 @@ func show_info(par string) {
 	fmt.Printf("TransactionsToSend:%d,  TransactionsRejected:%d,  TransactionsPending:%d/%d\n",
 		len(network.TransactionsToSend), len(network.TransactionsRejected),
 		len(network.TransactionsPending), len(network.NetTxs))
-	fmt.Printf("WaitingForInputs:%d,  SpentOutputs:%d,  Hashrate:%s\n",
-		len(network.WaitingForInputs), len(network.SpentOutputs), usif.GetNetworkHashRate())
+	fmt.Printf("WaitingForInputs:%d (%d txs),  SpentOutputs:%d,  Hashrate:%s\n",
+		len(network.WaitingForInputs), network.OrphanCnt, len(network.SpentOutputs), usif.GetNetworkHashRate())
 	network.TxMutex.Unlock()
 
 	common.PrintStats()
@@ -325,6 +325,101 @@ func dump_block(s string) {
 }
 
 
+func merkle_proof(par string) {
+	ps := strings.Split(par, " ")
+	if len(ps)!=2 {
+		fmt.Println("Specify block's hash and the txid")
+		return
+	}
+	h := btc.NewUint256FromString(ps[0])
+	txid := btc.NewUint256FromString(ps[1])
+	if h==nil || txid==nil {
+		fmt.Println("Specify block's hash and the txid")
+		return
+	}
+	dat, _, e := common.BlockChain.Blocks.BlockGet(h)
+	if e != nil {
+		println(e.Error())
+		return
+	}
+	bl, e := btc.NewBlock(dat)
+	if e != nil {
+		println(e.Error())
+		return
+	}
+	if e = bl.BuildTxList(); e != nil {
+		println(e.Error())
+		return
+	}
+
+	idx := -1
+	txids := make([][]byte, len(bl.Txs))
+	matches := make([]bool, len(bl.Txs))
+	for i := range bl.Txs {
+		txids[i] = bl.Txs[i].Hash.Hash[:]
+		if bl.Txs[i].Hash.Equal(txid) {
+			idx = i
+			matches[i] = true
+		}
+	}
+	if idx == -1 {
+		fmt.Println("Transaction", txid.String(), "is not in block", h.String())
+		return
+	}
+
+	mb, e := bl.GetMerkleBranch(idx)
+	if e != nil {
+		println(e.Error())
+		return
+	}
+	fmt.Println("Tx", txid.String(), "is at index", idx, "of", len(bl.Txs), "in block", h.String())
+	fmt.Println("Merkle root:", btc.NewUint256(bl.MerkleRoot()).String())
+	for i := range mb.Hashes {
+		fmt.Printf("%4d) %s\n", i, btc.NewUint256(mb.Hashes[i]).String())
+	}
+	fmt.Println("Proof verified:", mb.Verify(bl.MerkleRoot()))
+	fmt.Println("Merkle branch:", hex.EncodeToString(mb.Bytes()))
+	fmt.Println("BIP37 partial tree:", hex.EncodeToString(btc.NewPartialMerkleTree(txids, matches).Bytes()))
+	fmt.Println("Block header:", hex.EncodeToString(bl.Raw[:80]))
+}
+
+
+// Checks the wallet's addresses against compact filters of the recent blocks
+func cfilter_scan(par string) {
+	if wallet.MyWallet==nil {
+		fmt.Println("No wallet loaded")
+		return
+	}
+	var scrs [][]byte
+	for i := range wallet.MyWallet.Addrs {
+		if scr := wallet.MyWallet.Addrs[i].OutScript(); scr!=nil {
+			scrs = append(scrs, scr)
+		}
+	}
+	cnt := uint64(100)
+	if par!="" {
+		if v, e := strconv.ParseUint(par, 10, 32); e==nil {
+			cnt = v
+		}
+	}
+	common.Last.Mutex.Lock()
+	n := common.Last.Block
+	common.Last.Mutex.Unlock()
+	var matched int
+	for ; n!=nil && cnt>0; cnt-- {
+		yes, e := common.BlockChain.MatchBlockFilter(n.BlockHash, scrs)
+		if e != nil {
+			fmt.Println(n.Height, n.BlockHash.String(), e.Error())
+		} else if yes {
+			fmt.Println(n.Height, n.BlockHash.String(), "matches")
+			matched++
+		}
+		n = n.Parent
+	}
+	fmt.Println(matched, "block(s) may contain any of the", len(scrs), "wallet's scripts")
+}
+
+
 func ui_quit(par string) {
 	usif.Exit_now = true
 }
@@ -508,26 +603,19 @@ func show_balance_stats(p string) {
 
 func show_addresses(par string) {
 	fmt.Println(network.PeerDB.Count(), "peers in the database")
+	newcnt, triedcnt := network.AddrManStats()
+	fmt.Println(newcnt, "in the new table,", triedcnt, "in the tried table")
 	if par=="list" {
 		cnt :=  0
 		network.PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
-			cnt++
-			fmt.Printf("%4d) %s\n", cnt, network.NewPeer(v).String())
-			return 0
-		})
-	} else if par=="ban" {
-		cnt :=  0
-		network.PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
-			pr := network.NewPeer(v)
-			if pr.Banned != 0 {
+			if network.IsPeerKey(k) {
 				cnt++
-				fmt.Printf("%4d) %s\n", cnt, pr.String())
+				fmt.Printf("%4d) %s\n", cnt, network.NewPeer(v).String())
 			}
 			return 0
 		})
-		if cnt==0 {
-			fmt.Println("No banned peers in the DB")
-		}
+	} else if par=="ban" {
+		list_banned("")
 	} else if par != "" {
 		limit, er := strconv.ParseUint(par, 10, 32)
 		if er != nil {
@@ -701,6 +789,7 @@ func init() {
 	newUi("balstat", true, show_balance_stats, "Show balance cache statistics")
 	newUi("bchain b", true, blchain_stats, "Display blockchain statistics")
 	newUi("cache", false, show_cached, "Show blocks cached in memory")
+	newUi("cfscan", false, cfilter_scan, "Check wallet's addresses against compact filters of last blocks (default 100)")
 	newUi("configload cl", false, load_config, "Re-load settings from the common file")
 	newUi("configsave cs", false, save_config, "Save current settings to a common file")
 	newUi("configset cfg", false, set_config, "Set a specific common value - use JSON, omit top {}")
@@ -710,6 +799,7 @@ func init() {
 	newUi("dlimit dl", false, set_dlmax, "Set maximum download speed. The value is in KB/second - 0 for unlimited")
 	newUi("help h ?", false, show_help, "Shows this help")
 	newUi("info i", false, show_info, "Shows general info about the node")
+	newUi("merkle mp", false, merkle_proof, "Print merkle proof of a tx in a block (specify <block_hash> <txid>)")
 	newUi("mem", false, show_mem, "Show detailed memory stats (optionally free, gc or a numeric param)")
 	newUi("peers", false, show_addresses, "Dump pers database (warning: may be long)")
 	newUi("qdbstats qs", false, qdb_stats, "Show statistics of QDB engine")
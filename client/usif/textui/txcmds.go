@@ -4,6 +4,7 @@ import (
 	"os"
 	"fmt"
 	"time"
+	"strconv"
 	"github.com/piotrnar/gocoin/btc"
 	"github.com/piotrnar/gocoin/client/usif"
 	"github.com/piotrnar/gocoin/client/network"
@@ -38,9 +39,17 @@ func send_tx(par string) {
 	}
 	network.TxMutex.Lock()
 	if ptx, ok := network.TransactionsToSend[txid.BIdx()]; ok {
+		if reason := network.ReplaceConflicts(ptx); reason!=0 {
+			network.TxMutex.Unlock()
+			fmt.Println("TxID", txid.String(), "cannot replace the transactions it double spends - reason", reason)
+			return
+		}
+		cnt := network.RouteOwnTx(ptx)
 		network.TxMutex.Unlock()
-		cnt := network.NetRouteInv(1, txid, nil)
-		ptx.Invsentcnt += cnt
+		if ptx.SendWhenFinal {
+			fmt.Println("TxID", txid.String(), "is not final yet - it will be sent when it becomes final")
+			return
+		}
 		fmt.Println("INV for TxID", txid.String(), "sent to", cnt, "node(s)")
 		fmt.Println("If it does not appear in the chain, you may want to redo it.")
 	} else {
@@ -60,6 +69,11 @@ func send1_tx(par string) {
 	}
 	network.TxMutex.Lock()
 	if ptx, ok := network.TransactionsToSend[txid.BIdx()]; ok {
+		if reason := network.ReplaceConflicts(ptx); reason!=0 {
+			network.TxMutex.Unlock()
+			fmt.Println("TxID", txid.String(), "cannot replace the transactions it double spends - reason", reason)
+			return
+		}
 		network.TxMutex.Unlock()
 		usif.SendInvToRandomPeer(1, txid)
 		ptx.Invsentcnt++
@@ -81,13 +95,14 @@ func del_tx(par string) {
 		return
 	}
 	network.TxMutex.Lock()
-	if _, ok := network.TransactionsToSend[txid.BIdx()]; !ok {
+	tx, ok := network.TransactionsToSend[txid.BIdx()]
+	if !ok {
 		network.TxMutex.Unlock()
 		fmt.Println("No such transaction ID in the memory pool.")
 		list_txs("")
 		return
 	}
-	delete(network.TransactionsToSend, txid.BIdx())
+	network.DeleteToSend(tx)
 	network.TxMutex.Unlock()
 	fmt.Println("Transaction", txid.String(), "removed from the memory pool")
 }
@@ -153,14 +168,64 @@ func send_all_tx(par string) {
 	network.TxMutex.Lock()
 	for k, v := range network.TransactionsToSend {
 		if v.Own!=0 {
-			cnt := network.NetRouteInv(1, btc.NewUint256(k[:]), nil)
-			v.Invsentcnt += cnt
-			fmt.Println("INV for TxID", v.Hash.String(), "sent to", cnt, "node(s)")
+			cnt := network.RouteOwnTx(v)
+			if v.SendWhenFinal {
+				fmt.Println("TxID", v.Hash.String(), "is not final yet - it will be sent when it becomes final")
+			} else {
+				fmt.Println("INV for TxID", btc.NewUint256(k[:]).String(), "sent to", cnt, "node(s)")
+			}
 		}
 	}
 	network.TxMutex.Unlock()
 }
 
+func mining_txs(par string) {
+	maxsize := uint64(btc.MAX_BLOCK_SIZE-1000) // leave some space for the header and coinbase
+	if par!="" {
+		if n, e := strconv.ParseUint(par, 10, 32); e==nil && n>0 {
+			maxsize = n
+		}
+	}
+	txs, totfee := network.GetMiningTxs(maxsize)
+	var size uint64
+	for i, v := range txs {
+		size += uint64(len(v.Data))
+		fmt.Printf("%5d) %s - %d bytes - %.3f SPB, with ancestors %.3f SPB (%d)\n", i+1, v.Tx.Hash.String(),
+			len(v.Data), float64(v.SPKB())/1000, float64(v.AncSPKB())/1000, v.AncCnt)
+	}
+	fmt.Println(len(txs), "txs,", size, "bytes, paying", btc.UintToBtc(totfee), "BTC in fees")
+}
+
+
+func show_fee_est(par string) {
+	fmt.Println("Fee rates needed to get a tx mined within given number of blocks:")
+	for _, n := range []int{1, 2, 3, 6, 12, network.FeeEstMaxTarget} {
+		if spkb := network.EstimateFee(n); spkb!=0 {
+			fmt.Printf("%5d block(s) : %.3f SPB\n", n, float64(spkb)/1000)
+		} else {
+			fmt.Printf("%5d block(s) : not enough data\n", n)
+		}
+	}
+}
+
+
+func double_spends(par string) {
+	usif.DoubleSpendMutex.Lock()
+	defer usif.DoubleSpendMutex.Unlock()
+	if len(usif.DoubleSpends)==0 {
+		fmt.Println("No double spends seen")
+		return
+	}
+	for _, ds := range usif.DoubleSpends {
+		fmt.Println(ds.Time.Format("2006-01-02 15:04:05"), ds.String())
+		for i := range ds.Wallet {
+			fmt.Printf("   %s  %.8f BTC @ %s\n", ds.Wallet[i].TxPrevOut.String(),
+				float64(ds.Wallet[i].Value)/1e8, ds.Wallet[i].BtcAddr.String())
+		}
+	}
+}
+
+
 func init () {
 	newUi("txload tx", true, load_tx, "Load transaction data from the given file, decode it and store in memory")
 	newUi("txsend stx", true, send_tx, "Broadcast transaction from memory pool (identified by a given <txid>)")
@@ -170,4 +235,7 @@ func init () {
 	newUi("txdecode td", true, dec_tx, "Decode a transaction from memory pool (identified by a given <txid>)")
 	newUi("txlist ltx", true, list_txs, "List all the transaction loaded into memory pool")
 	newUi("txlistban ltxb", true, baned_txs, "List the transaction that we have rejected")
+	newUi("txfees fee", false, show_fee_est, "Show estimated fee rates for getting a transaction mined quickly")
+	newUi("txdblspend dbl", false, double_spends, "List the recently seen double spends of memory pool transactions")
+	newUi("txmining mtx", true, mining_txs, "List the transactions that would go into a new block (optionally specify max size)")
 }
@@ -5,11 +5,14 @@ import (
 	"time"
 	"sync"
 	"errors"
+	"os/exec"
 	"math/rand"
 	"encoding/hex"
 	"encoding/binary"
 	"github.com/piotrnar/gocoin/btc"
 	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/policy"
+	"github.com/piotrnar/gocoin/client/wallet"
 	"github.com/piotrnar/gocoin/client/network"
 )
 
@@ -25,6 +28,16 @@ var (
 
 	Exit_now bool
 	DefragBlocksDB bool
+
+	// Recent double spends (newest last):
+	DoubleSpends []*network.DoubleSpend
+	DoubleSpendMutex sync.Mutex
+	// Notification hook, called from its own goroutine for each double spend:
+	DoubleSpendHook func(*network.DoubleSpend) = runDoubleSpendCmd
+)
+
+const (
+	MaxDoubleSpends = 100 // how many recent double spends to remember
 )
 
 
@@ -112,12 +125,28 @@ func LoadRawTx(buf []byte) (s string) {
 		return
 	}
 
+	if reason := policy.IsStandard(tx, network.PolicyConfig()); reason!=0 {
+		s += fmt.Sprintln("WARNING: The transaction is not standard (reason", reason, ") - it may not get relayed nor mined.")
+	}
+
+	if !network.IsFinalNow(tx) {
+		s += fmt.Sprintln("WARNING: The transaction is not final yet - if you send it, it will be queued until it is.")
+	}
+
+	// Own txs can replace other versions (e.g. paying a higher fee), but only once they get sent
+	for _, c := range network.Conflicts(tx) {
+		s += fmt.Sprintln("WARNING: It double spends TxID", c.Tx.Hash.String(), "- when sent, it will try to replace it (BIP125).")
+		if !c.Replaceable() {
+			s += fmt.Sprintln("WARNING: The conflicting transaction did not signal RBF - it cannot be replaced.")
+		}
+	}
+
 	if missinginp {
-		network.TransactionsToSend[tx.Hash.BIdx()] = &network.OneTxToSend{Tx:tx, Data:txd, Own:2, Firstseen:time.Now(),
-			Volume:totout}
+		network.AddToSend(&network.OneTxToSend{Tx:tx, Data:txd, Own:2, Firstseen:time.Now(),
+			Volume:totout})
 	} else {
-		network.TransactionsToSend[tx.Hash.BIdx()] = &network.OneTxToSend{Tx:tx, Data:txd, Own:1, Firstseen:time.Now(),
-			Volume:totinp, Fee:totinp-totout}
+		network.AddToSend(&network.OneTxToSend{Tx:tx, Data:txd, Own:1, Firstseen:time.Now(),
+			Volume:totinp, Fee:totinp-totout})
 	}
 	s += fmt.Sprintln("Transaction added to the memory pool. Please double check its details above.")
 	s += fmt.Sprintln("If it does what you intended, you can send it the network.\nUse TxID:", tx.Hash.String())
@@ -133,14 +162,14 @@ func SendInvToRandomPeer(typ uint32, h *btc.Uint256) {
 	binary.LittleEndian.PutUint32(inv[0:4], typ)
 	copy(inv[4:36], h.Bytes())
 
-	// Append it to PendingInvs in a random connection
+	// Queue it in a random connection
 	network.Mutex_net.Lock()
 	idx := rand.Intn(len(network.OpenCons))
 	var cnt int
 	for _, v := range network.OpenCons {
 		if idx==cnt {
 			v.Mutex.Lock()
-			v.PendingInvs = append(v.PendingInvs, inv)
+			v.QueueInv(typ, inv)
 			v.Mutex.Unlock()
 			break
 		}
@@ -151,6 +180,60 @@ func SendInvToRandomPeer(typ uint32, h *btc.Uint256) {
 }
 
 
+// Called from the main thread for each double spend reported by the network
+func DoubleSpend(ds *network.DoubleSpend) {
+	// The outputs may be already gone from the balance (if the other tx got mined),
+	// so check the addresses of the spent outputs, as taken by the network.
+	ins := make(map[btc.TxPrevOut] bool, len(ds.Inputs))
+	wallet.LockBal()
+	for i := range ds.Inputs {
+		if i<len(ds.PrevOuts) && ds.PrevOuts[i]!=nil {
+			if ad := wallet.WalletAddr(ds.PrevOuts[i].Pk_script); ad!=nil {
+				ds.Wallet = append(ds.Wallet, &btc.OneUnspentTx{TxPrevOut:ds.Inputs[i],
+					Value:ds.PrevOuts[i].Value, MinedAt:ds.PrevOuts[i].BlockHeight, BtcAddr:ad})
+			}
+		} else {
+			ins[ds.Inputs[i]] = true
+		}
+	}
+	for i := range wallet.MyBalance {
+		if ins[wallet.MyBalance[i].TxPrevOut] {
+			ds.Wallet = append(ds.Wallet, wallet.MyBalance[i])
+		}
+	}
+	wallet.UnlockBal()
+
+	DoubleSpendMutex.Lock()
+	DoubleSpends = append(DoubleSpends, ds)
+	if len(DoubleSpends) > MaxDoubleSpends {
+		DoubleSpends = DoubleSpends[len(DoubleSpends)-MaxDoubleSpends:]
+	}
+	DoubleSpendMutex.Unlock()
+
+	if DoubleSpendHook!=nil {
+		go DoubleSpendHook(ds)
+	}
+}
+
+
+// Executes TXPool.DoubleSpendCmd from the config (if set) with the arguments:
+// txid conflicting_txid mined(true/false) own(true/false) wallet_value(satoshis)
+func runDoubleSpendCmd(ds *network.DoubleSpend) {
+	if common.CFG.TXPool.DoubleSpendCmd=="" {
+		return
+	}
+	var val uint64
+	for i := range ds.Wallet {
+		val += ds.Wallet[i].Value
+	}
+	cmd := exec.Command(common.CFG.TXPool.DoubleSpendCmd, ds.TxID.String(), ds.ConflictID.String(),
+		fmt.Sprint(ds.Mined), fmt.Sprint(ds.Own), fmt.Sprint(val))
+	if e := cmd.Run(); e != nil {
+		println("DoubleSpendCmd:", e.Error())
+	}
+}
+
+
 func GetNetworkHashRate() string {
 	hours := common.CFG.HashrateHours
 	common.Last.Mutex.Lock()
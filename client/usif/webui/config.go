@@ -88,6 +88,35 @@ func p_cfg(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(r.Form["setban"])>0 {
+		ip4, bits, e := network.ParseSubnet(r.Form["setban"][0])
+		if e == nil {
+			var durs string
+			if len(r.Form["bantime"])>0 {
+				durs = r.Form["bantime"][0]
+			}
+			if dur, e := network.ParseBanTime(durs); e == nil {
+				network.SetBan(ip4, bits, dur)
+			}
+		}
+		http.Redirect(w, r, "net", http.StatusFound)
+		return
+	}
+
+	if len(r.Form["unban"])>0 {
+		if ip4, bits, e := network.ParseSubnet(r.Form["unban"][0]); e == nil {
+			network.RemoveBan(ip4, bits)
+		}
+		http.Redirect(w, r, "net", http.StatusFound)
+		return
+	}
+
+	if len(r.Form["clearbans"])>0 {
+		network.ClearBans()
+		http.Redirect(w, r, "net", http.StatusFound)
+		return
+	}
+
 	if len(r.Form["savecfg"])>0 {
 		dat, _ := json.Marshal(&common.CFG)
 		if dat != nil {
@@ -37,6 +37,19 @@ func p_home(w http.ResponseWriter, r *http.Request) {
 	}
 	wallet.UnlockBal()
 
+	network.PeerRejectsMutex.Lock()
+	var ownrej int
+	for _, pr := range network.PeerRejects {
+		if pr.Own {
+			ownrej++
+		}
+	}
+	network.PeerRejectsMutex.Unlock()
+	if ownrej>0 {
+		s = strings.Replace(s, "<!--OWN_TX_REJECTS-->", fmt.Sprint("<br><b style=\"color:red\">Your transactions have been rejected by peers ",
+			ownrej, " time(s)</b> - see <a href=\"txs\">Transactions</a>"), 1)
+	}
+
 	common.Last.Mutex.Lock()
 	s = strings.Replace(s, "{LAST_BLOCK_HASH}", common.Last.Block.BlockHash.String(), 1)
 	s = strings.Replace(s, "{LAST_BLOCK_HEIGHT}", fmt.Sprint(common.Last.Block.Height), 1)
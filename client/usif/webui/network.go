@@ -35,6 +35,29 @@ func p_net(w http.ResponseWriter, r *http.Request) {
 	net_page = strings.Replace(net_page, "{LISTEN_TCP}", fmt.Sprint(common.CFG.Net.ListenTCP, network.TCPServerStarted), 1)
 	net_page = strings.Replace(net_page, "{EXTERNAL_ADDR}", btc.NewNetAddr(network.BestExternalAddr()).String(), 1)
 
+	common.LockBw()
+	common.TickSent()
+	if common.CFG.Net.UploadQuotaMB!=0 {
+		qs := fmt.Sprint("<b>", common.BytesToString(common.UlQuota.Bytes), "</b> uploaded this month, out of <b>",
+			common.CFG.Net.UploadQuotaMB, " MB</b> quota")
+		if common.UlQuota.Bytes >= uint64(common.CFG.Net.UploadQuotaMB)<<20 {
+			qs += " - <b style=\"color:red\">exceeded</b> (historical blocks are not served)"
+		}
+		net_page = strings.Replace(net_page, "<!--UPLOAD_QUOTA-->", qs+"<br>", 1)
+	}
+	if len(common.CFG.Net.BwSchedule)>0 {
+		var ss string
+		for i, p := range common.CFG.Net.BwSchedule {
+			pe := fmt.Sprint(p.From, "-", p.To, " ", p.MaxUpKBps, "/", p.MaxDownKBps, " KB/s")
+			if i==common.BwPeriodActive {
+				pe = "<b>" + pe + "</b>"
+			}
+			ss += " &nbsp;" + pe
+		}
+		net_page = strings.Replace(net_page, "<!--BW_SCHEDULE-->", "Bandwidth schedule (up/down):"+ss+"<br>", 1)
+	}
+	common.UnlockBw()
+
 	for idx := range srt {
 		v := network.OpenCons[srt[idx].Key]
 		s := net_row
@@ -48,6 +71,12 @@ func p_net(w http.ResponseWriter, r *http.Request) {
 		}
 
 		s = strings.Replace(s, "{PEER_ADDR}", v.PeerAddr.Ip(), 1)
+		if v.Whitelisted {
+			s = strings.Replace(s, "<!--PEER_FLAGS-->", "<b title=\"Whitelisted\">W</b><!--PEER_FLAGS-->", 1)
+		}
+		if v.AddNode {
+			s = strings.Replace(s, "<!--PEER_FLAGS-->", "<b title=\"Added node\">A</b>", 1)
+		}
 		s = strings.Replace(s, "{PERR_PING}", fmt.Sprint(v.GetAveragePing()), 1)
 		s = strings.Replace(s, "{LAST_RCVD_LEN}", fmt.Sprint(v.LastBtsRcvd), 1)
 		s = strings.Replace(s, "{LAST_RCVD_CMD}", v.LastCmdRcvd, 1)
@@ -55,6 +84,8 @@ func p_net(w http.ResponseWriter, r *http.Request) {
 		s = strings.Replace(s, "{LAST_SENT_CNT}", v.LastCmdSent, 1)
 		s = strings.Replace(s, "{TOTAL_RCVD}", common.BytesToString(v.BytesReceived), 1)
 		s = strings.Replace(s, "{TOTAL_SENT}", common.BytesToString(v.BytesSent), 1)
+		s = strings.Replace(s, "{AVG_RCVD}", fmt.Sprint(v.TrafficIn.BPS()>>10), 1)
+		s = strings.Replace(s, "{AVG_SENT}", fmt.Sprint(v.TrafficOut.BPS()>>10), 1)
 		s = strings.Replace(s, "{NODE_VERSION}", fmt.Sprint(v.Node.Version), 1)
 		s = strings.Replace(s, "{USER_AGENT}", v.Node.Agent, 1)
 		if v.Send.Buf != nil {
@@ -70,6 +101,31 @@ func p_net(w http.ResponseWriter, r *http.Request) {
 	}
 	network.Mutex_net.Unlock()
 
+	network.TrafficMutex.Lock()
+	for _, cmd := range network.SortedCmds(network.MsgTrafficAll) {
+		t := network.MsgTrafficAll[cmd]
+		s := fmt.Sprintf("<tr class=\"hov\"><td>%s<td align=\"right\">%d<td align=\"right\">%s<td align=\"right\">%d"+
+			"<td align=\"right\">%d<td align=\"right\">%s<td align=\"right\">%d", cmd,
+			t.InCnt, common.BytesToString(t.InBytes), t.In.BPS(), t.OutCnt, common.BytesToString(t.OutBytes), t.Out.BPS())
+		net_page = templ_add(net_page, "<!--TRAFFIC_ROW-->", s)
+	}
+	network.TrafficMutex.Unlock()
+	net_page = strings.Replace(net_page, "{TRAFFIC_WINDOW}", network.TrafficWindowLen.String(), -1)
+
+	bans := network.GetBans()
+	net_page = strings.Replace(net_page, "{BANS_CNT}", fmt.Sprint(len(bans)), 1)
+	for i := range bans {
+		s := "<tr class=\"hov\"><td>" + bans[i].Subnet() + "<td>" + bans[i].Period() +
+			"<td align=\"center\"><a href=\"javascript:net_unban('" + bans[i].Subnet() + "')\">Remove</a>"
+		net_page = templ_add(net_page, "<!--BAN_ROW-->", s)
+	}
+
+	ans := network.GetAddNodes()
+	net_page = strings.Replace(net_page, "{ADDNODES_CNT}", fmt.Sprint(len(ans)), 1)
+	for i := range ans {
+		net_page = templ_add(net_page, "<!--ADDNODE_ROW-->", "<tr class=\"hov\"><td>" + ans[i])
+	}
+
 	write_html_head(w, r)
 	w.Write([]byte(net_page))
 	write_html_tail(w)
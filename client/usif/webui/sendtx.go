@@ -11,6 +11,7 @@ import (
 	"encoding/hex"
 	"github.com/piotrnar/gocoin/btc"
 	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/network"
 	"github.com/piotrnar/gocoin/client/wallet"
 )
 
@@ -242,12 +243,20 @@ func p_snd(w http.ResponseWriter, r *http.Request) {
 
 	s := load_template("send.html")
 
+	var feeest string
+	for _, n := range []int{1, 3, 6, 12} {
+		if spkb := network.EstimateFee(n); spkb!=0 {
+			feeest += fmt.Sprintf("<option value=\"%d\">%d block(s) - %.3f SPB</option>", spkb, n, float64(spkb)/1000)
+		}
+	}
+
 	wallet.LockBal()
 	if wallet.MyWallet!=nil && len(wallet.MyBalance)>0 {
 		wal := load_template("send_wal.html")
 		row_tmp := load_template("send_wal_row.html")
 		wal = strings.Replace(wal, "{TOTAL_BTC}", fmt.Sprintf("%.8f", float64(wallet.LastBalance)/1e8), 1)
 		wal = strings.Replace(wal, "{UNSPENT_OUTS}", fmt.Sprint(len(wallet.MyBalance)), -1)
+		wal = strings.Replace(wal, "<!--FEE_ESTIMATES-->", feeest, 1)
 		for i := range wallet.MyBalance {
 			row := row_tmp
 			row = strings.Replace(row, "{WALLET_FILE}", html.EscapeString(wallet.MyBalance[i].BtcAddr.Extra.Wallet), 1)
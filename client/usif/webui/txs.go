@@ -5,6 +5,7 @@ import (
 	"time"
 	"sync"
 	"strings"
+	"html"
 	"net/http"
 	"io/ioutil"
 	"encoding/hex"
@@ -63,9 +64,67 @@ func p_txs(w http.ResponseWriter, r *http.Request) {
 	s = strings.Replace(s, "{PTR2_CNT}", fmt.Sprint(len(network.NetTxs)), 1)
 	s = strings.Replace(s, "{SPENT_OUTS_CNT}", fmt.Sprint(len(network.SpentOutputs)), 1)
 	s = strings.Replace(s, "{AWAITING_INPUTS}", fmt.Sprint(len(network.WaitingForInputs)), 1)
+	s = strings.Replace(s, "{ORPHAN_CNT}", fmt.Sprint(network.OrphanCnt), 1)
+	s = strings.Replace(s, "{ORPHAN_LIMIT}", fmt.Sprint(common.CFG.TXPool.MaxOrphans), 1)
+	if common.MaxMempoolSize!=0 {
+		s = strings.Replace(s, "{T2S_LIMIT}", common.BytesToString(common.MaxMempoolSize), 1)
+	} else {
+		s = strings.Replace(s, "{T2S_LIMIT}", "no limit", 1)
+	}
+	s = strings.Replace(s, "{T2S_MIN_FEE}", fmt.Sprintf("%.3f", float64(network.MinFeeSPKB())/1000), 1)
+	s = strings.Replace(s, "{EVICTED_CNT}", fmt.Sprint(network.EvictedTxs), 1)
+	s = strings.Replace(s, "{EVICTED_SIZE}", common.BytesToString(network.EvictedBytes), 1)
+	if !network.LastEviction.IsZero() {
+		s = strings.Replace(s, "<!--LAST_EVICTION-->", fmt.Sprintf("last at %.3f SPB, %s ago",
+			float64(network.LastEvictedSPKB)/1000, time.Now().Sub(network.LastEviction).String()), 1)
+	}
 
 	network.TxMutex.Unlock()
 
+	usif.DoubleSpendMutex.Lock()
+	s = strings.Replace(s, "{DBLSPEND_CNT}", fmt.Sprint(len(usif.DoubleSpends)), 1)
+	for i:=len(usif.DoubleSpends)-1; i>=0; i-- {
+		ds := usif.DoubleSpends[i]
+		row := "<tr><td>" + ds.Time.Format("2006-01-02 15:04:05") + "<td class=\"mono\">" + ds.TxID.String()
+		if ds.Own {
+			row += " (own)"
+		}
+		row += "<br>" + ds.ConflictID.String()
+		if ds.Mined {
+			row += " (mined)"
+		}
+		row += "<td align=\"right\">" + fmt.Sprint(len(ds.Inputs)) + "<td class=\"mono\">"
+		for j := range ds.Wallet {
+			row += fmt.Sprintf("%.8f @ %s<br>", float64(ds.Wallet[j].Value)/1e8, ds.Wallet[j].BtcAddr.String())
+		}
+		s = templ_add(s, "<!--DBLSPEND_ROW-->", row)
+	}
+	usif.DoubleSpendMutex.Unlock()
+
+	var ownrej int
+	network.PeerRejectsMutex.Lock()
+	for i:=len(network.PeerRejects)-1; i>=0; i-- {
+		pr := network.PeerRejects[i]
+		var row string
+		if pr.Own {
+			row = "<tr class=\"own\" title=\"Your own transaction\">"
+			ownrej++
+		} else {
+			row = "<tr>"
+		}
+		row += "<td>" + pr.Time.Format("2006-01-02 15:04:05") + "<td>" + pr.Peer + "<td>" + html.EscapeString(pr.Message) + "<td class=\"mono\">"
+		if pr.Hash != nil {
+			row += pr.Hash.String()
+		}
+		row += fmt.Sprintf("<td align=\"right\">0x%02x<td>%s", pr.Code, html.EscapeString(pr.Reason))
+		s = templ_add(s, "<!--PEERREJ_ROW-->", row)
+	}
+	s = strings.Replace(s, "{PEERREJ_CNT}", fmt.Sprint(len(network.PeerRejects)), 1)
+	network.PeerRejectsMutex.Unlock()
+	if ownrej>0 {
+		s = strings.Replace(s, "<!--OWN_REJECTS-->", fmt.Sprint("<b style=\"color:red\">", ownrej, " of own tx</b>"), 1)
+	}
+
 	wg.Wait()
 	if txloadresult!="" {
 		ld := load_template("txs_load.html")
@@ -157,7 +216,9 @@ func xml_txs2s(w http.ResponseWriter, r *http.Request) {
 			tid := btc.NewUint256FromString(r.Form["del"][0])
 			if tid!=nil {
 				network.TxMutex.Lock()
-				delete(network.TransactionsToSend, tid.BIdx())
+				if ptx, ok := network.TransactionsToSend[tid.BIdx()]; ok {
+					network.DeleteToSend(ptx)
+				}
 				network.TxMutex.Unlock()
 			}
 		}
@@ -167,10 +228,9 @@ func xml_txs2s(w http.ResponseWriter, r *http.Request) {
 			if tid!=nil {
 				network.TxMutex.Lock()
 				if ptx, ok := network.TransactionsToSend[tid.BIdx()]; ok {
-					network.TxMutex.Unlock()
-					cnt := network.NetRouteInv(1, tid, nil)
-					ptx.Invsentcnt += cnt
+					network.RouteOwnTx(ptx)
 				}
+				network.TxMutex.Unlock()
 			}
 		}
 
@@ -178,10 +238,12 @@ func xml_txs2s(w http.ResponseWriter, r *http.Request) {
 			tid := btc.NewUint256FromString(r.Form["sendone"][0])
 			if tid!=nil {
 				network.TxMutex.Lock()
-				if ptx, ok := network.TransactionsToSend[tid.BIdx()]; ok {
+				if ptx, ok := network.TransactionsToSend[tid.BIdx()]; ok && network.ReplaceConflicts(ptx)==0 {
 					network.TxMutex.Unlock()
 					usif.SendInvToRandomPeer(1, tid)
 					ptx.Invsentcnt++
+				} else {
+					network.TxMutex.Unlock()
 				}
 			}
 		}
@@ -122,6 +122,20 @@ func TxNotify (idx *btc.TxPrevOut, valpk *btc.TxOut) {
 }
 
 
+// Returns the wallet's address that the script pays to, or nil if it is not in the wallet
+// Make sure to call it with locked balance
+func WalletAddr(pk_script []byte) *btc.BtcAddr {
+	adr := btc.NewAddrFromPkScript(pk_script, common.Testnet)
+	if adr==nil {
+		return nil
+	}
+	if rec, ok := CachedAddrs[adr.Hash160]; ok && rec.InWallet {
+		return CacheUnspent[rec.CacheIndex].BtcAddr
+	}
+	return nil
+}
+
+
 func GetRawTransaction(BlockHeight uint32, txid *btc.Uint256, txf io.Writer) bool {
 	// Find the block with the indicated Height in the main tree
 	common.BlockChain.BlockIndexAccess.Lock()
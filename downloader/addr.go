@@ -5,9 +5,9 @@ import (
 	"fmt"
 	"net"
 	"sync"
-	"bytes"
 	"bufio"
-	"github.com/piotrnar/gocoin/btc"
+	"github.com/piotrnar/gocoin/protocol"
+	"github.com/piotrnar/gocoin/others/utils"
 )
 
 var (
@@ -37,21 +37,16 @@ func validip4(ip []byte) bool {
 
 
 func parse_addr(pl []byte) {
-	b := bytes.NewBuffer(pl)
-	cnt, _ := btc.ReadVLen(b)
-	for i := 0; i < int(cnt); i++ {
-		var buf [30]byte
-		var ip4 [4]byte
-		n, e := b.Read(buf[:])
-		if n!=len(buf) || e!=nil {
-			fmt.Println("parse_addr:", n, e)
-			break
-		}
-		copy(ip4[:], buf[24:28])
-		if validip4(ip4[:]) {
+	addrs, e := protocol.ParseAddr(pl)
+	if e != nil {
+		fmt.Println("parse_addr:", e.Error())
+		return
+	}
+	for _, a := range addrs {
+		if validip4(a.Ip4[:]) {
 			AddrMutex.Lock()
-			if _, pres := AddrDatbase[ip4]; !pres {
-				AddrDatbase[ip4] = false
+			if _, pres := AddrDatbase[a.Ip4]; !pres {
+				AddrDatbase[a.Ip4] = false
 			}
 			AddrMutex.Unlock()
 		}
@@ -75,6 +70,18 @@ func add_ip_str(s string) bool {
 	}
 }
 
+// Returns IPs of the nodes from the DNS seeds of our network
+func dns_seed() (res []string) {
+	seeds, _ := utils.DNSSeeds(Testnet)
+	for _, p := range utils.SeedPeers(nil, seeds, DefaultTcpPort) {
+		if p.IsIPv4() && validip4(p.Ip4[:]) {
+			res = append(res, net.IP(p.Ip4[:]).String())
+		}
+	}
+	return
+}
+
+
 func load_ips() {
 	f, er := os.Open("ips.txt")
 	if er != nil {
@@ -8,6 +8,7 @@ import (
 	"sync/atomic"
 	"encoding/hex"
 	"github.com/piotrnar/gocoin/btc"
+	"github.com/piotrnar/gocoin/protocol"
 )
 
 const (
@@ -206,6 +207,11 @@ func avg_block_size() (le int) {
 
 
 func (c *one_net_conn) block(d []byte) {
+	if len(d) < 80 {
+		fmt.Println(c.peerip, "- block too short")
+		c.setbroken(true)
+		return
+	}
 	BlocksMutex.Lock()
 	defer BlocksMutex.Unlock()
 	h := btc.NewSha2Hash(d[:80])
@@ -228,7 +234,7 @@ func (c *one_net_conn) block(d []byte) {
 	atomic.AddUint64(&DlBytesDownloaded, uint64(len(d)))
 	blocksize_update(len(d))
 
-	bl, er := btc.NewBlock(d)
+	bl, er := protocol.ParseBlock(d)
 	if er != nil {
 		fmt.Println(c.peerip, "-", er.Error())
 		c.setbroken(true)
@@ -5,10 +5,9 @@ import (
 	"fmt"
 	"time"
 	"sync"
-	"bytes"
 	"errors"
-	"encoding/binary"
 	"github.com/piotrnar/gocoin/btc"
+	"github.com/piotrnar/gocoin/protocol"
 )
 
 var (
@@ -104,36 +103,25 @@ func (c *one_net_conn) hdr_idle() bool {
 
 
 func (c *one_net_conn) getheaders() {
-	var b [4+1+32+32]byte
-	binary.LittleEndian.PutUint32(b[0:4], Version)
-	b[4] = 1 // one inv
 	LastBlock.Mutex.Lock()
-	copy(b[5:37], LastBlock.node.BlockHash.Hash[:])
+	l := &protocol.Locator{Version:Version, Hashes:[]*btc.Uint256{LastBlock.node.BlockHash}}
 	LastBlock.Mutex.Unlock()
-	c.sendmsg("getheaders", b[:])
+	c.sendmsg("getheaders", l.Bytes())
 }
 
 
 func (c *one_net_conn) headers(d []byte) {
-	var hdr [81]byte
-	b := bytes.NewReader(d)
-	cnt, er := btc.ReadVLen(b)
+	hdrs, er := protocol.ParseHeaders(d)
 	if er != nil {
+		fmt.Println(LastBlock.node.Height, "headers:", er.Error())
 		return
 	}
-	if cnt==0 /*|| LastBlock.node.Height>=10e3*/ {
+	if len(hdrs)==0 /*|| LastBlock.node.Height>=10e3*/ {
 		SetAllHeadersDone(true)
 		return
 	}
-	for i := uint64(0); i < cnt; i++ {
-		if _, er = b.Read(hdr[:]); er != nil {
-			return
-		}
-		if hdr[80]!=0 {
-			fmt.Println(LastBlock.node.Height, "Unexpected value of txn_count")
-			continue
-		}
-		bl, er := btc.NewBlock(hdr[:])
+	for _, hdr := range hdrs {
+		bl, er := btc.NewBlock(hdr)
 		if er == nil {
 			er = chkblock(bl)
 			if er != nil {
@@ -44,7 +44,7 @@ func parse_command_line() {
 	flag.BoolVar(&Testnet, "t", false, "Use Testnet3")
 	flag.StringVar(&GocoinHomeDir, "d", GocoinHomeDir, "Specify the home directory")
 	flag.StringVar(&LastTrustedBlock, "trust", "auto", "Specify the highest trusted block hash (use \"all\" for all)")
-	flag.StringVar(&SeedNode, "s", "", "Specify IP of the node to fetch headers from")
+	flag.StringVar(&SeedNode, "s", "", "Specify IP of the node to fetch headers from (default: taken from DNS seeds)")
 	flag.UintVar(&MaxNetworkConns, "n", 20, "Set maximum number of network connections for chain download")
 	flag.IntVar(&GCPerc, "g", 0, "Set waste percentage treshold for Go's garbage collector")
 	flag.BoolVar(&DoThePings, "p", false, "Execute the pings procedure first to find the fastest peers")
@@ -119,13 +119,6 @@ func main() {
 	parse_command_line()
 	setup_runtime_vars()
 
-	if !add_ip_str(SeedNode) {
-		println("You need to specify IP address of a fast seed node.")
-		println("For example run it like this: downloader -s 89.31.102.237")
-		return
-	}
-	load_ips() // other seed nodes
-
 	if len(GocoinHomeDir)>0 && GocoinHomeDir[len(GocoinHomeDir)-1]!=os.PathSeparator {
 		GocoinHomeDir += string(os.PathSeparator)
 	}
@@ -138,6 +131,23 @@ func main() {
 	} else {
 		GocoinHomeDir += "btcnet" + string(os.PathSeparator)
 	}
+
+	var dnsips []string
+	if SeedNode=="" {
+		fmt.Println("Asking DNS seeds for peers...")
+		if dnsips = dns_seed(); len(dnsips)>0 {
+			SeedNode, dnsips = dnsips[0], dnsips[1:]
+		}
+	}
+	if !add_ip_str(SeedNode) {
+		println("You need to specify IP address of a fast seed node.")
+		println("For example run it like this: downloader -s 89.31.102.237")
+		return
+	}
+	for i := range dnsips {
+		add_ip_str(dnsips[i])
+	}
+	load_ips() // other seed nodes
 	fmt.Println("GocoinHomeDir:", GocoinHomeDir)
 
 	utils.LockDatabaseDir(GocoinHomeDir)
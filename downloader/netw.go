@@ -6,10 +6,9 @@ import (
 	"time"
 	"sync"
 	"bytes"
-	"strings"
 	"sync/atomic"
-	"encoding/binary"
 	"github.com/piotrnar/gocoin/btc"
+	"github.com/piotrnar/gocoin/protocol"
 )
 
 
@@ -124,19 +123,8 @@ func (c *one_net_conn) sendbuflen() (sbl int) {
 
 
 func (c *one_net_conn) sendmsg(cmd string, pl []byte) (e error) {
-	sbuf := make([]byte, 24+len(pl))
-
-	binary.LittleEndian.PutUint32(sbuf[0:4], Version)
-	copy(sbuf[0:4], Magic[:])
-	copy(sbuf[4:16], cmd)
-	binary.LittleEndian.PutUint32(sbuf[16:20], uint32(len(pl)))
-
-	sh := btc.Sha2Sum(pl[:])
-	copy(sbuf[20:24], sh[:4])
-	copy(sbuf[24:], pl)
-
 	c.Mutex.Lock()
-	c.send.buf = append(c.send.buf, sbuf...)
+	c.send.buf = append(c.send.buf, protocol.NewMsg(Magic, cmd, pl)...)
 	//fmt.Println("...", len(c.send.buf))
 	c.Mutex.Unlock()
 	return
@@ -144,24 +132,11 @@ func (c *one_net_conn) sendmsg(cmd string, pl []byte) (e error) {
 
 
 func (c *one_net_conn) sendver() {
-	b := bytes.NewBuffer([]byte{})
-	binary.Write(b, binary.LittleEndian, uint32(Version))
-	binary.Write(b, binary.LittleEndian, uint64(Services))
-	binary.Write(b, binary.LittleEndian, uint64(time.Now().Unix()))
-
-	// Remote Addr
-	binary.Write(b, binary.LittleEndian, Services)
-	b.Write(bytes.Repeat([]byte{0}, 12)) // ip6
-	b.Write(bytes.Repeat([]byte{0}, 4)) // ip4
-	binary.Write(b, binary.LittleEndian, uint16(DefaultTcpPort)) // port
-
-	b.Write(bytes.Repeat([]byte{0}, 26)) // Local Addr
-	b.Write(bytes.Repeat([]byte{0}, 8)) // nonce
-	b.WriteByte(byte(len(UserAgent)))
-	b.Write([]byte(UserAgent))
-	binary.Write(b, binary.LittleEndian, uint32(0))  // Last Block Height
-	b.WriteByte(0)  // don't notify me about txs
-	c.sendmsg("version", b.Bytes())
+	v := &protocol.Version{Version:Version, Services:Services, Timestamp:time.Now().Unix(),
+		UserAgent:UserAgent, Relay:false /*don't notify me about txs*/}
+	v.AddrRecv.Services = Services
+	v.AddrRecv.Port = DefaultTcpPort
+	c.sendmsg("version", v.Bytes())
 }
 
 // Lock the mutex before calling it
@@ -195,8 +170,9 @@ func (c *one_net_conn) readmsg() *one_net_cmd {
 					return nil
 				}
 				if c.recv.hdr_len==24 {
-					c.recv.cmd = strings.TrimRight(string(c.recv.hdr[4:16]), "\000")
-					c.recv.pl_len = binary.LittleEndian.Uint32(c.recv.hdr[16:20])
+					h, _ := protocol.ParseMsgHeader(c.recv.hdr[:])
+					c.recv.cmd = h.Cmd
+					c.recv.pl_len = h.Len
 					c.recv.datlen = 0
 					if c.recv.pl_len > 0 {
 						c.recv.dat = make([]byte, c.recv.pl_len)
@@ -225,8 +201,7 @@ func (c *one_net_conn) readmsg() *one_net_cmd {
 		}
 	}
 
-	sh := btc.Sha2Sum(c.recv.dat)
-	if !bytes.Equal(c.recv.hdr[20:24], sh[:4]) {
+	if h, _ := protocol.ParseMsgHeader(c.recv.hdr[:]); !h.Verify(c.recv.dat) {
 		fmt.Println(c.peerip, "Msg checksum error")
 		c.setbroken(true)
 		return nil
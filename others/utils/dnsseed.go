@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"net"
+	"time"
+	"context"
+)
+
+var (
+	// DNS seeds of each network
+	MainnetSeeds = []string{"seed.bitcoin.sipa.be", "dnsseed.bluematt.me", "bitseed.xf2.org",
+		"seed.bitcoinstats.com", "seed.bitcoin.jonasschnelli.ch", "seed.btc.petertodd.org"}
+	TestnetSeeds = []string{"testnet-seed.bitcoin.jonasschnelli.ch", "seed.tbtc.petertodd.org",
+		"testnet-seed.bluematt.me"}
+
+	DNSSeedTimeout = 30*time.Second // for each of the seeds
+)
+
+// Anything that can resolve the A/AAAA records (e.g. *net.Resolver)
+type SeedResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+
+// Returns the DNS seeds and the default TCP port of the network
+func DNSSeeds(testnet bool) ([]string, uint16) {
+	if testnet {
+		return TestnetSeeds, 18333
+	}
+	return MainnetSeeds, 8333
+}
+
+
+// Returns a resolver that sends its queries to the given DNS server (host:port),
+// instead of the ones from the system config.
+func NewSeedResolver(server string) *net.Resolver {
+	return &net.Resolver{PreferGo:true, Dial:func(ctx context.Context, network, address string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, server)
+	}}
+}
+
+
+// Asks each of the seeds for the addresses of the nodes, which all get the given port.
+// Nil resolver means the system's default one.
+func SeedPeers(res SeedResolver, seeds []string, port uint16) (peers []*OnePeer) {
+	if res == nil {
+		res = net.DefaultResolver
+	}
+	seen := make(map[uint64] bool)
+	for i := range seeds {
+		ctx, cancel := context.WithTimeout(context.Background(), DNSSeedTimeout)
+		ips, er := res.LookupIPAddr(ctx, seeds[i])
+		cancel()
+		if er != nil {
+			println("DNS seed", seeds[i], "-", er.Error())
+			continue
+		}
+		for j := range ips {
+			ip := ips[j].IP.To16()
+			if ip == nil {
+				continue
+			}
+			p := new(OnePeer)
+			p.Time = uint32(time.Now().Unix())
+			p.Services = 1
+			copy(p.Ip6[:], ip[:12])
+			copy(p.Ip4[:], ip[12:16])
+			p.Port = port
+			if !seen[p.UniqID()] {
+				seen[p.UniqID()] = true
+				peers = append(peers, p)
+			}
+		}
+	}
+	return
+}
+
+
+// Returns true if the peer has an IPv4 address (from an A record)
+func (p *OnePeer) IsIPv4() bool {
+	return net.IP(append(p.Ip6[:], p.Ip4[:]...)).To4() != nil
+}
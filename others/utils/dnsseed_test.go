@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"net"
+	"testing"
+	"strings"
+	"encoding/binary"
+)
+
+// Records served by the fake DNS server
+var fakeZone = map[string] []string {
+	"seed1.test.": []string{"1.2.3.4", "5.6.7.8", "2001:db8::1"},
+	"seed2.test.": []string{"5.6.7.8", "9.10.11.12"},
+}
+
+
+// Answers A and AAAA queries from fakeZone, until the connection gets closed
+func fakeDNS(pc net.PacketConn) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, e := pc.ReadFrom(buf)
+		if e != nil {
+			return
+		}
+		if n < 12 {
+			continue
+		}
+		// Decode the question
+		var name string
+		off := 12
+		for off < n && buf[off]!=0 {
+			l := int(buf[off])
+			if off+1+l > n {
+				break
+			}
+			name += string(buf[off+1:off+1+l]) + "."
+			off += 1+l
+		}
+		off++
+		if off+4 > n {
+			continue
+		}
+		qtype := binary.BigEndian.Uint16(buf[off:off+2])
+		off += 4
+
+		res := make([]byte, off, 512)
+		copy(res, buf[:off])
+		binary.BigEndian.PutUint16(res[2:4], 0x8180) // response, recursion desired and available
+		binary.BigEndian.PutUint16(res[6:8], 0)
+		binary.BigEndian.PutUint16(res[8:10], 0)
+		binary.BigEndian.PutUint16(res[10:12], 0)
+		ips, ok := fakeZone[strings.ToLower(name)]
+		if !ok {
+			res[3] |= 3 // NXDOMAIN
+		}
+		var cnt uint16
+		for _, s := range ips {
+			ip := net.ParseIP(s)
+			var rd []byte
+			if ip4 := ip.To4(); ip4!=nil && qtype==1 {
+				rd = ip4
+			} else if ip4==nil && qtype==28 {
+				rd = ip.To16()
+			} else {
+				continue
+			}
+			var rr [12]byte
+			binary.BigEndian.PutUint16(rr[0:2], 0xc00c) // pointer to the question's name
+			binary.BigEndian.PutUint16(rr[2:4], qtype)
+			binary.BigEndian.PutUint16(rr[4:6], 1) // IN
+			binary.BigEndian.PutUint32(rr[6:10], 60)
+			binary.BigEndian.PutUint16(rr[10:12], uint16(len(rd)))
+			res = append(res, rr[:]...)
+			res = append(res, rd...)
+			cnt++
+		}
+		binary.BigEndian.PutUint16(res[6:8], cnt)
+		pc.WriteTo(res, addr)
+	}
+}
+
+
+func TestSeedPeers(t *testing.T) {
+	pc, e := net.ListenPacket("udp", "127.0.0.1:0")
+	if e != nil {
+		t.Skip(e.Error())
+	}
+	defer pc.Close()
+	go fakeDNS(pc)
+
+	res := NewSeedResolver(pc.LocalAddr().String())
+	peers := SeedPeers(res, []string{"seed1.test", "seed2.test", "none.test"}, 18333)
+
+	exp := map[string] bool {"1.2.3.4":true, "5.6.7.8":true, "9.10.11.12":true, "2001:db8::1":false}
+	if len(peers) != len(exp) {
+		t.Fatal("Expected", len(exp), "peers, got", len(peers))
+	}
+	for _, p := range peers {
+		ip := net.IP(append(p.Ip6[:], p.Ip4[:]...)).String()
+		ipv4, ok := exp[ip]
+		if !ok {
+			t.Error("Unexpected peer", ip)
+			continue
+		}
+		delete(exp, ip)
+		if p.IsIPv4() != ipv4 {
+			t.Error("IsIPv4 failed for", ip)
+		}
+		if p.Port != 18333 || p.Services != 1 || p.Time == 0 {
+			t.Error("Bad record for", ip, p.Port, p.Services, p.Time)
+		}
+	}
+}
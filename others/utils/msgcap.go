@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"io"
+	"time"
+	"bytes"
+	"errors"
+	"strings"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/btc"
+)
+
+/*
+Capture of the messages exchanged with a single peer.
+
+File header (all values LSB unless specified otherwise):
+ [0:4] - "GCAP"
+ [4] - format version
+ [5:9] - network magic
+ [9:13] - peer's IPv4 (network order)
+ [13:15] - peer's TCP port (big endian)
+ [15] - 1 for an incoming connection, 0 for outgoing
+ [16:24] - unix time (in nanoseconds) of when the capture started
+
+Then each message:
+ [0] - 1 for a message sent to the peer, 0 for one received from it
+ [1:9] - unix time in nanoseconds
+ [9:21] - command (zero padded)
+ vlen - payload length
+ ... - payload
+*/
+
+const (
+	MsgCapVersion = 1
+	msgCapHdrLen = 24
+)
+
+type MsgCapHeader struct {
+	Magic [4]byte
+	Ip4 [4]byte
+	Port uint16
+	Incoming bool
+	Started time.Time
+}
+
+type CapMsg struct {
+	Time time.Time
+	Sent bool
+	Cmd string
+	Pl []byte
+}
+
+
+func (h *MsgCapHeader) Bytes() (res []byte) {
+	res = make([]byte, msgCapHdrLen)
+	copy(res[0:4], "GCAP")
+	res[4] = MsgCapVersion
+	copy(res[5:9], h.Magic[:])
+	copy(res[9:13], h.Ip4[:])
+	binary.BigEndian.PutUint16(res[13:15], h.Port)
+	if h.Incoming {
+		res[15] = 1
+	}
+	binary.LittleEndian.PutUint64(res[16:24], uint64(h.Started.UnixNano()))
+	return
+}
+
+
+func ReadMsgCapHeader(rd io.Reader) (h *MsgCapHeader, e error) {
+	var b [msgCapHdrLen]byte
+	if _, e = io.ReadFull(rd, b[:]); e != nil {
+		return
+	}
+	if string(b[0:4])!="GCAP" {
+		e = errors.New("Not a message capture file")
+		return
+	}
+	if b[4]!=MsgCapVersion {
+		e = errors.New("Unsupported message capture version")
+		return
+	}
+	h = new(MsgCapHeader)
+	copy(h.Magic[:], b[5:9])
+	copy(h.Ip4[:], b[9:13])
+	h.Port = binary.BigEndian.Uint16(b[13:15])
+	h.Incoming = b[15]!=0
+	h.Started = time.Unix(0, int64(binary.LittleEndian.Uint64(b[16:24])))
+	return
+}
+
+
+func (m *CapMsg) Bytes() []byte {
+	b := new(bytes.Buffer)
+	if m.Sent {
+		b.WriteByte(1)
+	} else {
+		b.WriteByte(0)
+	}
+	binary.Write(b, binary.LittleEndian, m.Time.UnixNano())
+	var cmd [12]byte
+	copy(cmd[:], m.Cmd)
+	b.Write(cmd[:])
+	btc.WriteVlen(b, uint32(len(m.Pl)))
+	b.Write(m.Pl)
+	return b.Bytes()
+}
+
+
+// Returns io.EOF at the end of the capture
+func ReadCapMsg(rd io.Reader) (m *CapMsg, e error) {
+	var b [21]byte
+	if _, e = io.ReadFull(rd, b[:]); e != nil {
+		return
+	}
+	var le uint64
+	if le, e = btc.ReadVLen(rd); e != nil {
+		return
+	}
+	if le > btc.MAX_BLOCK_SIZE*4 {
+		e = errors.New("Payload too big in the message capture")
+		return
+	}
+	m = new(CapMsg)
+	m.Sent = b[0]!=0
+	m.Time = time.Unix(0, int64(binary.LittleEndian.Uint64(b[1:9])))
+	m.Cmd = strings.TrimRight(string(b[9:21]), "\000")
+	m.Pl = make([]byte, int(le))
+	if _, e = io.ReadFull(rd, m.Pl); e != nil {
+		m = nil
+	}
+	return
+}
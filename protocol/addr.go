@@ -0,0 +1,41 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/btc"
+)
+
+// Single record of "addr" message
+type Addr struct {
+	Time uint32
+	btc.NetAddr
+}
+
+
+func ParseAddr(pl []byte) (res []*Addr, e error) {
+	r := &reader{b:pl}
+	cnt := r.vlen(MaxAddrCount)
+	if r.e == nil && cnt*30 > r.left() {
+		return nil, ErrTooShort
+	}
+	res = make([]*Addr, cnt)
+	for i := range res {
+		res[i] = &Addr{Time:r.u32(), NetAddr:r.netaddr()}
+	}
+	if e = r.e; e != nil {
+		res = nil
+	}
+	return
+}
+
+
+func AddrBytes(list []*Addr) []byte {
+	b := new(bytes.Buffer)
+	btc.WriteVlen(b, uint32(len(list)))
+	for i := range list {
+		binary.Write(b, binary.LittleEndian, list[i].Time)
+		b.Write(list[i].NetAddr.Bytes())
+	}
+	return b.Bytes()
+}
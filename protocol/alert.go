@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/btc"
+)
+
+const maxAlertSetLen = 1000
+
+
+// Checks the signature of "alert" message and decodes it.
+// If the signature is correct, but the content broken, it returns an error along with what has been decoded.
+func ParseAlert(pl []byte, pubkey []byte) (a *btc.Alert, e error) {
+	r := &reader{b:pl}
+	payload := r.bytes(r.vlen(len(pl)))
+	sig := r.bytes(r.vlen(len(pl)))
+	if r.e != nil {
+		return nil, errors.New("ParseAlert: broken payload or signature")
+	}
+	h := btc.NewSha2Hash(payload)
+	if !btc.EcdsaVerify(pubkey, sig, h.Hash[:]) {
+		return nil, errors.New("ParseAlert: the signature is not correct")
+	}
+
+	r = &reader{b:payload}
+	a = new(btc.Alert)
+	a.Version = r.u32()
+	a.RelayUntil = int64(r.u64())
+	a.Expiration = int64(r.u64())
+	a.ID = int32(r.u32())
+	a.Cancel = int32(r.u32())
+	if cnt := r.vlen(maxAlertSetLen); cnt > 0 {
+		a.SetCancel = make([]int32, cnt)
+		for i := range a.SetCancel {
+			a.SetCancel[i] = int32(r.u32())
+		}
+	}
+	a.MinVer = int32(r.u32())
+	a.MaxVer = int32(r.u32())
+	if cnt := r.vlen(maxAlertSetLen); cnt > 0 {
+		a.SetSubVer = make([]string, cnt)
+		for i := range a.SetSubVer {
+			a.SetSubVer[i] = r.str(len(payload))
+		}
+	}
+	a.Priority = int32(r.u32())
+	a.Comment = r.str(len(payload))
+	a.StatusBar = r.str(len(payload))
+	a.Reserved = r.str(len(payload))
+	e = r.e
+	return
+}
+
+
+// Returns the (unsigned) payload of the alert
+func AlertPayload(a *btc.Alert) []byte {
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.LittleEndian, a.Version)
+	binary.Write(b, binary.LittleEndian, a.RelayUntil)
+	binary.Write(b, binary.LittleEndian, a.Expiration)
+	binary.Write(b, binary.LittleEndian, a.ID)
+	binary.Write(b, binary.LittleEndian, a.Cancel)
+	btc.WriteVlen(b, uint32(len(a.SetCancel)))
+	for i := range a.SetCancel {
+		binary.Write(b, binary.LittleEndian, a.SetCancel[i])
+	}
+	binary.Write(b, binary.LittleEndian, a.MinVer)
+	binary.Write(b, binary.LittleEndian, a.MaxVer)
+	btc.WriteVlen(b, uint32(len(a.SetSubVer)))
+	for i := range a.SetSubVer {
+		writeStr(b, a.SetSubVer[i])
+	}
+	binary.Write(b, binary.LittleEndian, a.Priority)
+	writeStr(b, a.Comment)
+	writeStr(b, a.StatusBar)
+	writeStr(b, a.Reserved)
+	return b.Bytes()
+}
+
+
+// Returns "alert" message made of the payload and its signature
+func AlertBytes(payload, sig []byte) []byte {
+	b := new(bytes.Buffer)
+	btc.WriteVlen(b, uint32(len(payload)))
+	b.Write(payload)
+	btc.WriteVlen(b, uint32(len(sig)))
+	b.Write(sig)
+	return b.Bytes()
+}
+
+
+func writeStr(b *bytes.Buffer, s string) {
+	btc.WriteVlen(b, uint32(len(s)))
+	b.WriteString(s)
+}
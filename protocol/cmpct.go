@@ -0,0 +1,183 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/btc"
+)
+
+// BIP152 compact blocks - "cmpctblock", "getblocktxn" and "blocktxn" messages
+
+const MaxBlockTxs = int(btc.MAX_BLOCK_SIZE)/60 // each tx (with an input and an output) takes at least 60 bytes
+
+var ErrCmpctIndex = errors.New("Transaction index out of the block")
+
+type PrefilledTx struct {
+	Index int // absolute position in the block
+	Raw []byte
+}
+
+type CmpctBlock struct {
+	Header []byte // 80 bytes
+	Nonce [8]byte
+	ShortIds []uint64 // 48-bit values
+	Prefilled []*PrefilledTx
+}
+
+// Request for transactions of a compact block ("getblocktxn")
+type GetBlockTxn struct {
+	Hash *btc.Uint256
+	Indexes []int // absolute positions in the block
+}
+
+// Response to "getblocktxn"
+type BlockTxn struct {
+	Hash *btc.Uint256
+	Txs [][]byte // raw transactions
+}
+
+
+// Reads differentially encoded tx indexes (as in "cmpctblock" and "getblocktxn").
+// Each one must be lower than max.
+func (r *reader) indexes(cnt int, max int, f func(int)) {
+	idx := -1
+	for i:=0; i<cnt && r.e==nil; i++ {
+		idx += r.vlen(max) + 1
+		if r.e == nil && idx >= max {
+			r.e = ErrCmpctIndex
+			r.b = nil
+			return
+		}
+		f(idx)
+	}
+}
+
+
+func writeIndexes(b *bytes.Buffer, idxs []int) {
+	prv := -1
+	for _, i := range idxs {
+		btc.WriteVlen(b, uint32(i-prv-1))
+		prv = i
+	}
+}
+
+
+func ParseCmpctBlock(pl []byte) (cb *CmpctBlock, e error) {
+	r := &reader{b:pl}
+	cb = new(CmpctBlock)
+	cb.Header = r.bytes(80)
+	copy(cb.Nonce[:], r.bytes(8))
+	cnt := r.vlen(MaxBlockTxs)
+	if r.e == nil && cnt*6 > r.left() {
+		return nil, ErrTooShort
+	}
+	cb.ShortIds = make([]uint64, cnt)
+	var sid [8]byte
+	for i := range cb.ShortIds {
+		copy(sid[:6], r.bytes(6))
+		cb.ShortIds[i] = binary.LittleEndian.Uint64(sid[:])
+	}
+	pcnt := r.vlen(MaxBlockTxs-cnt)
+	if r.e == nil && pcnt*11 > r.left() { // index plus at least 10 bytes of tx
+		return nil, ErrTooShort
+	}
+	r.indexes(pcnt, cnt+pcnt, func(idx int) {
+		p := &PrefilledTx{Index:idx}
+		start := r.b
+		skipTx(r)
+		if r.e == nil {
+			p.Raw = start[:len(start)-len(r.b)]
+		}
+		cb.Prefilled = append(cb.Prefilled, p)
+	})
+	if r.e == nil && cnt+pcnt == 0 {
+		return nil, errors.New("Compact block without transactions")
+	}
+	if e = r.e; e != nil {
+		cb = nil
+	}
+	return
+}
+
+
+func (cb *CmpctBlock) Bytes() []byte {
+	var sid [8]byte
+	b := new(bytes.Buffer)
+	b.Write(cb.Header[:80])
+	b.Write(cb.Nonce[:])
+	btc.WriteVlen(b, uint32(len(cb.ShortIds)))
+	for _, id := range cb.ShortIds {
+		binary.LittleEndian.PutUint64(sid[:], id)
+		b.Write(sid[:6])
+	}
+	btc.WriteVlen(b, uint32(len(cb.Prefilled)))
+	prv := -1
+	for _, p := range cb.Prefilled {
+		btc.WriteVlen(b, uint32(p.Index-prv-1))
+		b.Write(p.Raw)
+		prv = p.Index
+	}
+	return b.Bytes()
+}
+
+
+func ParseGetBlockTxn(pl []byte) (req *GetBlockTxn, e error) {
+	r := &reader{b:pl}
+	req = &GetBlockTxn{Hash:r.hash()}
+	cnt := r.vlen(MaxBlockTxs)
+	if r.e == nil && cnt > r.left() {
+		return nil, ErrTooShort
+	}
+	req.Indexes = make([]int, 0, cnt)
+	r.indexes(cnt, MaxBlockTxs, func(idx int) {
+		req.Indexes = append(req.Indexes, idx)
+	})
+	if e = r.e; e != nil {
+		req = nil
+	}
+	return
+}
+
+
+func (req *GetBlockTxn) Bytes() []byte {
+	b := new(bytes.Buffer)
+	b.Write(req.Hash.Hash[:])
+	btc.WriteVlen(b, uint32(len(req.Indexes)))
+	writeIndexes(b, req.Indexes)
+	return b.Bytes()
+}
+
+
+func ParseBlockTxn(pl []byte) (bt *BlockTxn, e error) {
+	r := &reader{b:pl}
+	bt = &BlockTxn{Hash:r.hash()}
+	cnt := r.vlen(MaxBlockTxs)
+	if r.e == nil && cnt*10 > r.left() {
+		return nil, ErrTooShort
+	}
+	bt.Txs = make([][]byte, cnt)
+	for i := range bt.Txs {
+		start := r.b
+		skipTx(r)
+		if r.e != nil {
+			break
+		}
+		bt.Txs[i] = start[:len(start)-len(r.b)]
+	}
+	if e = r.e; e != nil {
+		bt = nil
+	}
+	return
+}
+
+
+func (bt *BlockTxn) Bytes() []byte {
+	b := new(bytes.Buffer)
+	b.Write(bt.Hash.Hash[:])
+	btc.WriteVlen(b, uint32(len(bt.Txs)))
+	for i := range bt.Txs {
+		b.Write(bt.Txs[i])
+	}
+	return b.Bytes()
+}
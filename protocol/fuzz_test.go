@@ -0,0 +1,229 @@
+package protocol
+
+/*
+Fuzz targets - a payload that makes any of the decoders panic would crash the node.
+Run them with e.g.: go test -fuzz=FuzzParseTx
+Without -fuzz only the seeds get checked.
+*/
+
+import (
+	"bytes"
+	"testing"
+	"github.com/piotrnar/gocoin/btc"
+)
+
+
+func FuzzParseMsgHeader(f *testing.F) {
+	f.Add(NewMsg([4]byte{0xF9,0xBE,0xB4,0xD9}, "ping", PingBytes(1)))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if h, e := ParseMsgHeader(b); e == nil {
+			h.Verify(b[MsgHeaderLen:])
+		}
+	})
+}
+
+
+func FuzzParseVersion(f *testing.F) {
+	v := &Version{Version:70014, Services:1, UserAgent:"/test/", Height:1, Relay:true}
+	f.Add(v.Bytes())
+	f.Add(v.Bytes()[:80])
+	f.Fuzz(func(t *testing.T, b []byte) {
+		v, e := ParseVersion(b)
+		if e != nil {
+			return
+		}
+		v2, e := ParseVersion(v.Bytes())
+		if e != nil || *v2 != *v {
+			t.Error("Version round trip failed")
+		}
+	})
+}
+
+
+func FuzzParseAddr(f *testing.F) {
+	f.Add(AddrBytes([]*Addr{&Addr{Time:1}}))
+	f.Add([]byte{0xfd, 0xe8, 0x03})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		res, e := ParseAddr(b)
+		if e != nil {
+			return
+		}
+		res2, e := ParseAddr(AddrBytes(res))
+		if e != nil || len(res2)!=len(res) {
+			t.Fatal("Addr round trip failed")
+		}
+		for i := range res {
+			if *res[i] != *res2[i] {
+				t.Error("Addr round trip failed at", i)
+			}
+		}
+	})
+}
+
+
+func FuzzParseInv(f *testing.F) {
+	f.Add(InvBytes([]*Inv{NewInv(MSG_TX, new(btc.Uint256))}))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		res, e := ParseInv(b)
+		if e != nil {
+			return
+		}
+		res2, e := ParseInv(InvBytes(res))
+		if e != nil || len(res2)!=len(res) {
+			t.Fatal("Inv round trip failed")
+		}
+		for i := range res {
+			if res[i].Type!=res2[i].Type || !res[i].Hash.Equal(res2[i].Hash) {
+				t.Error("Inv round trip failed at", i)
+			}
+		}
+	})
+}
+
+
+func FuzzParseLocator(f *testing.F) {
+	f.Add((&Locator{Version:70014, Hashes:[]*btc.Uint256{new(btc.Uint256)}}).Bytes())
+	f.Fuzz(func(t *testing.T, b []byte) {
+		l, e := ParseLocator(b)
+		if e != nil {
+			return
+		}
+		l2, e := ParseLocator(l.Bytes())
+		if e != nil || !bytes.Equal(l2.Bytes(), l.Bytes()) {
+			t.Error("Locator round trip failed")
+		}
+	})
+}
+
+
+func FuzzParseHeaders(f *testing.F) {
+	f.Add(HeadersBytes([][]byte{make([]byte, 80)}))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		hdrs, e := ParseHeaders(b)
+		if e != nil {
+			return
+		}
+		hdrs2, e := ParseHeaders(HeadersBytes(hdrs))
+		if e != nil || !bytes.Equal(HeadersBytes(hdrs2), HeadersBytes(hdrs)) {
+			t.Error("Headers round trip failed")
+		}
+	})
+}
+
+
+func FuzzParsePing(f *testing.F) {
+	f.Add(PingBytes(1))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if n, e := ParsePing(b); e == nil && !bytes.Equal(PingBytes(n), b) {
+			t.Error("Ping round trip failed")
+		}
+	})
+}
+
+
+func FuzzParseReject(f *testing.F) {
+	f.Add((&Reject{Message:"tx", Code:REJECT_DUST, Reason:"dust", Hash:new(btc.Uint256)}).Bytes())
+	f.Fuzz(func(t *testing.T, b []byte) {
+		rj, e := ParseReject(b)
+		if e != nil {
+			return
+		}
+		rj2, e := ParseReject(rj.Bytes())
+		if e != nil || rj2.Message!=rj.Message || rj2.Code!=rj.Code || rj2.Reason!=rj.Reason ||
+			(rj.Hash==nil) != (rj2.Hash==nil) {
+			t.Error("Reject round trip failed")
+		}
+	})
+}
+
+
+func FuzzParseAlert(f *testing.F) {
+	a := &btc.Alert{Version:1, SetSubVer:[]string{"/x/"}, StatusBar:"test"}
+	f.Add(AlertBytes(AlertPayload(a), make([]byte, 72)))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		ParseAlert(b, alertPubKey)
+	})
+}
+
+
+func FuzzParseTx(f *testing.F) {
+	f.Add(testTx().Serialize())
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if tx, e := ParseTx(b); e == nil && !bytes.Equal(tx.Serialize(), b) {
+			t.Error("Tx round trip failed")
+		}
+	})
+}
+
+
+func FuzzParseBlock(f *testing.F) {
+	b := new(bytes.Buffer)
+	b.Write(make([]byte, 80))
+	btc.WriteVlen(b, 1)
+	b.Write(testTx().Serialize())
+	f.Add(b.Bytes())
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if bl, e := ParseBlock(b); e == nil {
+			if e = bl.BuildTxList(); e != nil {
+				t.Error("BuildTxList failed for a parsed block:", e.Error())
+			}
+		}
+	})
+}
+
+
+func FuzzParseCmpctBlock(f *testing.F) {
+	f.Add((&CmpctBlock{Header:make([]byte, 80), ShortIds:[]uint64{1},
+		Prefilled:[]*PrefilledTx{&PrefilledTx{Index:0, Raw:testTx().Serialize()}}}).Bytes())
+	f.Fuzz(func(t *testing.T, b []byte) {
+		cb, e := ParseCmpctBlock(b)
+		if e != nil {
+			return
+		}
+		for _, p := range cb.Prefilled {
+			if p.Index >= len(cb.ShortIds)+len(cb.Prefilled) {
+				t.Fatal("Prefilled tx out of the block")
+			}
+		}
+		cb2, e := ParseCmpctBlock(cb.Bytes())
+		if e != nil || !bytes.Equal(cb2.Bytes(), cb.Bytes()) {
+			t.Error("CmpctBlock round trip failed")
+		}
+	})
+}
+
+
+func FuzzParseGetBlockTxn(f *testing.F) {
+	f.Add((&GetBlockTxn{Hash:new(btc.Uint256), Indexes:[]int{0, 3}}).Bytes())
+	f.Fuzz(func(t *testing.T, b []byte) {
+		req, e := ParseGetBlockTxn(b)
+		if e != nil {
+			return
+		}
+		req2, e := ParseGetBlockTxn(req.Bytes())
+		if e != nil || !bytes.Equal(req2.Bytes(), req.Bytes()) {
+			t.Error("GetBlockTxn round trip failed")
+		}
+	})
+}
+
+
+func FuzzParseBlockTxn(f *testing.F) {
+	f.Add((&BlockTxn{Hash:new(btc.Uint256), Txs:[][]byte{testTx().Serialize()}}).Bytes())
+	f.Fuzz(func(t *testing.T, b []byte) {
+		bt, e := ParseBlockTxn(b)
+		if e != nil {
+			return
+		}
+		for i := range bt.Txs {
+			if tx, _ := btc.NewTx(bt.Txs[i]); tx == nil {
+				t.Fatal("Unparsable tx in blocktxn")
+			}
+		}
+		bt2, e := ParseBlockTxn(bt.Bytes())
+		if e != nil || !bytes.Equal(bt2.Bytes(), bt.Bytes()) {
+			t.Error("BlockTxn round trip failed")
+		}
+	})
+}
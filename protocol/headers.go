@@ -0,0 +1,36 @@
+package protocol
+
+import (
+	"bytes"
+	"github.com/piotrnar/gocoin/btc"
+)
+
+
+// Returns the 80 bytes long block headers from "headers" message
+func ParseHeaders(pl []byte) (hdrs [][]byte, e error) {
+	r := &reader{b:pl}
+	cnt := r.vlen(MaxHeadersCount)
+	if r.e == nil && cnt*81 > r.left() {
+		return nil, ErrTooShort
+	}
+	hdrs = make([][]byte, cnt)
+	for i := range hdrs {
+		hdrs[i] = r.bytes(80)
+		r.vlen(0) // txn_count must be zero
+	}
+	if e = r.e; e != nil {
+		hdrs = nil
+	}
+	return
+}
+
+
+func HeadersBytes(hdrs [][]byte) []byte {
+	b := new(bytes.Buffer)
+	btc.WriteVlen(b, uint32(len(hdrs)))
+	for i := range hdrs {
+		b.Write(hdrs[i][:80])
+		b.WriteByte(0) // 81st byte is always zero
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/btc"
+)
+
+// Single record of "inv", "getdata" or "notfound" message
+type Inv struct {
+	Type uint32
+	Hash *btc.Uint256
+}
+
+
+func NewInv(typ uint32, h *btc.Uint256) *Inv {
+	return &Inv{Type:typ, Hash:h}
+}
+
+
+// Parses payload of "inv", "getdata" or "notfound"
+func ParseInv(pl []byte) (res []*Inv, e error) {
+	r := &reader{b:pl}
+	cnt := r.vlen(MaxInvCount)
+	if r.e == nil && cnt*36 > r.left() {
+		return nil, ErrTooShort
+	}
+	res = make([]*Inv, cnt)
+	for i := range res {
+		res[i] = &Inv{Type:r.u32(), Hash:r.hash()}
+	}
+	if e = r.e; e != nil {
+		res = nil
+	}
+	return
+}
+
+
+// Returns payload of "inv", "getdata" or "notfound"
+func InvBytes(invs []*Inv) []byte {
+	b := new(bytes.Buffer)
+	btc.WriteVlen(b, uint32(len(invs)))
+	for i := range invs {
+		binary.Write(b, binary.LittleEndian, invs[i].Type)
+		b.Write(invs[i].Hash.Hash[:])
+	}
+	return b.Bytes()
+}
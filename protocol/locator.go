@@ -0,0 +1,52 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/btc"
+)
+
+// Payload of "getblocks" and "getheaders"
+type Locator struct {
+	Version uint32
+	Hashes []*btc.Uint256
+	Stop *btc.Uint256 // all zeros to get as many as possible
+}
+
+
+func ParseLocator(pl []byte) (l *Locator, e error) {
+	r := &reader{b:pl}
+	l = new(Locator)
+	l.Version = r.u32()
+	cnt := r.vlen(MaxLocatorCount)
+	if r.e == nil && (cnt+1)*32 > r.left() {
+		return nil, ErrTooShort
+	}
+	if cnt > 0 {
+		l.Hashes = make([]*btc.Uint256, cnt)
+		for i := range l.Hashes {
+			l.Hashes[i] = r.hash()
+		}
+	}
+	l.Stop = r.hash()
+	if e = r.e; e != nil {
+		l = nil
+	}
+	return
+}
+
+
+func (l *Locator) Bytes() []byte {
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.LittleEndian, l.Version)
+	btc.WriteVlen(b, uint32(len(l.Hashes)))
+	for i := range l.Hashes {
+		b.Write(l.Hashes[i].Hash[:])
+	}
+	if l.Stop != nil {
+		b.Write(l.Stop.Hash[:])
+	} else {
+		b.Write(make([]byte, 32))
+	}
+	return b.Bytes()
+}
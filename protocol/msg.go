@@ -0,0 +1,55 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/btc"
+)
+
+const MsgHeaderLen = 24
+
+type MsgHeader struct {
+	Magic [4]byte
+	Cmd string
+	Len uint32
+	Checksum [4]byte
+}
+
+
+// Returns the message (with its header) ready to be sent over the network
+func NewMsg(magic [4]byte, cmd string, pl []byte) (res []byte) {
+	res = make([]byte, MsgHeaderLen+len(pl))
+	copy(res[0:4], magic[:])
+	copy(res[4:16], cmd)
+	binary.LittleEndian.PutUint32(res[16:20], uint32(len(pl)))
+	sh := btc.Sha2Sum(pl)
+	copy(res[20:24], sh[:4])
+	copy(res[24:], pl)
+	return
+}
+
+
+func ParseMsgHeader(b []byte) (h *MsgHeader, e error) {
+	if len(b) < MsgHeaderLen {
+		e = ErrTooShort
+		return
+	}
+	h = new(MsgHeader)
+	copy(h.Magic[:], b[0:4])
+	h.Cmd = strings.TrimRight(string(b[4:16]), "\000")
+	h.Len = binary.LittleEndian.Uint32(b[16:20])
+	copy(h.Checksum[:], b[20:24])
+	if strings.IndexByte(h.Cmd, 0) != -1 {
+		e = errors.New("Command not properly padded")
+	}
+	return
+}
+
+
+// Returns true if the payload's checksum matches the header
+func (h *MsgHeader) Verify(pl []byte) bool {
+	sh := btc.Sha2Sum(pl)
+	return bytes.Equal(h.Checksum[:], sh[:4])
+}
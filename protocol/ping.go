@@ -0,0 +1,24 @@
+package protocol
+
+import (
+	"errors"
+	"encoding/binary"
+)
+
+
+// Decodes "ping" or "pong" message (BIP31)
+func ParsePing(pl []byte) (nonce uint64, e error) {
+	if len(pl) != 8 {
+		e = errors.New("Ping nonce must be 8 bytes long")
+		return
+	}
+	nonce = binary.LittleEndian.Uint64(pl)
+	return
+}
+
+
+func PingBytes(nonce uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, nonce)
+	return b
+}
@@ -0,0 +1,123 @@
+// Package protocol encodes and decodes the payloads of the bitcoin network messages.
+// It is shared by the client and the downloader.
+// None of the Parse functions panics or allocates more than the payload justifies,
+// whatever bytes a peer sends (see the fuzz tests).
+package protocol
+
+import (
+	"errors"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/btc"
+)
+
+const (
+	// Inventory types (in "inv", "getdata" and "notfound")
+	MSG_TX = 1
+	MSG_BLOCK = 2
+	MSG_FILTERED_BLOCK = 3
+	MSG_CMPCT_BLOCK = 4
+
+	MaxInvCount = 50000 // in a single "inv", "getdata" or "notfound"
+	MaxAddrCount = 1000
+	MaxHeadersCount = 2000
+	MaxLocatorCount = 500
+	MaxUserAgentLen = 256
+)
+
+var (
+	ErrTooShort = errors.New("Payload too short")
+	ErrTooMany = errors.New("Too many items in the payload")
+)
+
+
+// Sticks to the first error, after which it only returns zeros
+type reader struct {
+	b []byte
+	e error
+}
+
+
+func (r *reader) left() int {
+	return len(r.b)
+}
+
+
+func (r *reader) bytes(n int) (res []byte) {
+	if r.e != nil {
+		return
+	}
+	if n<0 || n>len(r.b) {
+		r.e = ErrTooShort
+		r.b = nil
+		return
+	}
+	res = r.b[:n]
+	r.b = r.b[n:]
+	return
+}
+
+
+func (r *reader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+
+func (r *reader) u32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+
+func (r *reader) u64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+
+func (r *reader) hash() (h *btc.Uint256) {
+	if b := r.bytes(32); b != nil {
+		h = btc.NewUint256(b)
+	}
+	return
+}
+
+
+func (r *reader) netaddr() (a btc.NetAddr) {
+	if b := r.bytes(26); b != nil {
+		a = *btc.NewNetAddr(b)
+	}
+	return
+}
+
+
+// Reads var_int, which must not be bigger than max
+func (r *reader) vlen(max int) int {
+	var res uint64
+	c := r.byte()
+	if c < 0xfd {
+		res = uint64(c)
+	} else if b := r.bytes(2 << (2-(0xff-c))); b != nil {
+		for i := range b {
+			res |= uint64(b[i]) << uint(8*i)
+		}
+	}
+	if r.e == nil && res > uint64(max) {
+		r.e = ErrTooMany
+		r.b = nil
+		return 0
+	}
+	return int(res)
+}
+
+
+// Reads var_str, which must not be longer than max
+func (r *reader) str(max int) string {
+	return string(r.bytes(r.vlen(max)))
+}
@@ -0,0 +1,302 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+	"encoding/hex"
+	"github.com/piotrnar/gocoin/btc"
+)
+
+var alertPubKey, _ = hex.DecodeString("04fc9702847840aaf195de8442ebecedf5b095cdbb9bc716bda9110971b28a49e0ead8564ff0db22209e0374782c093bb899692d524e9d6a6956e7c5ecbcd68284")
+
+
+func testTx() *btc.Tx {
+	tx := new(btc.Tx)
+	tx.Version = 1
+	tx.TxIn = []*btc.TxIn{&btc.TxIn{Input:btc.TxPrevOut{Vout:3}, ScriptSig:[]byte{1,2,3}, Sequence:0xffffffff}}
+	tx.TxOut = []*btc.TxOut{&btc.TxOut{Value:12345, Pk_script:[]byte{0x51}}, &btc.TxOut{Value:1, Pk_script:nil}}
+	tx.Lock_time = 100
+	return tx
+}
+
+
+func TestMsg(t *testing.T) {
+	magic := [4]byte{0xF9,0xBE,0xB4,0xD9}
+	m := NewMsg(magic, "verack", nil)
+	if hex.EncodeToString(m)!="f9beb4d976657261636b000000000000000000005df6e0e2" {
+		t.Error("Bad verack:", hex.EncodeToString(m))
+	}
+	h, e := ParseMsgHeader(m)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if h.Magic!=magic || h.Cmd!="verack" || h.Len!=0 || !h.Verify(nil) || h.Verify([]byte{0}) {
+		t.Error("Bad header", h)
+	}
+	if _, e = ParseMsgHeader(m[:23]); e == nil {
+		t.Error("Short header accepted")
+	}
+}
+
+
+func TestVersion(t *testing.T) {
+	v := &Version{Version:70014, Services:1, Timestamp:1400000000, Nonce:[8]byte{1,2,3,4,5,6,7,8},
+		UserAgent:"/Gocoin:0.9.12/", Height:300000, Relay:false}
+	v.AddrRecv.Ip4 = [4]byte{1,2,3,4}
+	v.AddrRecv.Port = 8333
+	pl := v.Bytes()
+	v2, e := ParseVersion(pl)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if *v2 != *v {
+		t.Error("Version mismatch", v2)
+	}
+
+	// Without the optional fields
+	v2, e = ParseVersion(pl[:80])
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if v2.UserAgent!="" || v2.Height!=0 || !v2.Relay || v2.Nonce!=v.Nonce {
+		t.Error("Bad short version", v2)
+	}
+	if _, e = ParseVersion(pl[:79]); e == nil {
+		t.Error("Too short version accepted")
+	}
+}
+
+
+func TestAddr(t *testing.T) {
+	list := []*Addr{&Addr{Time:1400000000}, &Addr{Time:1}}
+	list[0].Ip4 = [4]byte{1,2,3,4}
+	list[1].Port = 18333
+	pl := AddrBytes(list)
+	if len(pl)!=1+2*30 {
+		t.Error("Bad addr length", len(pl))
+	}
+	res, e := ParseAddr(pl)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if len(res)!=2 || *res[0]!=*list[0] || *res[1]!=*list[1] {
+		t.Error("Addr mismatch")
+	}
+	if _, e = ParseAddr(pl[:len(pl)-1]); e == nil {
+		t.Error("Short addr accepted")
+	}
+	if _, e = ParseAddr([]byte{0xfd, 0xe9, 0x03}); e != ErrTooMany {
+		t.Error("Too many addrs accepted")
+	}
+}
+
+
+func TestInv(t *testing.T) {
+	invs := []*Inv{NewInv(MSG_TX, btc.NewSha2Hash([]byte{1})), NewInv(MSG_BLOCK, btc.NewSha2Hash([]byte{2}))}
+	pl := InvBytes(invs)
+	res, e := ParseInv(pl)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if len(res)!=2 {
+		t.Fatal("Bad inv count", len(res))
+	}
+	for i := range res {
+		if res[i].Type!=invs[i].Type || !res[i].Hash.Equal(invs[i].Hash) {
+			t.Error("Inv mismatch", i)
+		}
+	}
+	if _, e = ParseInv(pl[:len(pl)-1]); e == nil {
+		t.Error("Short inv accepted")
+	}
+	if _, e = ParseInv([]byte{0xff, 1,2,3,4,5,6,7,8}); e != ErrTooMany {
+		t.Error("Huge inv count accepted")
+	}
+}
+
+
+func TestLocator(t *testing.T) {
+	l := &Locator{Version:70014, Hashes:[]*btc.Uint256{btc.NewSha2Hash([]byte{1}), btc.NewSha2Hash([]byte{2})}}
+	pl := l.Bytes()
+	if len(pl)!=4+1+3*32 {
+		t.Fatal("Bad locator length", len(pl))
+	}
+	l2, e := ParseLocator(pl)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if l2.Version!=l.Version || len(l2.Hashes)!=2 || !l2.Hashes[1].Equal(l.Hashes[1]) || !l2.Stop.Equal(new(btc.Uint256)) {
+		t.Error("Locator mismatch")
+	}
+	if _, e = ParseLocator(pl[:len(pl)-32]); e == nil {
+		t.Error("Locator without hash_stop accepted")
+	}
+}
+
+
+func TestHeaders(t *testing.T) {
+	hdrs := [][]byte{bytes.Repeat([]byte{1}, 80), bytes.Repeat([]byte{2}, 80)}
+	pl := HeadersBytes(hdrs)
+	res, e := ParseHeaders(pl)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if len(res)!=2 || !bytes.Equal(res[0], hdrs[0]) || !bytes.Equal(res[1], hdrs[1]) {
+		t.Error("Headers mismatch")
+	}
+	pl[len(pl)-1] = 1
+	if _, e = ParseHeaders(pl); e == nil {
+		t.Error("Non-zero txn_count accepted")
+	}
+}
+
+
+func TestPing(t *testing.T) {
+	n, e := ParsePing(PingBytes(0x0102030405060708))
+	if e != nil || n!=0x0102030405060708 {
+		t.Error("Ping mismatch", n, e)
+	}
+	if _, e = ParsePing(nil); e == nil {
+		t.Error("Empty ping accepted")
+	}
+}
+
+
+func TestReject(t *testing.T) {
+	rj := &Reject{Message:"tx", Code:REJECT_INSUFFICIENTFEE, Reason:"insufficient fee", Hash:btc.NewSha2Hash([]byte{1})}
+	rj2, e := ParseReject(rj.Bytes())
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if rj2.Message!=rj.Message || rj2.Code!=rj.Code || rj2.Reason!=rj.Reason || !rj2.Hash.Equal(rj.Hash) {
+		t.Error("Reject mismatch", rj2)
+	}
+
+	rj = &Reject{Message:"version", Code:REJECT_OBSOLETE, Reason:string(bytes.Repeat([]byte{'x'}, 200))}
+	rj2, e = ParseReject(rj.Bytes())
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if rj2.Hash!=nil || len(rj2.Reason)!=MaxRejectReasonLen {
+		t.Error("Bad reject", rj2)
+	}
+}
+
+
+func TestTx(t *testing.T) {
+	raw := testTx().Serialize()
+	tx, e := ParseTx(raw)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if !bytes.Equal(tx.Serialize(), raw) || !tx.Hash.Equal(btc.NewSha2Hash(raw)) || tx.Size!=uint32(len(raw)) {
+		t.Error("Tx mismatch")
+	}
+	if _, e = ParseTx(append(raw, 0)); e != ErrTxLength {
+		t.Error("Extra byte not detected", e)
+	}
+	if _, e = ParseTx(raw[:len(raw)-1]); e != ErrTxFormat {
+		t.Error("Missing byte not detected", e)
+	}
+}
+
+
+func TestBlock(t *testing.T) {
+	tx := testTx()
+	b := new(bytes.Buffer)
+	b.Write(make([]byte, 80))
+	btc.WriteVlen(b, 2)
+	b.Write(tx.Serialize())
+	b.Write(tx.Serialize())
+	bl, e := ParseBlock(b.Bytes())
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if e = bl.BuildTxList(); e != nil {
+		t.Fatal(e.Error())
+	}
+	if len(bl.Txs)!=2 || !bytes.Equal(bl.Txs[1].Serialize(), tx.Serialize()) {
+		t.Error("Block txs mismatch")
+	}
+	if _, e = ParseBlock(b.Bytes()[:b.Len()-1]); e == nil {
+		t.Error("Truncated block accepted")
+	}
+}
+
+
+func TestAlert(t *testing.T) {
+	dat, _ := hex.DecodeString("7d01000000111a4853000000005d235c53000000001104000010040000007211010072110100010f2f5361746f7368693a302e392e302f881300000040555247454e543a20557067726164652072657175697265643a207365652068747470733a2f2f7777772e626974636f696e2e6f72672f6865617274626c656564004630440220108a795ab2fcc2c6b1e538b2e48f63042b5e16939e3ef5faefd8c154b38a40c502200feacb829d61f1912a529b0812db846501c09556e61ab679c824b53b201999bf")
+	a, e := ParseAlert(dat, alertPubKey)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if a.ID!=1041 || a.Cancel!=1040 || a.MinVer!=70002 || a.MaxVer!=70002 || len(a.SetSubVer)!=1 ||
+		a.SetSubVer[0]!="/Satoshi:0.9.0/" || a.Priority!=5000 ||
+		a.StatusBar!="URGENT: Upgrade required: see https://www.bitcoin.org/heartbleed" {
+		t.Error("Bad alert", a)
+	}
+	if !bytes.Equal(AlertPayload(a), dat[1:1+0x7d]) {
+		t.Error("AlertPayload mismatch")
+	}
+
+	dat[10] ^= 1
+	if a, e = ParseAlert(dat, alertPubKey); a!=nil || e==nil {
+		t.Error("Alert with a wrong signature accepted")
+	}
+}
+
+
+func TestCmpctBlock(t *testing.T) {
+	raw := testTx().Serialize()
+	cb := &CmpctBlock{Header:bytes.Repeat([]byte{1}, 80), Nonce:[8]byte{1,2,3,4,5,6,7,8},
+		ShortIds:[]uint64{0x123456789abc, 1},
+		Prefilled:[]*PrefilledTx{&PrefilledTx{Index:0, Raw:raw}, &PrefilledTx{Index:2, Raw:raw}}}
+	pl := cb.Bytes()
+	cb2, e := ParseCmpctBlock(pl)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if !bytes.Equal(cb2.Bytes(), pl) || len(cb2.Prefilled)!=2 || cb2.Prefilled[1].Index!=2 || cb2.ShortIds[0]!=0x123456789abc {
+		t.Error("Cmpct block mismatch")
+	}
+
+	// the prefilled tx index must be within the block
+	cb.Prefilled[1].Index = 4
+	if _, e = ParseCmpctBlock(cb.Bytes()); e != ErrCmpctIndex {
+		t.Error("Prefilled tx out of the block accepted", e)
+	}
+
+	// a huge count must not panic nor allocate
+	b := append(bytes.Repeat([]byte{0}, 88), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	if _, e = ParseCmpctBlock(b); e != ErrTooMany {
+		t.Error("Huge short ids count accepted", e)
+	}
+}
+
+
+func TestBlockTxn(t *testing.T) {
+	req := &GetBlockTxn{Hash:btc.NewSha2Hash([]byte{1}), Indexes:[]int{0, 5, 6, 1000}}
+	req2, e := ParseGetBlockTxn(req.Bytes())
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if !req2.Hash.Equal(req.Hash) || len(req2.Indexes)!=4 || req2.Indexes[3]!=1000 {
+		t.Error("GetBlockTxn mismatch", req2.Indexes)
+	}
+	req.Indexes = []int{MaxBlockTxs}
+	if _, e = ParseGetBlockTxn(req.Bytes()); e == nil {
+		t.Error("Index out of the block accepted")
+	}
+
+	bt := &BlockTxn{Hash:req.Hash, Txs:[][]byte{testTx().Serialize()}}
+	bt2, e := ParseBlockTxn(bt.Bytes())
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if !bytes.Equal(bt2.Bytes(), bt.Bytes()) {
+		t.Error("BlockTxn mismatch")
+	}
+	if _, e = ParseBlockTxn(bt.Bytes()[:40]); e == nil {
+		t.Error("Truncated blocktxn accepted")
+	}
+}
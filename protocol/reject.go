@@ -0,0 +1,59 @@
+package protocol
+
+import (
+	"bytes"
+	"github.com/piotrnar/gocoin/btc"
+)
+
+// Reject codes (BIP61)
+const (
+	REJECT_MALFORMED = 0x01
+	REJECT_INVALID = 0x10
+	REJECT_OBSOLETE = 0x11
+	REJECT_DUPLICATE = 0x12
+	REJECT_NONSTANDARD = 0x40
+	REJECT_DUST = 0x41
+	REJECT_INSUFFICIENTFEE = 0x42
+	REJECT_CHECKPOINT = 0x43
+
+	MaxRejectReasonLen = 111
+)
+
+type Reject struct {
+	Message string // command of the rejected message
+	Code byte
+	Reason string
+	Hash *btc.Uint256 // of the rejected tx or block (nil for other messages)
+}
+
+
+func ParseReject(pl []byte) (rj *Reject, e error) {
+	r := &reader{b:pl}
+	rj = new(Reject)
+	rj.Message = r.str(12)
+	rj.Code = r.byte()
+	rj.Reason = r.str(MaxRejectReasonLen)
+	if r.e == nil && r.left() >= 32 {
+		rj.Hash = r.hash()
+	}
+	if e = r.e; e != nil {
+		rj = nil
+	}
+	return
+}
+
+
+func (rj *Reject) Bytes() []byte {
+	b := new(bytes.Buffer)
+	writeStr(b, rj.Message)
+	b.WriteByte(rj.Code)
+	reason := rj.Reason
+	if len(reason) > MaxRejectReasonLen {
+		reason = reason[:MaxRejectReasonLen]
+	}
+	writeStr(b, reason)
+	if rj.Hash != nil {
+		b.Write(rj.Hash.Hash[:])
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"errors"
+	"github.com/piotrnar/gocoin/btc"
+)
+
+var (
+	ErrTxFormat = errors.New("Transaction format broken")
+	ErrTxLength = errors.New("Transaction length does not match the payload")
+	ErrTxNoInputs = errors.New("Transaction has no inputs")
+)
+
+
+// Goes through a serialized tx, checking that it fits the buffer.
+// Does not allocate anything, so btc.NewTx can safely parse it later.
+func skipTx(r *reader) {
+	r.bytes(4) // version
+	cnt := r.vlen(r.left()/41) // each input takes at least 41 bytes
+	for i:=0; i<cnt; i++ {
+		r.bytes(36) // previous output
+		r.bytes(r.vlen(r.left())) // script
+		r.bytes(4) // sequence
+	}
+	cnt = r.vlen(r.left()/9) // each output takes at least 9 bytes
+	for i:=0; i<cnt; i++ {
+		r.bytes(8) // value
+		r.bytes(r.vlen(r.left())) // script
+	}
+	r.bytes(4) // lock time
+}
+
+
+// Decodes "tx" message, which must not contain any extra bytes. Sets the tx's hash.
+func ParseTx(pl []byte) (tx *btc.Tx, e error) {
+	r := &reader{b:pl}
+	skipTx(r)
+	if r.e != nil {
+		return nil, ErrTxFormat
+	}
+	if r.left() != 0 {
+		return nil, ErrTxLength
+	}
+	tx, _ = btc.NewTx(pl)
+	if tx == nil {
+		return nil, ErrTxFormat
+	}
+	if len(tx.TxIn) < 1 {
+		return nil, ErrTxNoInputs
+	}
+	tx.Size = uint32(len(pl))
+	tx.Hash = btc.NewSha2Hash(pl)
+	return
+}
+
+
+// Decodes "block" message. Only checks that the block's transactions can be parsed
+// - it is up to the caller to call BuildTxList.
+func ParseBlock(pl []byte) (bl *btc.Block, e error) {
+	r := &reader{b:pl}
+	r.bytes(80)
+	cnt := r.vlen(r.left()/10) // each tx takes at least 10 bytes
+	for i:=0; i<cnt; i++ {
+		skipTx(r)
+	}
+	if r.e != nil {
+		return nil, errors.New("Block format broken")
+	}
+	return btc.NewBlock(pl)
+}
@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/piotrnar/gocoin/btc"
+)
+
+type Version struct {
+	Version uint32
+	Services uint64
+	Timestamp int64
+	AddrRecv btc.NetAddr
+	AddrFrom btc.NetAddr
+	Nonce [8]byte
+	UserAgent string
+	Height uint32
+	Relay bool // false if the peer does not want invs of txs
+}
+
+
+// The fields up to (and including) the nonce are mandatory
+func ParseVersion(pl []byte) (v *Version, e error) {
+	r := &reader{b:pl}
+	v = new(Version)
+	v.Version = r.u32()
+	v.Services = r.u64()
+	v.Timestamp = int64(r.u64())
+	v.AddrRecv = r.netaddr()
+	v.AddrFrom = r.netaddr()
+	copy(v.Nonce[:], r.bytes(8))
+	v.Relay = true
+	if r.e == nil && r.left() > 0 {
+		v.UserAgent = r.str(MaxUserAgentLen)
+		if r.e == nil && r.left() >= 4 {
+			v.Height = r.u32()
+			if r.left() > 0 {
+				v.Relay = r.byte()!=0
+			}
+		}
+	}
+	if e = r.e; e != nil {
+		v = nil
+	}
+	return
+}
+
+
+func (v *Version) Bytes() []byte {
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.LittleEndian, v.Version)
+	binary.Write(b, binary.LittleEndian, v.Services)
+	binary.Write(b, binary.LittleEndian, v.Timestamp)
+	b.Write(v.AddrRecv.Bytes())
+	b.Write(v.AddrFrom.Bytes())
+	b.Write(v.Nonce[:])
+	btc.WriteVlen(b, uint32(len(v.UserAgent)))
+	b.Write([]byte(v.UserAgent))
+	binary.Write(b, binary.LittleEndian, v.Height)
+	if v.Relay {
+		b.WriteByte(1)
+	} else {
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
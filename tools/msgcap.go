@@ -0,0 +1,189 @@
+package main
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"net"
+	"time"
+	"bufio"
+	"encoding/hex"
+	"github.com/piotrnar/gocoin/btc"
+	"github.com/piotrnar/gocoin/protocol"
+	"github.com/piotrnar/gocoin/others/utils"
+)
+
+var testnetMagic = [4]byte{0x0B,0x11,0x09,0x07}
+
+
+func usage() {
+	fmt.Println("Dump or replay a peer's messages captured by the client (Net.CaptureAll or TextUI \"capture\")")
+	fmt.Println("Usage:")
+	fmt.Println("  msgcap dump <file> [-x]  - list the messages (-x to show the payloads in hex)")
+	fmt.Println("  msgcap replay <file> [<host:port>] [-fast]  - send the messages that came from the peer")
+	fmt.Println("     to a node (127.0.0.1 by default), keeping their original timing (unless -fast)")
+}
+
+
+func open_capture(fn string) (f *os.File, rd *bufio.Reader, h *utils.MsgCapHeader) {
+	f, e := os.Open(fn)
+	if e != nil {
+		println(e.Error())
+		os.Exit(1)
+	}
+	rd = bufio.NewReader(f)
+	if h, e = utils.ReadMsgCapHeader(rd); e != nil {
+		println(fn, "-", e.Error())
+		os.Exit(1)
+	}
+	return
+}
+
+
+func dump(fn string, full bool) {
+	f, rd, h := open_capture(fn)
+	defer f.Close()
+
+	dir := "outgoing"
+	if h.Incoming {
+		dir = "incoming"
+	}
+	fmt.Printf("Peer %d.%d.%d.%d:%d (%s connection), magic %s, captured at %s\n", h.Ip4[0], h.Ip4[1],
+		h.Ip4[2], h.Ip4[3], h.Port, dir, hex.EncodeToString(h.Magic[:]), h.Started.Format("2006-01-02 15:04:05"))
+
+	var cnt, sent int
+	var bts uint64
+	for {
+		m, e := utils.ReadCapMsg(rd)
+		if e != nil {
+			if e != io.EOF {
+				println(e.Error())
+			}
+			break
+		}
+		arrow := "<-"
+		if m.Sent {
+			arrow = "->"
+			sent++
+		}
+		fmt.Printf("%5d) %10.3f  %s %-12s %8d", cnt, m.Time.Sub(h.Started).Seconds(), arrow, m.Cmd, len(m.Pl))
+		if full {
+			fmt.Println()
+			fmt.Print(hex.Dump(m.Pl))
+		} else if len(m.Pl)>0 {
+			l := len(m.Pl)
+			if l>16 {
+				l = 16
+			}
+			fmt.Print("  ", hex.EncodeToString(m.Pl[:l]))
+			if l<len(m.Pl) {
+				fmt.Print("...")
+			}
+			fmt.Println()
+		} else {
+			fmt.Println()
+		}
+		cnt++
+		bts += uint64(len(m.Pl))
+	}
+	fmt.Println(cnt, "messages:", cnt-sent, "received and", sent, "sent -", bts, "bytes of payload")
+}
+
+
+// Prints what the node sends back
+func read_answers(c net.Conn, magic [4]byte) {
+	rd := bufio.NewReader(c)
+	for {
+		var hdr [protocol.MsgHeaderLen]byte
+		if _, e := io.ReadFull(rd, hdr[:]); e != nil {
+			return
+		}
+		h, _ := protocol.ParseMsgHeader(hdr[:])
+		if h.Magic != magic {
+			fmt.Println("Bad magic from the node")
+			return
+		}
+		le := h.Len
+		if le > 4*btc.MAX_BLOCK_SIZE {
+			fmt.Println("Message too big from the node")
+			return
+		}
+		pl := make([]byte, le)
+		if _, e := io.ReadFull(rd, pl); e != nil {
+			return
+		}
+		fmt.Printf("   <- %-12s %8d\n", h.Cmd, le)
+	}
+}
+
+
+func replay(fn, addr string, fast bool) {
+	f, rd, h := open_capture(fn)
+	var msgs []*utils.CapMsg
+	for {
+		m, e := utils.ReadCapMsg(rd)
+		if e != nil {
+			if e != io.EOF {
+				println(e.Error())
+			}
+			break
+		}
+		if !m.Sent {
+			msgs = append(msgs, m)
+		}
+	}
+	f.Close()
+
+	if addr=="" {
+		if h.Magic==testnetMagic {
+			addr = "127.0.0.1:18333"
+		} else {
+			addr = "127.0.0.1:8333"
+		}
+	}
+	c, e := net.Dial("tcp4", addr)
+	if e != nil {
+		println(e.Error())
+		os.Exit(1)
+	}
+	defer c.Close()
+	fmt.Println("Replaying", len(msgs), "messages to", addr)
+	go read_answers(c, h.Magic)
+
+	for i, m := range msgs {
+		if !fast && i>0 {
+			time.Sleep(m.Time.Sub(msgs[i-1].Time))
+		}
+		if _, e = c.Write(protocol.NewMsg(h.Magic, m.Cmd, m.Pl)); e != nil {
+			println(e.Error())
+			return
+		}
+		fmt.Printf("-> %-12s %8d\n", m.Cmd, len(m.Pl))
+	}
+	time.Sleep(3*time.Second) // give the node some time to answer
+}
+
+
+func main() {
+	if len(os.Args)<3 {
+		usage()
+		return
+	}
+	var flag bool
+	var addr string
+	for _, a := range os.Args[3:] {
+		if a=="-x" || a=="-fast" {
+			flag = true
+		} else {
+			addr = a
+		}
+	}
+	switch os.Args[1] {
+		case "dump":
+			dump(os.Args[2], flag)
+		case "replay":
+			replay(os.Args[2], addr, flag)
+		default:
+			usage()
+	}
+}
@@ -30,7 +30,7 @@ func main() {
 	if len(os.Args)>1 {
 		dir = os.Args[1]
 	} else {
-		dir = utils.BitcoinHome() + "gocoin" + string(os.PathSeparator) + "btcnet" + string(os.PathSeparator) + "peers3"
+		dir = utils.BitcoinHome() + "gocoin" + string(os.PathSeparator) + "btcnet" + string(os.PathSeparator) + "peers4"
 	}
 
 	db, er := qdb.NewDB(dir, true)
@@ -48,6 +48,9 @@ func main() {
 	tmp := make(manyPeers, db.Count())
 	cnt := 0
 	db.Browse(func(k qdb.KeyType, v []byte) uint32 {
+		if len(v)<30 {
+			return 0 // not a peer (e.g. a ban record)
+		}
 		np := utils.NewPeer(v)
 		if !utils.ValidIp4(np.Ip4[:]) {
 			return 0